@@ -2,12 +2,21 @@ package ai
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
+	"sync"
 
-	"github.com/aki-colt/aiterm/terminal"
+	"github.com/aki-colt/aiterm/audit"
 	"github.com/openai/openai-go"
 	"github.com/openai/openai-go/option"
-	"github.com/rivo/tview"
+)
+
+var (
+	// ErrRefusal is reported when the model refuses to answer
+	ErrRefusal = errors.New("model refused")
+	// ErrRejected is returned to the model when the user declines a command
+	ErrRejected = errors.New("the user rejected this command")
 )
 
 type AiConfig struct {
@@ -41,72 +50,173 @@ func (c AiConfig) Validate() error {
 	return fmt.Errorf("model %s not found", c.Model)
 }
 
+// CommandResult is what an Executor reports about a finished command
+type CommandResult struct {
+	Output   string
+	ExitCode int // -1 when the executor cannot tell
+	Cwd      string
+}
+
+// Executor runs commands on behalf of the model
+type Executor interface {
+	Execute(command string) (CommandResult, error)
+}
+
 type AiClient struct {
-	client     openai.Client
-	params     openai.ChatCompletionNewParams
-	Tc         *terminal.TerminalController
-	DialogView *tview.TextView
+	client   openai.Client
+	params   openai.ChatCompletionNewParams
+	request  string // the user input that started the current turn
+	mutex    sync.Mutex
+	commands []audit.Entry // commands run in this session
+	// usage sums the tokens of the session, contextTokens is the size of
+	// the conversation at the last response
+	usage         Usage
+	contextTokens int64
+	Executor      Executor
+	// Panes is set with SetPanes when commands can run in several panes
+	Panes Panes
+	// Keys is set with SetKeySender when the model can type into panes
+	Keys    KeySender
+	Handler Handler
+	// Approve is asked before each command is executed; nil runs everything
+	Approve func(ctx context.Context, command string) bool
+	// ReviewPlan shows the steps of a proposed plan to the user, who may
+	// change them, and returns the approved steps; nil approves every plan
+	ReviewPlan func(ctx context.Context, steps []string) ([]string, bool)
+	planning   bool  // plan mode, set with SetPlanning
+	plan       *Plan // the approved plan, nil when there is none
+	plans      int   // plans approved in this session
+	// environment describes where commands run, for the system prompt
+	environment string
+	// prompts holds the index in the messages of each request of the user,
+	// as notes from AddContext are user messages too
+	prompts []int
+	// Redact masks secrets in tool results and added context before they are
+	// sent to the model, and counts them by kind. Nil sends them as they are.
+	Redact func(text string) (string, map[string]int)
+	// Audit records every command when set
+	Audit   *audit.Log
+	Session string
 }
 
-func Init(tc *terminal.TerminalController, dv *tview.TextView, cfg AiConfig) *AiClient {
+// Init creates a client for the configured provider. Extra options, such as a
+// custom HTTP client, are applied after the configuration.
+func Init(executor Executor, handler Handler, cfg AiConfig, opts ...option.RequestOption) *AiClient {
+	opts = append([]option.RequestOption{
+		option.WithBaseURL(cfg.URL),
+		option.WithAPIKey(cfg.Token),
+	}, opts...)
 	return &AiClient{
-		client: openai.NewClient(
-			option.WithBaseURL(cfg.URL),
-			option.WithAPIKey(cfg.Token),
-		),
+		client: openai.NewClient(opts...),
 		params: openai.ChatCompletionNewParams{
 			Model:    cfg.Model,
 			Messages: []openai.ChatCompletionMessageParamUnion{openai.SystemMessage(prompt)},
 			Seed:     openai.Int(0),
-			Tools:    tools,
+			Tools:    slices.Clone(tools),
+			// Ask for a final chunk with the token usage
+			StreamOptions: openai.ChatCompletionStreamOptionsParam{IncludeUsage: openai.Bool(true)},
 		},
-		Tc:         tc,
-		DialogView: dv,
+		Executor: executor,
+		Handler:  handler,
+	}
+}
+
+// Commands returns the commands run or rejected in this session
+func (c *AiClient) Commands() []audit.Entry {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return append([]audit.Entry(nil), c.commands...)
+}
+
+// emit sends an event to the handler if there is one
+func (c *AiClient) emit(e Event) {
+	if c.Handler != nil {
+		c.Handler.HandleEvent(e)
 	}
 }
 
-func (c *AiClient) Run(ctx context.Context, input string, app *tview.Application) error {
+// Run sends the input to the model and keeps the conversation going until the
+// model stops calling tools. Progress is reported through the handler, and the
+// turn always ends with an EventTurnDone.
+func (c *AiClient) Run(ctx context.Context, input string) error {
+	defer c.emit(Event{Type: EventTurnDone})
+	return c.run(ctx, input)
+}
+
+// run is Run without the EventTurnDone, for turns made of several runs
+func (c *AiClient) run(ctx context.Context, input string) error {
 	if input != "" {
+		c.request = input
+		c.prompts = append(c.prompts, len(c.params.Messages))
 		c.params.Messages = append(c.params.Messages, openai.UserMessage(input))
 	}
+	for {
+		calls, err := c.step(ctx)
+		if err != nil {
+			c.emit(Event{Type: EventError, Err: err})
+			return err
+		}
+		if len(calls) == 0 {
+			return nil
+		}
+		for _, call := range calls {
+			c.emit(Event{Type: EventToolCallStarted, ToolCall: &call})
+			res, redacted := c.redact(c.dealTool(ctx, call))
+			c.params.Messages = append(c.params.Messages, openai.ToolMessage(res, call.ID))
+			c.emit(Event{Type: EventToolCallFinished, ToolCall: &call, Result: res})
+			if len(redacted) > 0 {
+				c.emit(Event{Type: EventRedacted, ToolCall: &call, Redacted: redacted})
+			}
+		}
+		if err := ctx.Err(); err != nil {
+			c.emit(Event{Type: EventError, Err: err})
+			return err
+		}
+	}
+}
+
+// redact masks the secrets of text if redaction is on
+func (c *AiClient) redact(text string) (string, map[string]int) {
+	if c.Redact == nil {
+		return text, nil
+	}
+	return c.Redact(text)
+}
+
+// step streams one model response into the conversation and returns the tool
+// calls it asked for
+func (c *AiClient) step(ctx context.Context) ([]ToolCall, error) {
 	stream := c.client.Chat.Completions.NewStreaming(ctx, c.params)
+	defer stream.Close()
 	acc := openai.ChatCompletionAccumulator{}
 
 	for stream.Next() {
 		chunk := stream.Current()
 		acc.AddChunk(chunk)
 
-		if content, ok := acc.JustFinishedContent(); ok {
-			c.params.Messages = append(c.params.Messages, openai.AssistantMessage(content))
-		}
-
-		// if using tool calls
-		if tool, ok := acc.JustFinishedToolCall(); ok {
-			assistantMsg := acc.Choices[0].Message
-			if len(assistantMsg.ToolCalls) > 0 {
-				c.params.Messages = append(c.params.Messages, assistantMsg.ToParam())
-			}
-
-			res := c.dealTool(tool)
-			c.params.Messages = append(c.params.Messages, res)
-
-			c.Run(ctx, "", app)
-		}
-
-		if refusal, ok := acc.JustFinishedRefusal(); ok {
-			println("Refusal stream finished:", refusal)
-		}
-
-		if len(chunk.Choices) > 0 {
-			app.QueueUpdateDraw(func() {
-				fmt.Fprint(c.DialogView, chunk.Choices[0].Delta.Content)
-				c.DialogView.ScrollToEnd()
-			})
+		if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
+			c.emit(Event{Type: EventTextDelta, Text: chunk.Choices[0].Delta.Content})
 		}
 	}
 
 	if stream.Err() != nil {
-		return stream.Err()
+		return nil, stream.Err()
+	}
+	if acc.Usage.PromptTokens > 0 || acc.Usage.CompletionTokens > 0 {
+		c.addUsage(Usage{Model: c.params.Model, PromptTokens: acc.Usage.PromptTokens, CompletionTokens: acc.Usage.CompletionTokens})
+	}
+	if len(acc.Choices) == 0 {
+		return nil, nil
+	}
+
+	msg := acc.Choices[0].Message
+	c.params.Messages = append(c.params.Messages, msg.ToParam())
+	if msg.Refusal != "" {
+		return nil, fmt.Errorf("%w: %s", ErrRefusal, msg.Refusal)
+	}
+	calls := make([]ToolCall, 0, len(msg.ToolCalls))
+	for _, tool := range msg.ToolCalls {
+		calls = append(calls, ToolCall{ID: tool.ID, Name: tool.Function.Name, Arguments: tool.Function.Arguments})
 	}
-	return nil
+	return calls, nil
 }
@@ -0,0 +1,798 @@
+package ai_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aki-colt/aiterm/ai"
+	"github.com/aki-colt/aiterm/audit"
+	"github.com/aki-colt/aiterm/internal/llmtest"
+)
+
+type recorder struct {
+	mutex  sync.Mutex
+	events []ai.Event
+}
+
+func (r *recorder) HandleEvent(e ai.Event) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *recorder) types() []ai.EventType {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var types []ai.EventType
+	for _, e := range r.events {
+		// Collapse runs of text deltas to keep expectations readable
+		if e.Type == ai.EventTextDelta && len(types) > 0 && types[len(types)-1] == ai.EventTextDelta {
+			continue
+		}
+		types = append(types, e.Type)
+	}
+	return types
+}
+
+func (r *recorder) text() string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var sb strings.Builder
+	for _, e := range r.events {
+		if e.Type == ai.EventTextDelta {
+			sb.WriteString(e.Text)
+		}
+	}
+	return sb.String()
+}
+
+func (r *recorder) results() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var results []string
+	for _, e := range r.events {
+		if e.Type == ai.EventToolCallFinished {
+			results = append(results, e.Result)
+		}
+	}
+	return results
+}
+
+func newClient(t *testing.T, responses ...llmtest.Response) (*ai.AiClient, *llmtest.Server, *llmtest.Executor, *recorder) {
+	t.Helper()
+	srv := llmtest.NewServer(responses...)
+	t.Cleanup(srv.Close)
+	exec := llmtest.NewExecutor()
+	rec := &recorder{}
+	client := ai.Init(exec, rec, ai.AiConfig{URL: srv.URL, Token: "test", Model: "test-model"})
+	return client, srv, exec, rec
+}
+
+func assertTypes(t *testing.T, got []ai.EventType, want ...ai.EventType) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("events = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("events = %v, want %v", got, want)
+		}
+	}
+}
+
+func TestRunText(t *testing.T) {
+	client, srv, _, rec := newClient(t, llmtest.Text("Hello", ", world"))
+
+	if err := client.Run(context.Background(), "hi"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	assertTypes(t, rec.types(), ai.EventTextDelta, ai.EventTurnDone)
+	if got := rec.text(); got != "Hello, world" {
+		t.Errorf("text = %q", got)
+	}
+	msgs := srv.Messages(0)
+	if len(msgs) != 2 || msgs[1]["role"] != "user" || msgs[1]["content"] != "hi" {
+		t.Errorf("messages = %v", msgs)
+	}
+}
+
+func TestRunMultiStepToolUse(t *testing.T) {
+	first := llmtest.Call("call_1", "checkCommand", `{"cmd":"sh -c true"}`)
+	first.Text = []string{"Let me check."}
+	client, srv, exec, rec := newClient(t,
+		first,
+		llmtest.Call("call_2", "executeCommand", `{"cmd":"ls"}`),
+		llmtest.Text("There are ", "two files."),
+	)
+	exec.Outputs["ls"] = "a.txt\nb.txt"
+
+	if err := client.Run(context.Background(), "list files"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	assertTypes(t, rec.types(),
+		ai.EventTextDelta,
+		ai.EventToolCallStarted, ai.EventToolCallFinished,
+		ai.EventToolCallStarted, ai.EventCommandOutput, ai.EventToolCallFinished,
+		ai.EventTextDelta,
+		ai.EventTurnDone,
+	)
+	if got := exec.Commands(); len(got) != 1 || got[0] != "ls" {
+		t.Errorf("commands = %v", got)
+	}
+	if got := rec.results(); len(got) != 2 || got[0] != "true" || got[1] != "a.txt\nb.txt" {
+		t.Errorf("results = %q", got)
+	}
+
+	// The last request carries the whole exchange, tool results included
+	msgs := srv.Messages(2)
+	if len(msgs) != 6 {
+		t.Fatalf("messages = %v", msgs)
+	}
+	last := msgs[5]
+	if last["role"] != "tool" || last["tool_call_id"] != "call_2" || last["content"] != "a.txt\nb.txt" {
+		t.Errorf("tool message = %v", last)
+	}
+	calls, _ := msgs[4]["tool_calls"].([]any)
+	if len(calls) != 1 {
+		t.Errorf("assistant message = %v", msgs[4])
+	}
+}
+
+func TestRunExecutorError(t *testing.T) {
+	client, _, exec, rec := newClient(t,
+		llmtest.Call("call_1", "executeCommand", `{"cmd":"make"}`),
+		llmtest.Text("The build failed."),
+	)
+	exec.Errors["make"] = errors.New("pane closed")
+
+	if err := client.Run(context.Background(), "build it"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	results := rec.results()
+	if len(results) != 1 || !strings.Contains(results[0], "pane closed") {
+		t.Errorf("results = %q", results)
+	}
+}
+
+func TestRunMalformedArguments(t *testing.T) {
+	client, srv, exec, rec := newClient(t,
+		llmtest.Call("call_1", "executeCommand", `{"cmd": ls`),
+		llmtest.Text("Sorry."),
+	)
+
+	if err := client.Run(context.Background(), "list files"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got := exec.Commands(); len(got) != 0 {
+		t.Errorf("commands = %v", got)
+	}
+	results := rec.results()
+	if len(results) != 1 || !strings.HasPrefix(results[0], "unmarshal param error") {
+		t.Errorf("results = %q", results)
+	}
+	if len(srv.Requests()) != 2 {
+		t.Errorf("requests = %d, want 2", len(srv.Requests()))
+	}
+}
+
+func TestRunUnknownTool(t *testing.T) {
+	client, _, _, rec := newClient(t,
+		llmtest.Call("call_1", "rmEverything", `{}`),
+		llmtest.Text("ok"),
+	)
+
+	if err := client.Run(context.Background(), "go"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if results := rec.results(); len(results) != 1 || results[0] != "no tool named rmEverything" {
+		t.Errorf("results = %q", results)
+	}
+}
+
+func TestRunAPIError(t *testing.T) {
+	client, _, _, rec := newClient(t, llmtest.Response{Status: 400})
+
+	if err := client.Run(context.Background(), "hi"); err == nil {
+		t.Fatal("Run succeeded, want error")
+	}
+	assertTypes(t, rec.types(), ai.EventError, ai.EventTurnDone)
+}
+
+func TestRunRefusal(t *testing.T) {
+	client, _, _, rec := newClient(t, llmtest.Response{Refusal: "I can't help with that."})
+
+	err := client.Run(context.Background(), "rm -rf /")
+	if !errors.Is(err, ai.ErrRefusal) {
+		t.Fatalf("Run = %v, want ErrRefusal", err)
+	}
+	assertTypes(t, rec.types(), ai.EventError, ai.EventTurnDone)
+}
+
+func TestRunCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	srv := llmtest.NewServer(llmtest.Response{Text: []string{"Thinking"}, Hang: true})
+	defer srv.Close()
+	rec := &recorder{}
+	client := ai.Init(llmtest.NewExecutor(), ai.HandlerFunc(func(e ai.Event) {
+		rec.HandleEvent(e)
+		if e.Type == ai.EventTextDelta {
+			cancel()
+		}
+	}), ai.AiConfig{URL: srv.URL, Token: "test", Model: "test-model"})
+
+	done := make(chan error, 1)
+	go func() { done <- client.Run(ctx, "hi") }()
+	select {
+	case err := <-done:
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Run = %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after cancel")
+	}
+	types := rec.types()
+	if types[len(types)-1] != ai.EventTurnDone {
+		t.Errorf("events = %v, want to end with turn_done", types)
+	}
+}
+
+func TestRunAudit(t *testing.T) {
+	client, _, exec, _ := newClient(t,
+		llmtest.Call("call_1", "executeCommand", `{"cmd":"make"}`),
+		llmtest.Call("call_2", "executeCommand", `{"cmd":"rm -rf /"}`),
+		llmtest.Text("Done."),
+	)
+	exec.Outputs["make"] = "ok"
+	exec.ExitCodes["make"] = 2
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	log, err := audit.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	client.Audit = log
+	client.Session = "test-session"
+	client.Approve = func(_ context.Context, command string) bool {
+		return command == "make"
+	}
+
+	if err := client.Run(context.Background(), "build it"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if got := exec.Commands(); len(got) != 1 || got[0] != "make" {
+		t.Errorf("commands = %v", got)
+	}
+
+	entries, err := audit.Read(path)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("entries = %+v", entries)
+	}
+	e := entries[0]
+	if e.Session != "test-session" || e.Model != "test-model" || e.Request != "build it" ||
+		e.Command != "make" || e.Cwd != "/work" || e.ExitCode == nil || *e.ExitCode != 2 ||
+		e.Approval != audit.ApprovalApproved {
+		t.Errorf("entry = %+v", e)
+	}
+	if e := entries[1]; e.Command != "rm -rf /" || e.Approval != audit.ApprovalRejected {
+		t.Errorf("entry = %+v", e)
+	}
+}
+
+func TestUndoAndReset(t *testing.T) {
+	client, srv, exec, _ := newClient(t,
+		llmtest.Text("Hi."),
+		llmtest.Call("call_1", "executeCommand", `{"cmd":"ls"}`),
+		llmtest.Text("Two files."),
+		llmtest.Text("Hello again."),
+	)
+	exec.Outputs["ls"] = "a\nb"
+	ctx := context.Background()
+	if err := client.Run(ctx, "hi"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := client.Run(ctx, "list files"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if n, _ := client.ContextSize(); n != 7 {
+		t.Fatalf("messages = %d, want 7", n)
+	}
+
+	// A note after the request is not taken for it
+	client.AddContext("I ran `ls` myself. Its output:\na\nb")
+	if got, ok := client.Undo(); !ok || got != "list files" {
+		t.Fatalf("Undo = %q, %v", got, ok)
+	}
+	if n, _ := client.ContextSize(); n != 3 {
+		t.Errorf("messages after Undo = %d, want 3", n)
+	}
+
+	client.Reset()
+	if _, ok := client.Undo(); ok {
+		t.Error("Undo after Reset found a request")
+	}
+	if err := client.Run(ctx, "hello"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if msgs := srv.Messages(3); len(msgs) != 2 || msgs[1]["content"] != "hello" {
+		t.Errorf("messages after Reset = %v", msgs)
+	}
+}
+
+func TestRunUsage(t *testing.T) {
+	first := llmtest.Call("call_1", "executeCommand", `{"cmd":"ls"}`)
+	first.PromptTokens, first.CompletionTokens = 100, 10
+	second := llmtest.Text("Done.")
+	second.PromptTokens, second.CompletionTokens = 130, 5
+	client, srv, exec, rec := newClient(t, first, second)
+	exec.Outputs["ls"] = "a.txt"
+
+	if err := client.Run(context.Background(), "list files"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	assertTypes(t, rec.types(),
+		ai.EventUsage,
+		ai.EventToolCallStarted, ai.EventCommandOutput, ai.EventToolCallFinished,
+		ai.EventTextDelta, ai.EventUsage, ai.EventTurnDone,
+	)
+	if got := client.Usage(); got.PromptTokens != 230 || got.CompletionTokens != 15 {
+		t.Errorf("Usage = %+v", got)
+	}
+	if got := client.ContextTokens(); got != 135 {
+		t.Errorf("ContextTokens = %d, want 135", got)
+	}
+	opts, _ := srv.Requests()[0]["stream_options"].(map[string]any)
+	if opts["include_usage"] != true {
+		t.Errorf("stream_options = %v", srv.Requests()[0]["stream_options"])
+	}
+
+	info := ai.ModelInfo{InputPrice: 2, OutputPrice: 8}
+	if got := info.Cost(client.Usage()); got != 0.00058 {
+		t.Errorf("Cost = %v", got)
+	}
+	client.Reset()
+	if got := client.ContextTokens(); got != 0 {
+		t.Errorf("ContextTokens after Reset = %d", got)
+	}
+}
+
+// paneExecutor is a fake executor with named panes
+type paneExecutor struct {
+	*llmtest.Executor
+	names []string
+	ran   []string
+}
+
+func (e *paneExecutor) ExecuteIn(pane, command string) (ai.CommandResult, error) {
+	e.ran = append(e.ran, pane+": "+command)
+	return e.Execute(command)
+}
+
+func (e *paneExecutor) OpenPane(name string) error {
+	e.names = append(e.names, name)
+	return nil
+}
+
+func (e *paneExecutor) ClosePane(name string) error {
+	return errors.New("busy")
+}
+
+func (e *paneExecutor) PaneNames() []string {
+	return e.names
+}
+
+func toolNames(request map[string]any) []string {
+	tools, _ := request["tools"].([]any)
+	var names []string
+	for _, tool := range tools {
+		fn, _ := tool.(map[string]any)["function"].(map[string]any)
+		names = append(names, fn["name"].(string))
+	}
+	return names
+}
+
+func TestRunPanes(t *testing.T) {
+	srv := llmtest.NewServer(
+		llmtest.Call("call_1", "createPane", `{"name":"server"}`),
+		llmtest.Call("call_2", "executeCommand", `{"cmd":"serve","pane":"server"}`),
+		llmtest.Call("call_3", "closePane", `{"name":"server"}`),
+		llmtest.Text("The server is running."),
+	)
+	defer srv.Close()
+	exec := &paneExecutor{Executor: llmtest.NewExecutor(), names: []string{"main"}}
+	exec.Outputs["serve"] = "listening"
+	rec := &recorder{}
+	client := ai.Init(exec, rec, ai.AiConfig{URL: srv.URL, Token: "test", Model: "test-model"})
+	client.SetPanes(exec)
+
+	if err := client.Run(context.Background(), "start the server"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	results := rec.results()
+	if len(results) != 3 || results[0] != "panes: main, server" || results[1] != "listening" || !strings.Contains(results[2], "busy") {
+		t.Errorf("results = %q", results)
+	}
+	if len(exec.ran) != 1 || exec.ran[0] != "server: serve" {
+		t.Errorf("ran = %q", exec.ran)
+	}
+	if names := toolNames(srv.Requests()[0]); !strings.Contains(strings.Join(names, ","), "createPane,closePane") {
+		t.Errorf("tools = %v", names)
+	}
+}
+
+func TestRunPaneWithoutPanes(t *testing.T) {
+	client, srv, exec, rec := newClient(t,
+		llmtest.Call("call_1", "executeCommand", `{"cmd":"ls","pane":"tests"}`),
+		llmtest.Text("No panes."),
+	)
+	exec.Outputs["ls"] = "a.txt"
+
+	if err := client.Run(context.Background(), "list files"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if results := rec.results(); len(results) != 1 || !strings.Contains(results[0], ai.ErrNoPanes.Error()) {
+		t.Errorf("results = %q", results)
+	}
+	if len(exec.Commands()) != 0 {
+		t.Errorf("commands = %v", exec.Commands())
+	}
+	if names := toolNames(srv.Requests()[0]); strings.Contains(strings.Join(names, ","), "createPane") {
+		t.Errorf("tools = %v", names)
+	}
+}
+
+// keySender records the keys typed by the model
+type keySender struct {
+	keys []string
+}
+
+func (k *keySender) SendKeys(pane string, keys []string) (string, error) {
+	k.keys = append(k.keys, pane+": "+strings.Join(keys, " "))
+	return "Continue? [y/N] y\ndone", nil
+}
+
+func TestRunSendKeys(t *testing.T) {
+	client, srv, _, rec := newClient(t,
+		llmtest.Call("call_1", "sendKeys", `{"keys":["y","Enter"]}`),
+		llmtest.Text("Done."),
+	)
+	keys := &keySender{}
+	client.SetKeySender(keys)
+
+	if err := client.Run(context.Background(), "answer yes"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if len(keys.keys) != 1 || keys.keys[0] != ": y Enter" {
+		t.Errorf("keys = %q", keys.keys)
+	}
+	if results := rec.results(); len(results) != 1 || !strings.HasSuffix(results[0], "done") {
+		t.Errorf("results = %q", results)
+	}
+	if names := toolNames(srv.Requests()[0]); !strings.Contains(strings.Join(names, ","), "sendKeys") {
+		t.Errorf("tools = %v", names)
+	}
+	if entries := client.Commands(); len(entries) != 1 || entries[0].Command != "y Enter" || !entries[0].Keys {
+		t.Errorf("entries = %+v", entries)
+	}
+}
+
+func TestRunSendKeysApproval(t *testing.T) {
+	client, _, _, rec := newClient(t,
+		llmtest.Call("call_1", "sendKeys", `{"keys":["rm -rf ~","Enter"],"pane":"build"}`),
+		llmtest.Call("call_2", "sendKeys", `{"keys":[]}`),
+		llmtest.Text("OK."),
+	)
+	keys := &keySender{}
+	client.SetKeySender(keys)
+	var asked []string
+	client.Approve = func(_ context.Context, command string) bool {
+		asked = append(asked, command)
+		return false
+	}
+
+	if err := client.Run(context.Background(), "clean up"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	// Looking at the screen needs no approval
+	if len(asked) != 1 || asked[0] != "Type into pane build: rm -rf ~ Enter" {
+		t.Errorf("asked = %q", asked)
+	}
+	if len(keys.keys) != 1 || keys.keys[0] != ": " {
+		t.Errorf("keys = %q", keys.keys)
+	}
+	if results := rec.results(); len(results) != 2 || results[0] != ai.ErrRejected.Error() {
+		t.Errorf("results = %q", results)
+	}
+	if entries := client.Commands(); len(entries) != 1 || entries[0].Approval != audit.ApprovalRejected || !entries[0].Keys {
+		t.Errorf("entries = %+v", entries)
+	}
+}
+
+func TestRunRedact(t *testing.T) {
+	client, srv, exec, rec := newClient(t,
+		llmtest.Call("call_1", "executeCommand", `{"cmd":"env"}`),
+		llmtest.Text("Done."),
+		llmtest.Text("Noted."),
+	)
+	exec.Outputs["env"] = "HOME=/root\nTOKEN=s3cret"
+	client.Redact = func(text string) (string, map[string]int) {
+		n := strings.Count(text, "s3cret")
+		if n == 0 {
+			return text, nil
+		}
+		return strings.ReplaceAll(text, "s3cret", "[REDACTED:secret]"), map[string]int{"secret": n}
+	}
+
+	if err := client.Run(context.Background(), "show env"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	client.AddContext("I ran `cat .env` myself. Its output:\nTOKEN=s3cret")
+	if err := client.Run(context.Background(), ""); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	for i, msg := range srv.Messages(2) {
+		if content, _ := msg["content"].(string); strings.Contains(content, "s3cret") {
+			t.Errorf("message %d sent the secret: %q", i, content)
+		}
+	}
+	var redacted int
+	for _, e := range rec.events {
+		if e.Type == ai.EventRedacted {
+			redacted += e.Redacted["secret"]
+		}
+	}
+	if redacted != 2 {
+		t.Errorf("%d secrets reported, want 2", redacted)
+	}
+	// The user still sees the real output
+	for _, e := range rec.events {
+		if e.Type == ai.EventCommandOutput && !strings.Contains(e.Output, "s3cret") {
+			t.Errorf("command output = %q", e.Output)
+		}
+	}
+}
+
+// verifier fails the verification until the patch command is run
+type verifier struct {
+	*llmtest.Executor
+	fixed bool
+	runs  int
+}
+
+func (v *verifier) Execute(command string) (ai.CommandResult, error) {
+	if strings.HasPrefix(command, "sh -c ") {
+		v.runs++
+		// Like a tmux pane, which only knows the exit code from the output
+		if v.fixed {
+			return ai.CommandResult{Output: "$ " + command + "\nok\n[aiterm-exit 0]\n$", ExitCode: -1}, nil
+		}
+		return ai.CommandResult{Output: "$ " + command + "\nFAIL: TestParse\n[aiterm-exit 1]\n$", ExitCode: -1}, nil
+	}
+	if command == "patch" {
+		v.fixed = true
+	}
+	return v.Executor.Execute(command)
+}
+
+func fixStatuses(rec *recorder) []ai.FixStatus {
+	var statuses []ai.FixStatus
+	for _, e := range rec.events {
+		if e.Type == ai.EventFix {
+			statuses = append(statuses, *e.Fix)
+		}
+	}
+	return statuses
+}
+
+func TestFixUntilGreen(t *testing.T) {
+	client, srv, exec, rec := newClient(t,
+		llmtest.Call("call_1", "executeCommand", `{"cmd":"patch"}`),
+		llmtest.Text("Patched the parser."),
+		llmtest.Text("Changed parse.go."),
+	)
+	exec.Outputs["patch"] = "patched"
+	v := &verifier{Executor: exec}
+	client.Executor = v
+
+	green, err := client.FixUntilGreen(context.Background(), ai.FixOptions{Goal: "make the tests pass", Verify: "go test ./..."})
+	if err != nil || !green {
+		t.Fatalf("FixUntilGreen = %v, %v", green, err)
+	}
+	if v.runs != 2 {
+		t.Errorf("verified %d times, want 2", v.runs)
+	}
+	statuses := fixStatuses(rec)
+	if len(statuses) != 2 || statuses[0].ExitCode != 1 || statuses[0].Done || !statuses[1].Green || statuses[1].Attempt != 1 || statuses[1].Commands != 3 {
+		t.Errorf("statuses = %+v", statuses)
+	}
+
+	msgs := srv.Messages(0)
+	first, _ := msgs[len(msgs)-1]["content"].(string)
+	if !strings.Contains(first, "FAIL: TestParse") || !strings.Contains(first, "make the tests pass") || strings.Contains(first, "aiterm-exit") {
+		t.Errorf("fix request = %q", first)
+	}
+	msgs = srv.Messages(2)
+	last, _ := msgs[len(msgs)-1]["content"].(string)
+	if !strings.Contains(last, "now succeeds") || !strings.Contains(last, "Summarize") {
+		t.Errorf("summary request = %q", last)
+	}
+	if commands := client.Commands(); len(commands) != 3 || commands[0].Command != "go test ./..." || *commands[0].ExitCode != 1 {
+		t.Errorf("commands = %+v", commands)
+	}
+	var turns int
+	for _, typ := range rec.types() {
+		if typ == ai.EventTurnDone {
+			turns++
+		}
+	}
+	if turns != 1 {
+		t.Errorf("%d turns, want 1", turns)
+	}
+}
+
+func TestFixUntilGreenRejected(t *testing.T) {
+	client, srv, exec, _ := newClient(t)
+	v := &verifier{Executor: exec}
+	client.Executor = v
+	var asked []string
+	client.Approve = func(_ context.Context, command string) bool {
+		asked = append(asked, command)
+		return false
+	}
+
+	if _, err := client.FixUntilGreen(context.Background(), ai.FixOptions{Verify: "make"}); !errors.Is(err, ai.ErrRejected) {
+		t.Fatalf("FixUntilGreen = %v", err)
+	}
+	if len(asked) != 1 || !strings.Contains(asked[0], "make") || v.runs != 0 || len(srv.Requests()) != 0 {
+		t.Errorf("asked %q, verified %d times, %d requests", asked, v.runs, len(srv.Requests()))
+	}
+	if commands := client.Commands(); len(commands) != 1 || commands[0].Approval != audit.ApprovalRejected {
+		t.Errorf("commands = %+v", commands)
+	}
+}
+
+func TestFixUntilGreenGivesUp(t *testing.T) {
+	client, srv, exec, rec := newClient(t,
+		llmtest.Text("Tried a fix."),
+		llmtest.Text("Tried another fix."),
+		llmtest.Text("Nothing worked."),
+	)
+	v := &verifier{Executor: exec}
+	client.Executor = v
+
+	green, err := client.FixUntilGreen(context.Background(), ai.FixOptions{Verify: "make", MaxAttempts: 2})
+	if err != nil || green {
+		t.Fatalf("FixUntilGreen = %v, %v", green, err)
+	}
+	statuses := fixStatuses(rec)
+	if len(statuses) != 3 || !statuses[2].Done || statuses[2].Green || statuses[2].Attempt != 2 {
+		t.Errorf("statuses = %+v", statuses)
+	}
+	msgs := srv.Messages(2)
+	if last, _ := msgs[len(msgs)-1]["content"].(string); !strings.Contains(last, "still fails with exit code 1 after 2 fixes") {
+		t.Errorf("summary request = %q", last)
+	}
+}
+
+func TestFixUntilGreenAlreadyGreen(t *testing.T) {
+	client, srv, exec, rec := newClient(t)
+	client.Executor = &verifier{Executor: exec, fixed: true}
+
+	green, err := client.FixUntilGreen(context.Background(), ai.FixOptions{Verify: "make"})
+	if err != nil || !green {
+		t.Fatalf("FixUntilGreen = %v, %v", green, err)
+	}
+	if len(srv.Requests()) != 0 {
+		t.Errorf("%d requests to the model", len(srv.Requests()))
+	}
+	if statuses := fixStatuses(rec); len(statuses) != 1 || !statuses[0].Green || !statuses[0].Done {
+		t.Errorf("statuses = %+v", statuses)
+	}
+}
+
+func planEvents(rec *recorder) []*ai.Plan {
+	var plans []*ai.Plan
+	for _, e := range rec.events {
+		if e.Type == ai.EventPlan {
+			plans = append(plans, e.Plan)
+		}
+	}
+	return plans
+}
+
+func TestRunPlan(t *testing.T) {
+	client, _, _, rec := newClient(t,
+		llmtest.Call("call_1", "proposePlan", `{"steps":["install","migrate"]}`),
+		llmtest.Call("call_2", "updatePlan", `{"step":1,"status":"running"}`),
+		llmtest.Call("call_3", "updatePlan", `{"step":1,"status":"done","note":"3 packages"}`),
+		llmtest.Call("call_4", "updatePlan", `{"step":2,"status":"failed","note":"no database"}`),
+		llmtest.Text("Migrations failed."),
+	)
+	client.SetPlanning(true)
+	var reviewed []string
+	client.ReviewPlan = func(ctx context.Context, steps []string) ([]string, bool) {
+		reviewed = steps
+		return []string{"install deps", "migrate"}, true
+	}
+
+	if err := client.Run(context.Background(), "set up the app"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if strings.Join(reviewed, ",") != "install,migrate" {
+		t.Errorf("reviewed %q", reviewed)
+	}
+	results := rec.results()
+	if len(results) != 4 || !strings.Contains(results[0], "approved this plan after editing it:\n1. [pending] install deps\n2. [pending] migrate") {
+		t.Fatalf("results = %q", results)
+	}
+	if results[3] != "1. [done] install deps (3 packages)\n2. [failed] migrate (no database)\n" {
+		t.Errorf("last result = %q", results[3])
+	}
+
+	plans := planEvents(rec)
+	var statuses []string
+	for _, p := range plans {
+		statuses = append(statuses, string(p.Steps[0].Status)+"/"+string(p.Steps[1].Status))
+	}
+	want := "pending/pending,running/pending,done/pending,done/failed"
+	if strings.Join(statuses, ",") != want {
+		t.Errorf("statuses = %s, want %s", strings.Join(statuses, ","), want)
+	}
+}
+
+func TestRunPlanRejected(t *testing.T) {
+	client, _, _, rec := newClient(t,
+		llmtest.Call("call_1", "proposePlan", `{"steps":["rm -rf build"]}`),
+		llmtest.Call("call_2", "updatePlan", `{"step":1,"status":"running"}`),
+		llmtest.Text("OK."),
+	)
+	client.SetPlanning(true)
+	client.ReviewPlan = func(ctx context.Context, steps []string) ([]string, bool) {
+		return nil, false
+	}
+
+	if err := client.Run(context.Background(), "clean"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	results := rec.results()
+	if len(results) != 2 || !strings.Contains(results[0], "rejected the plan") || !strings.Contains(results[1], "no approved plan") {
+		t.Errorf("results = %q", results)
+	}
+	if plans := planEvents(rec); len(plans) != 0 {
+		t.Errorf("plans = %v", plans)
+	}
+}
+
+func TestPlanningOff(t *testing.T) {
+	client, srv, _, rec := newClient(t,
+		llmtest.Text("OK."),
+		llmtest.Call("call_1", "proposePlan", `{"steps":["build"]}`),
+		llmtest.Text("OK."),
+	)
+	if err := client.Run(context.Background(), "build"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if names := strings.Join(toolNames(srv.Requests()[0]), ","); strings.Contains(names, "proposePlan") {
+		t.Errorf("tools without plan mode = %s", names)
+	}
+
+	client.SetPlanning(true)
+	client.SetPlanning(false)
+	if err := client.Run(context.Background(), "build again"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if names := strings.Join(toolNames(srv.Requests()[1]), ","); strings.Contains(names, "proposePlan") {
+		t.Errorf("tools after plan mode = %s", names)
+	}
+	if results := rec.results(); len(results) != 1 || !strings.Contains(results[0], "plan mode is off") {
+		t.Errorf("results = %q", results)
+	}
+}
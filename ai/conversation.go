@@ -0,0 +1,92 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/openai/openai-go"
+)
+
+// Model returns the model the conversation is sent to
+func (c *AiClient) Model() string {
+	return c.params.Model
+}
+
+// SetModel switches the model used for the next requests
+func (c *AiClient) SetModel(model string) {
+	c.params.Model = model
+}
+
+// ListModels returns the ids of the models offered by the provider
+func (c *AiClient) ListModels(ctx context.Context) ([]string, error) {
+	page, err := c.client.Models.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(page.Data))
+	for _, m := range page.Data {
+		ids = append(ids, m.ID)
+	}
+	return ids, nil
+}
+
+// SetEnvironment tells the model where its commands run, e.g. the OS and
+// shell of a remote host. It is kept by Reset.
+func (c *AiClient) SetEnvironment(description string) {
+	c.environment = description
+	c.updateSystem()
+}
+
+// updateSystem sets the system prompt for the plan mode and the environment
+func (c *AiClient) updateSystem() {
+	system := prompt
+	if c.planning {
+		system += "\n\n### Planning\n" + planPrompt
+	}
+	if c.environment != "" {
+		system += "\n\n### Environment\n" + c.environment
+	}
+	c.params.Messages[0] = openai.SystemMessage(system)
+}
+
+// Reset forgets the conversation, keeping only the system prompt
+func (c *AiClient) Reset() {
+	c.params.Messages = c.params.Messages[:1]
+	c.prompts = nil
+	c.request = ""
+	c.plan = nil
+	c.mutex.Lock()
+	c.contextTokens = 0
+	c.mutex.Unlock()
+}
+
+// Undo drops the last user request and everything that followed it from the
+// conversation, notes from AddContext included. It returns the dropped
+// request.
+func (c *AiClient) Undo() (string, bool) {
+	if len(c.prompts) == 0 {
+		return "", false
+	}
+	i := c.prompts[len(c.prompts)-1]
+	c.prompts = c.prompts[:len(c.prompts)-1]
+	request := c.params.Messages[i].OfUser.Content.OfString.Value
+	c.params.Messages = c.params.Messages[:i]
+	return request, true
+}
+
+// AddContext appends a note from the user to the conversation without asking
+// the model, e.g. the output of a command the user ran
+func (c *AiClient) AddContext(text string) {
+	text, redacted := c.redact(text)
+	c.params.Messages = append(c.params.Messages, openai.UserMessage(text))
+	if len(redacted) > 0 {
+		c.emit(Event{Type: EventRedacted, Redacted: redacted})
+	}
+}
+
+// ContextSize returns the number of messages in the conversation and their
+// size in bytes once encoded
+func (c *AiClient) ContextSize() (messages int, size int) {
+	data, _ := json.Marshal(c.params.Messages)
+	return len(c.params.Messages), len(data)
+}
@@ -0,0 +1,113 @@
+package ai
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// EventType identifies what happened in an agent turn
+type EventType string
+
+const (
+	EventTextDelta        EventType = "text_delta"
+	EventToolCallStarted  EventType = "tool_call_started"
+	EventToolCallFinished EventType = "tool_call_finished"
+	EventCommandOutput    EventType = "command_output"
+	EventUsage            EventType = "usage"
+	EventRedacted         EventType = "redacted"
+	EventFix              EventType = "fix"
+	EventPlan             EventType = "plan"
+	EventError            EventType = "error"
+	EventTurnDone         EventType = "turn_done"
+)
+
+// ToolCall describes a tool invocation requested by the model
+type ToolCall struct {
+	ID        string `json:"id"`
+	Name      string `json:"name"`
+	Arguments string `json:"arguments"`
+}
+
+// Event is emitted by AiClient.Run while it talks to the model and runs tools.
+// Only the fields relevant to Type are set.
+type Event struct {
+	Type     EventType
+	Text     string    // EventTextDelta
+	ToolCall *ToolCall // EventToolCallStarted, EventToolCallFinished
+	Result   string    // EventToolCallFinished
+	Command  string    // EventCommandOutput
+	Pane     string    // EventCommandOutput, empty for the main pane
+	Output   string    // EventCommandOutput
+	Cwd      string    // EventCommandOutput, when the executor knows it
+	Usage    *Usage    // EventUsage, the tokens of one response
+	// Redacted counts the secrets masked by kind, for EventRedacted
+	Redacted map[string]int
+	Fix      *FixStatus // EventFix
+	Plan     *Plan      // EventPlan, the plan with the status of its steps
+	Err      error      // EventError
+}
+
+// MarshalJSON encodes the event with its error as a plain string
+func (e Event) MarshalJSON() ([]byte, error) {
+	v := struct {
+		Type     EventType      `json:"type"`
+		Text     string         `json:"text,omitempty"`
+		ToolCall *ToolCall      `json:"tool_call,omitempty"`
+		Result   string         `json:"result,omitempty"`
+		Command  string         `json:"command,omitempty"`
+		Pane     string         `json:"pane,omitempty"`
+		Output   string         `json:"output,omitempty"`
+		Cwd      string         `json:"cwd,omitempty"`
+		Usage    *Usage         `json:"usage,omitempty"`
+		Redacted map[string]int `json:"redacted,omitempty"`
+		Fix      *FixStatus     `json:"fix,omitempty"`
+		Plan     *Plan          `json:"plan,omitempty"`
+		Error    string         `json:"error,omitempty"`
+	}{
+		Type:     e.Type,
+		Text:     e.Text,
+		ToolCall: e.ToolCall,
+		Result:   e.Result,
+		Command:  e.Command,
+		Pane:     e.Pane,
+		Output:   e.Output,
+		Cwd:      e.Cwd,
+		Usage:    e.Usage,
+		Redacted: e.Redacted,
+		Fix:      e.Fix,
+		Plan:     e.Plan,
+	}
+	if e.Err != nil {
+		v.Error = e.Err.Error()
+	}
+	return json.Marshal(v)
+}
+
+// Handler consumes events emitted by AiClient
+type Handler interface {
+	HandleEvent(Event)
+}
+
+// HandlerFunc adapts an ordinary function to a Handler
+type HandlerFunc func(Event)
+
+func (f HandlerFunc) HandleEvent(e Event) {
+	f(e)
+}
+
+// JSONLinesHandler writes every event as one JSON object per line
+type JSONLinesHandler struct {
+	mutex sync.Mutex
+	enc   *json.Encoder
+}
+
+func NewJSONLinesHandler(w io.Writer) *JSONLinesHandler {
+	return &JSONLinesHandler{enc: json.NewEncoder(w)}
+}
+
+func (h *JSONLinesHandler) HandleEvent(e Event) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.enc.Encode(e)
+}
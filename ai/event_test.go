@@ -0,0 +1,25 @@
+package ai_test
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/aki-colt/aiterm/ai"
+)
+
+func TestJSONLinesHandler(t *testing.T) {
+	var buf bytes.Buffer
+	h := ai.NewJSONLinesHandler(&buf)
+	h.HandleEvent(ai.Event{Type: ai.EventTextDelta, Text: "hi"})
+	h.HandleEvent(ai.Event{Type: ai.EventToolCallStarted, ToolCall: &ai.ToolCall{ID: "1", Name: "executeCommand", Arguments: `{"cmd":"ls"}`}})
+	h.HandleEvent(ai.Event{Type: ai.EventError, Err: errors.New("boom")})
+
+	want := `{"type":"text_delta","text":"hi"}
+{"type":"tool_call_started","tool_call":{"id":"1","name":"executeCommand","arguments":"{\"cmd\":\"ls\"}"}}
+{"type":"error","error":"boom"}
+`
+	if buf.String() != want {
+		t.Errorf("output =\n%s\nwant\n%s", buf.String(), want)
+	}
+}
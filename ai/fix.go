@@ -0,0 +1,160 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aki-colt/aiterm/audit"
+	"github.com/aki-colt/aiterm/internal/shell"
+)
+
+// DefaultFixAttempts is the number of fixes FixUntilGreen tries when
+// FixOptions.MaxAttempts is not set
+const DefaultFixAttempts = 5
+
+// maxVerifyOutput is how much of the end of a failed verification the model
+// is shown
+const maxVerifyOutput = 8 << 10
+
+// FixOptions configures FixUntilGreen
+type FixOptions struct {
+	Goal        string // what the user wants, e.g. "make the tests pass"
+	Verify      string // the command that succeeds once the goal is met
+	MaxAttempts int    // fixes tried before giving up
+}
+
+// FixStatus reports a verification run of FixUntilGreen, for EventFix
+type FixStatus struct {
+	Command  string `json:"command"`
+	Attempt  int    `json:"attempt"` // fixes tried before this run
+	Max      int    `json:"max"`
+	ExitCode int    `json:"exit_code"`
+	Green    bool   `json:"green"` // the verification passed
+	Done     bool   `json:"done"`  // the loop is over
+	Commands int    `json:"commands"`
+}
+
+// exitRe matches the line the verification wrapper ends with
+var exitRe = regexp.MustCompile(`\[aiterm-exit (\d+)\]\n?`)
+
+// FixUntilGreen runs the verification command and, while it fails, asks the
+// model to fix the cause, up to MaxAttempts times. The model then summarizes
+// what it changed. It returns whether the verification passed in the end.
+// The whole loop is one turn, ended by a single EventTurnDone.
+func (c *AiClient) FixUntilGreen(ctx context.Context, opts FixOptions) (bool, error) {
+	defer c.emit(Event{Type: EventTurnDone})
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = DefaultFixAttempts
+	}
+	if opts.Goal == "" {
+		opts.Goal = "make `" + opts.Verify + "` succeed"
+	}
+	c.request = "fix until green: " + opts.Goal
+	first := len(c.Commands())
+	status := FixStatus{Command: opts.Verify, Max: opts.MaxAttempts}
+	for ; ; status.Attempt++ {
+		res, err := c.verify(ctx, opts.Verify, status.Attempt)
+		if err != nil {
+			c.emit(Event{Type: EventError, Err: err})
+			return false, err
+		}
+		status.ExitCode, status.Green = res.ExitCode, res.ExitCode == 0
+		status.Done = status.Green || status.Attempt == opts.MaxAttempts
+		status.Commands = len(c.Commands()) - first
+		reported := status
+		c.emit(Event{Type: EventFix, Fix: &reported})
+		if status.Done {
+			break
+		}
+
+		output := res.Output
+		if len(output) > maxVerifyOutput {
+			output = "[...]\n" + output[len(output)-maxVerifyOutput:]
+		}
+		c.AddContext(fmt.Sprintf("Goal: %s.\n`%s` checks it and failed with exit code %d (fix %d of %d). Its output:\n```\n%s\n```\n"+
+			"Find the cause and fix it with the tools. Do not run `%s` yourself, I run it again after your fix. End with one line on what you changed.",
+			opts.Goal, opts.Verify, res.ExitCode, status.Attempt+1, opts.MaxAttempts, output, opts.Verify))
+		if err := c.run(ctx, ""); err != nil {
+			return false, err
+		}
+	}
+
+	if status.Attempt == 0 {
+		return status.Green, nil
+	}
+	outcome := "now succeeds"
+	if !status.Green {
+		outcome = fmt.Sprintf("still fails with exit code %d after %d fixes", status.ExitCode, status.Attempt)
+	}
+	c.AddContext(fmt.Sprintf("`%s` %s. Summarize in a few lines what you changed to %s, file by file, and what is left to do if anything. Do not call tools.",
+		opts.Verify, outcome, opts.Goal))
+	return status.Green, c.run(ctx, "")
+}
+
+// verify runs the verification command in the main pane. It is wrapped to
+// print its exit code, which tmux panes cannot report otherwise.
+func (c *AiClient) verify(ctx context.Context, command string, attempt int) (CommandResult, error) {
+	if err := ctx.Err(); err != nil {
+		return CommandResult{}, err
+	}
+	args, _ := json.Marshal(ToolRequest{Cmd: command})
+	call := ToolCall{ID: "verify-" + strconv.Itoa(attempt), Name: "verify", Arguments: string(args)}
+	c.emit(Event{Type: EventToolCallStarted, ToolCall: &call})
+
+	entry := audit.Entry{
+		Time:     time.Now(),
+		Session:  c.Session,
+		Model:    c.params.Model,
+		Request:  c.request,
+		Command:  command,
+		Approval: audit.ApprovalAuto,
+	}
+	wrapped := "sh -c " + shell.Quote(command+"; s=$?; echo \"[aiterm-exit $s]\"; exit $s")
+	if !c.approve(ctx, &entry, wrapped) {
+		c.emit(Event{Type: EventToolCallFinished, ToolCall: &call, Result: ErrRejected.Error()})
+		return CommandResult{}, ErrRejected
+	}
+	start := time.Now()
+	res, err := c.Executor.Execute(wrapped)
+	// Panes report commands that take long as still running, so their screen
+	// is watched until the wrapper prints the exit code
+	for err == nil && res.ExitCode < 0 && !exitRe.MatchString(res.Output) && c.Keys != nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-time.After(time.Second):
+			res.Output, err = c.Keys.SendKeys("", nil)
+		}
+	}
+	entry.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		entry.Error = err.Error()
+		c.record(entry)
+		c.emit(Event{Type: EventToolCallFinished, ToolCall: &call, Result: err.Error()})
+		return CommandResult{}, err
+	}
+	if m := exitRe.FindAllStringSubmatchIndex(res.Output, -1); m != nil {
+		last := m[len(m)-1]
+		if res.ExitCode < 0 {
+			res.ExitCode, _ = strconv.Atoi(res.Output[last[2]:last[3]])
+		}
+		res.Output = res.Output[:last[0]] + res.Output[last[1]:]
+	} else if res.ExitCode < 0 {
+		// The marker was lost, a failure is the safe guess
+		res.ExitCode = 1
+		res.Output += "\n[The exit code is unknown, the command may still be running.]"
+	}
+	// Panes echo the command as typed
+	res.Output = strings.ReplaceAll(res.Output, wrapped, command)
+	entry.Cwd, entry.ExitCode = res.Cwd, &res.ExitCode
+	c.record(entry)
+
+	c.emit(Event{Type: EventCommandOutput, Command: command, Output: res.Output, Cwd: res.Cwd})
+	c.emit(Event{Type: EventToolCallFinished, ToolCall: &call, Result: res.Output})
+	return res, nil
+}
@@ -0,0 +1,213 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/aki-colt/aiterm/audit"
+	"github.com/openai/openai-go"
+)
+
+// ErrNoPanes is returned when the model names a pane but commands run in a
+// single place
+var ErrNoPanes = errors.New("commands run in a single pane here, call executeCommand without pane")
+
+// PaneExecutor is implemented by executors that can run a command in one of
+// several named panes
+type PaneExecutor interface {
+	Executor
+	ExecuteIn(pane, command string) (CommandResult, error)
+}
+
+// Panes opens and closes the named panes of a PaneExecutor
+type Panes interface {
+	OpenPane(name string) error
+	ClosePane(name string) error
+	PaneNames() []string
+}
+
+// KeySender is implemented by executors whose commands keep a terminal, so
+// that the model can answer the programs it starts
+type KeySender interface {
+	// SendKeys types tmux key names, such as Enter or C-c, or text into a
+	// pane and returns its screen
+	SendKeys(pane string, keys []string) (string, error)
+}
+
+// ExecuteIn runs command in the named pane of e, the default one when pane is
+// empty. It is meant for executors wrapping another one.
+func ExecuteIn(e Executor, pane, command string) (CommandResult, error) {
+	if pane == "" {
+		return e.Execute(command)
+	}
+	pe, ok := e.(PaneExecutor)
+	if !ok {
+		return CommandResult{}, ErrNoPanes
+	}
+	return pe.ExecuteIn(pane, command)
+}
+
+type PaneRequest struct {
+	Name string `json:"name"`
+}
+
+type KeysRequest struct {
+	Keys []string `json:"keys"`
+	Pane string   `json:"pane,omitempty"`
+}
+
+var paneTools = []openai.ChatCompletionToolParam{
+	{
+		Function: openai.FunctionDefinitionParam{
+			Name:        "createPane",
+			Description: openai.String("Open a new terminal pane, e.g. to keep a server running in it while running other commands elsewhere. Return the panes open."),
+			Parameters: openai.FunctionParameters{
+				"type": "object",
+				"properties": map[string]any{
+					"name": map[string]string{
+						"type":        "string",
+						"description": "short name of the pane, such as server or tests",
+					},
+				},
+				"required": []string{"name"},
+			},
+		},
+	},
+	{
+		Function: openai.FunctionDefinitionParam{
+			Name:        "closePane",
+			Description: openai.String("Close a pane opened with createPane, stopping what runs in it. Return the panes open."),
+			Parameters: openai.FunctionParameters{
+				"type": "object",
+				"properties": map[string]any{
+					"name": map[string]string{
+						"type": "string",
+					},
+				},
+				"required": []string{"name"},
+			},
+		},
+	},
+}
+
+var sendKeysTool = openai.ChatCompletionToolParam{
+	Function: openai.FunctionDefinitionParam{
+		Name:        "sendKeys",
+		Description: openai.String("Type keys into a pane where a command is still running, e.g. to answer a prompt or stop the command. Return the screen of the pane."),
+		Parameters: openai.FunctionParameters{
+			"type": "object",
+			"properties": map[string]any{
+				"keys": map[string]any{
+					"type":        "array",
+					"items":       map[string]string{"type": "string"},
+					"description": `tmux key names such as Enter, C-c, Escape, Up or Tab, or text typed as is, e.g. ["y", "Enter"]. Empty to only look at the screen.`,
+				},
+				"pane": map[string]string{
+					"type":        "string",
+					"description": "name of the pane, the main pane when omitted",
+				},
+			},
+			"required": []string{"keys"},
+		},
+	},
+}
+
+// SetPanes lets the model open and close panes and choose the pane of each
+// command. Nil takes the pane tools away.
+func (c *AiClient) SetPanes(p Panes) {
+	c.Panes = p
+	c.updateTools()
+}
+
+// SetKeySender lets the model type into the programs it starts. Nil takes the
+// sendKeys tool away.
+func (c *AiClient) SetKeySender(k KeySender) {
+	c.Keys = k
+	c.updateTools()
+}
+
+// updateTools offers the tools the executor and the plan mode support
+func (c *AiClient) updateTools() {
+	c.params.Tools = slices.Clone(tools)
+	if c.planning {
+		c.params.Tools = append(c.params.Tools, planTools...)
+	}
+	if c.Panes != nil {
+		c.params.Tools = append(c.params.Tools, paneTools...)
+	}
+	if c.Keys != nil {
+		c.params.Tools = append(c.params.Tools, sendKeysTool)
+	}
+}
+
+// dealSendKeys runs sendKeys. Keys can run a command as well as answer one,
+// so they are approved and logged like executeCommand; only looking at the
+// screen is not.
+func (c *AiClient) dealSendKeys(ctx context.Context, toolCall ToolCall) string {
+	if c.Keys == nil {
+		return "commands here do not keep a terminal to type into"
+	}
+	var args KeysRequest
+	if err := json.Unmarshal([]byte(toolCall.Arguments), &args); err != nil {
+		return fmt.Sprintf("unmarshal param error: %v", err.Error())
+	}
+	if len(args.Keys) == 0 {
+		screen, err := c.Keys.SendKeys(args.Pane, nil)
+		if err != nil {
+			return fmt.Sprintf("error in executing sendKeys, %s", err.Error())
+		}
+		return screen
+	}
+
+	typed := strings.Join(args.Keys, " ")
+	entry := audit.Entry{
+		Time:     time.Now(),
+		Session:  c.Session,
+		Model:    c.params.Model,
+		Request:  c.request,
+		Command:  typed,
+		Keys:     true,
+		Approval: audit.ApprovalAuto,
+	}
+	pane := "the main pane"
+	if args.Pane != "" {
+		pane = "pane " + args.Pane
+	}
+	if !c.approve(ctx, &entry, fmt.Sprintf("Type into %s: %s", pane, typed)) {
+		return ErrRejected.Error()
+	}
+	start := time.Now()
+	screen, err := c.Keys.SendKeys(args.Pane, args.Keys)
+	entry.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		entry.Error = err.Error()
+		c.record(entry)
+		return fmt.Sprintf("error in executing sendKeys, %s", err.Error())
+	}
+	c.record(entry)
+	return screen
+}
+
+// dealPaneTool runs createPane or closePane
+func (c *AiClient) dealPaneTool(toolCall ToolCall) string {
+	if c.Panes == nil {
+		return ErrNoPanes.Error()
+	}
+	var args PaneRequest
+	if err := json.Unmarshal([]byte(toolCall.Arguments), &args); err != nil {
+		return fmt.Sprintf("unmarshal param error: %v", err.Error())
+	}
+	open := c.Panes.OpenPane
+	if toolCall.Name == "closePane" {
+		open = c.Panes.ClosePane
+	}
+	if err := open(args.Name); err != nil {
+		return fmt.Sprintf("error in executing %s, %s", toolCall.Name, err.Error())
+	}
+	return "panes: " + strings.Join(c.Panes.PaneNames(), ", ")
+}
@@ -0,0 +1,193 @@
+package ai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/openai/openai-go"
+)
+
+// StepStatus is where a step of a plan is
+type StepStatus string
+
+const (
+	StepPending StepStatus = "pending"
+	StepRunning StepStatus = "running"
+	StepDone    StepStatus = "done"
+	StepFailed  StepStatus = "failed"
+)
+
+// Step is a step of a plan
+type Step struct {
+	Text   string     `json:"text"`
+	Status StepStatus `json:"status"`
+	Note   string     `json:"note,omitempty"` // what the model said about it
+}
+
+// Plan is the list of steps the user approved, for EventPlan
+type Plan struct {
+	ID    int    `json:"id"` // counts the plans of the session
+	Steps []Step `json:"steps"`
+}
+
+// String numbers the steps with their status, as the model is told them
+func (p *Plan) String() string {
+	var sb strings.Builder
+	for i, s := range p.Steps {
+		fmt.Fprintf(&sb, "%d. [%s] %s", i+1, s.Status, s.Text)
+		if s.Note != "" {
+			fmt.Fprintf(&sb, " (%s)", s.Note)
+		}
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// copy returns a plan the handler can keep while this one changes
+func (p *Plan) copy() *Plan {
+	return &Plan{ID: p.ID, Steps: slices.Clone(p.Steps)}
+}
+
+type PlanRequest struct {
+	Steps []string `json:"steps"`
+}
+
+type StepRequest struct {
+	Step   int        `json:"step"`
+	Status StepStatus `json:"status"`
+	Note   string     `json:"note,omitempty"`
+}
+
+// planPrompt tells the model to plan in plan mode
+const planPrompt = "For a task that needs several commands, first call 'proposePlan' with its steps and wait for the approved plan. Then carry out the approved steps in order, calling 'updatePlan' with running before each step and done or failed after it."
+
+var planTools = []openai.ChatCompletionToolParam{
+	{
+		Function: openai.FunctionDefinitionParam{
+			Name:        "proposePlan",
+			Description: openai.String("Propose the steps of a task that needs several commands, before running any. The user can edit the steps, then approves or rejects the plan. Return the approved plan."),
+			Parameters: openai.FunctionParameters{
+				"type": "object",
+				"properties": map[string]any{
+					"steps": map[string]any{
+						"type":        "array",
+						"items":       map[string]string{"type": "string"},
+						"description": "short steps in order, e.g. [\"Install the dependencies\", \"Run the migrations\"]",
+					},
+				},
+				"required": []string{"steps"},
+			},
+		},
+	},
+	{
+		Function: openai.FunctionDefinitionParam{
+			Name:        "updatePlan",
+			Description: openai.String("Set the status of a step of the approved plan: running before working on it, done or failed after. Return the plan."),
+			Parameters: openai.FunctionParameters{
+				"type": "object",
+				"properties": map[string]any{
+					"step": map[string]string{
+						"type":        "integer",
+						"description": "number of the step, from 1",
+					},
+					"status": map[string]any{
+						"type": "string",
+						"enum": []string{string(StepRunning), string(StepDone), string(StepFailed)},
+					},
+					"note": map[string]string{
+						"type":        "string",
+						"description": "one line on the outcome, e.g. why it failed",
+					},
+				},
+				"required": []string{"step", "status"},
+			},
+		},
+	},
+}
+
+// SetPlanning turns the plan mode on or off. In plan mode the model proposes
+// the steps of a task that needs several commands, and the user reviews them
+// before any runs. Turning it off forgets the current plan.
+func (c *AiClient) SetPlanning(on bool) {
+	c.planning = on
+	if !on {
+		c.plan = nil
+	}
+	c.updateTools()
+	c.updateSystem()
+}
+
+// Planning reports whether the plan mode is on
+func (c *AiClient) Planning() bool {
+	return c.planning
+}
+
+// dealPlanTool runs proposePlan or updatePlan
+func (c *AiClient) dealPlanTool(ctx context.Context, toolCall ToolCall) string {
+	if !c.planning {
+		return "plan mode is off, run the commands without a plan"
+	}
+	if toolCall.Name == "updatePlan" {
+		var args StepRequest
+		if err := json.Unmarshal([]byte(toolCall.Arguments), &args); err != nil {
+			return fmt.Sprintf("unmarshal param error: %v", err.Error())
+		}
+		return c.updatePlan(args)
+	}
+	var args PlanRequest
+	if err := json.Unmarshal([]byte(toolCall.Arguments), &args); err != nil {
+		return fmt.Sprintf("unmarshal param error: %v", err.Error())
+	}
+	return c.proposePlan(ctx, args.Steps)
+}
+
+// proposePlan has the user review the steps and keeps the approved plan
+func (c *AiClient) proposePlan(ctx context.Context, steps []string) string {
+	if len(steps) == 0 {
+		return "error in executing proposePlan, a plan needs steps"
+	}
+	approved := steps
+	if c.ReviewPlan != nil {
+		var ok bool
+		if approved, ok = c.ReviewPlan(ctx, steps); !ok || len(approved) == 0 {
+			c.plan = nil
+			return "The user rejected the plan. Do not run it; ask them what to do instead."
+		}
+	}
+	c.plans++
+	c.plan = &Plan{ID: c.plans}
+	for _, s := range approved {
+		c.plan.Steps = append(c.plan.Steps, Step{Text: s, Status: StepPending})
+	}
+	c.emit(Event{Type: EventPlan, Plan: c.plan.copy()})
+
+	edited := ""
+	if !slices.Equal(approved, steps) {
+		edited = " after editing it"
+	}
+	return fmt.Sprintf("The user approved this plan%s:\n%s"+
+		"Carry it out in this order. Call updatePlan with running before each step, and with done or failed after it. Stop at a failed step unless you can fix it.",
+		edited, c.plan)
+}
+
+// updatePlan sets the status of a step
+func (c *AiClient) updatePlan(args StepRequest) string {
+	if c.plan == nil {
+		return "error in executing updatePlan, there is no approved plan, call proposePlan first"
+	}
+	if args.Step < 1 || args.Step > len(c.plan.Steps) {
+		return fmt.Sprintf("error in executing updatePlan, the plan has steps 1 to %d", len(c.plan.Steps))
+	}
+	switch args.Status {
+	case StepRunning, StepDone, StepFailed:
+	default:
+		return fmt.Sprintf("error in executing updatePlan, the status is running, done or failed, not %q", args.Status)
+	}
+	step := &c.plan.Steps[args.Step-1]
+	step.Status, step.Note = args.Status, args.Note
+	c.emit(Event{Type: EventPlan, Plan: c.plan.copy()})
+	return c.plan.String()
+}
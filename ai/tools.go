@@ -1,18 +1,22 @@
 package ai
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"os"
 	"os/exec"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/aki-colt/aiterm/audit"
 	"github.com/openai/openai-go"
 )
 
 type ToolRequest struct {
-	Cmd string `json:"cmd"`
+	Cmd  string `json:"cmd"`
+	Pane string `json:"pane,omitempty"`
 }
 
 var tools = []openai.ChatCompletionToolParam{
@@ -41,6 +45,10 @@ var tools = []openai.ChatCompletionToolParam{
 					"cmd": map[string]string{
 						"type": "string",
 					},
+					"pane": map[string]string{
+						"type":        "string",
+						"description": "name of a pane opened with createPane, the main pane when omitted",
+					},
 				},
 				"required": []string{"cmd"},
 			},
@@ -63,32 +71,34 @@ var tools = []openai.ChatCompletionToolParam{
 	},
 }
 
-func (c *AiClient) dealTool(toolCall openai.FinishedChatCompletionToolCall) openai.ChatCompletionMessageParamUnion {
+// dealTool runs the tool the model asked for and returns the content of the
+// tool message
+func (c *AiClient) dealTool(ctx context.Context, toolCall ToolCall) string {
 	switch toolCall.Name {
 	case `checkCommand`:
 		var args ToolRequest
 		err := json.Unmarshal([]byte(toolCall.Arguments), &args)
 		if err != nil {
-			return openai.ToolMessage(fmt.Sprintf("unmarshal param error: %v", err.Error()), toolCall.Id)
+			return fmt.Sprintf("unmarshal param error: %v", err.Error())
 		}
 		res := c.checkCommand(args.Cmd)
-		return openai.ToolMessage(strconv.FormatBool(res), toolCall.Id)
+		return strconv.FormatBool(res)
 	case `executeCommand`:
 		var args ToolRequest
 		err := json.Unmarshal([]byte(toolCall.Arguments), &args)
 		if err != nil {
-			return openai.ToolMessage(fmt.Sprintf("unmarshal param error: %v", err.Error()), toolCall.Id)
+			return fmt.Sprintf("unmarshal param error: %v", err.Error())
 		}
-		res, err := c.executeCommand(args.Cmd)
+		res, err := c.executeCommand(ctx, args.Pane, args.Cmd)
 		if err != nil {
-			res = fmt.Sprintf("error in executing executeCommand, %s", err.Error())
+			return fmt.Sprintf("error in executing executeCommand, %s", err.Error())
 		}
-		return openai.ToolMessage(res, toolCall.Id)
+		return res
 	case `getAvailableCommands`:
 		var args ToolRequest
 		err := json.Unmarshal([]byte(toolCall.Arguments), &args)
 		if err != nil {
-			return openai.ToolMessage(fmt.Sprintf("unmarshal param error: %v", err.Error()), toolCall.Id)
+			return fmt.Sprintf("unmarshal param error: %v", err.Error())
 		}
 		res := ""
 		cmds, err := c.getAvailableCommands(args.Cmd)
@@ -97,9 +107,15 @@ func (c *AiClient) dealTool(toolCall openai.FinishedChatCompletionToolCall) open
 		} else {
 			res = strings.Join(cmds, ",")
 		}
-		return openai.ToolMessage(res, toolCall.Id)
+		return res
+	case `createPane`, `closePane`:
+		return c.dealPaneTool(toolCall)
+	case `sendKeys`:
+		return c.dealSendKeys(ctx, toolCall)
+	case `proposePlan`, `updatePlan`:
+		return c.dealPlanTool(ctx, toolCall)
 	default:
-		return openai.ToolMessage(fmt.Sprintf("no tool named %s", toolCall.Name), toolCall.Id)
+		return fmt.Sprintf("no tool named %s", toolCall.Name)
 	}
 }
 
@@ -110,8 +126,65 @@ func (c *AiClient) checkCommand(command string) bool {
 }
 
 // Tool function: Execute the command and return the result
-func (c *AiClient) executeCommand(command string) (string, error) {
-	return c.Tc.ExecuteAndGetResult(command)
+func (c *AiClient) executeCommand(ctx context.Context, pane, command string) (string, error) {
+	entry := audit.Entry{
+		Time:     time.Now(),
+		Session:  c.Session,
+		Model:    c.params.Model,
+		Request:  c.request,
+		Command:  command,
+		Approval: audit.ApprovalAuto,
+	}
+	if !c.approve(ctx, &entry, command) {
+		return "", ErrRejected
+	}
+
+	// The time spent approving is not part of the run
+	start := time.Now()
+	res, err := ExecuteIn(c.Executor, pane, command)
+	entry.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		entry.Error = err.Error()
+		c.record(entry)
+		return "", err
+	}
+	entry.Cwd = res.Cwd
+	if res.ExitCode >= 0 {
+		entry.ExitCode = &res.ExitCode
+	}
+	c.record(entry)
+
+	c.emit(Event{Type: EventCommandOutput, Command: command, Pane: pane, Output: res.Output, Cwd: res.Cwd})
+	return res.Output, nil
+}
+
+// approve asks Approve about what the entry runs, shown as text, and notes
+// the answer in the entry. A rejected entry is recorded at once.
+func (c *AiClient) approve(ctx context.Context, entry *audit.Entry, text string) bool {
+	if c.Approve == nil {
+		return true
+	}
+	if !c.Approve(ctx, text) {
+		entry.Approval = audit.ApprovalRejected
+		c.record(*entry)
+		return false
+	}
+	entry.Approval = audit.ApprovalApproved
+	return true
+}
+
+// record keeps the entry for this session and appends it to the audit log if
+// there is one
+func (c *AiClient) record(entry audit.Entry) {
+	c.mutex.Lock()
+	c.commands = append(c.commands, entry)
+	c.mutex.Unlock()
+	if c.Audit == nil {
+		return
+	}
+	if err := c.Audit.Append(entry); err != nil {
+		c.emit(Event{Type: EventError, Err: fmt.Errorf("failed to write audit log: %w", err)})
+	}
 }
 
 // Tool function: Get available commands
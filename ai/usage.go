@@ -0,0 +1,45 @@
+package ai
+
+// Usage counts the tokens of model requests
+type Usage struct {
+	Model            string `json:"model,omitempty"`
+	PromptTokens     int64  `json:"prompt_tokens"`
+	CompletionTokens int64  `json:"completion_tokens"`
+}
+
+// ModelInfo is what aiterm knows about a model from the configuration
+type ModelInfo struct {
+	Context     int64   // context window in tokens, 0 when unknown
+	InputPrice  float64 // USD per million prompt tokens
+	OutputPrice float64 // USD per million completion tokens
+}
+
+// Cost returns the price of the usage in USD
+func (m ModelInfo) Cost(u Usage) float64 {
+	return (float64(u.PromptTokens)*m.InputPrice + float64(u.CompletionTokens)*m.OutputPrice) / 1e6
+}
+
+// Usage returns the tokens used by the session so far
+func (c *AiClient) Usage() Usage {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.usage
+}
+
+// ContextTokens returns the size of the conversation in tokens as reported by
+// the last response, 0 before the first one
+func (c *AiClient) ContextTokens() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.contextTokens
+}
+
+// addUsage accumulates the usage of a response and reports it
+func (c *AiClient) addUsage(u Usage) {
+	c.mutex.Lock()
+	c.usage.PromptTokens += u.PromptTokens
+	c.usage.CompletionTokens += u.CompletionTokens
+	c.contextTokens = u.PromptTokens + u.CompletionTokens
+	c.mutex.Unlock()
+	c.emit(Event{Type: EventUsage, Usage: &u})
+}
@@ -0,0 +1,126 @@
+// Package audit keeps a JSON-lines trail of every command run by the AI.
+package audit
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Approval decisions recorded for a command
+const (
+	ApprovalAuto     = "auto"
+	ApprovalApproved = "approved"
+	ApprovalRejected = "rejected"
+)
+
+// Entry is one command run (or refused) on behalf of the model
+type Entry struct {
+	Time       time.Time `json:"time"`
+	Session    string    `json:"session"`
+	Model      string    `json:"model"`
+	Request    string    `json:"request"`
+	Command    string    `json:"command"`
+	Cwd        string    `json:"cwd,omitempty"`
+	ExitCode   *int      `json:"exit_code"` // nil when the executor cannot tell
+	DurationMs int64     `json:"duration_ms"`
+	Approval   string    `json:"approval"`
+	Error      string    `json:"error,omitempty"`
+	// Keys marks keys typed into a pane, Command holding them, rather than
+	// a command run
+	Keys bool `json:"keys,omitempty"`
+}
+
+// Ran reports whether the command was run, whatever its exit code
+func (e Entry) Ran() bool {
+	return e.Approval != ApprovalRejected && e.Error == ""
+}
+
+// Succeeded reports whether the command ran and exited with 0. A command
+// whose exit code is unknown is not known to succeed.
+func (e Entry) Succeeded() bool {
+	return e.Ran() && e.ExitCode != nil && *e.ExitCode == 0
+}
+
+// Unverified reports whether the command ran but its exit code is unknown
+func (e Entry) Unverified() bool {
+	return e.Ran() && e.ExitCode == nil
+}
+
+// Log appends entries to an audit file
+type Log struct {
+	path  string
+	mutex sync.Mutex
+}
+
+func Open(path string) (*Log, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, err
+	}
+	return &Log{path: path}, nil
+}
+
+// Path returns the file the log writes to
+func (l *Log) Path() string {
+	return l.path
+}
+
+// Append writes the entry as a single line
+func (l *Log) Append(e Entry) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// Read loads all entries of an audit file, skipping lines it cannot parse
+func Read(path string) ([]Entry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// DefaultPath is ~/.aiterm/audit.jsonl
+func DefaultPath() (string, error) {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(homeDir, ".aiterm", "audit.jsonl"), nil
+}
+
+// NewSessionID returns a sortable, reasonably unique session identifier
+func NewSessionID() string {
+	b := make([]byte, 3)
+	rand.Read(b)
+	return fmt.Sprintf("%s-%s", time.Now().Format("20060102-150405"), hex.EncodeToString(b))
+}
@@ -0,0 +1,60 @@
+package audit_test
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aki-colt/aiterm/audit"
+)
+
+func TestAppendAndRead(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "nested", "audit.jsonl")
+	log, err := audit.Open(path)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	zero := 0
+	entries := []audit.Entry{
+		{Time: time.Unix(1, 0).UTC(), Session: "s1", Command: "ls", ExitCode: &zero, Approval: audit.ApprovalAuto},
+		{Time: time.Unix(2, 0).UTC(), Session: "s1", Command: "rm -rf build", Approval: audit.ApprovalRejected},
+	}
+	for _, e := range entries {
+		if err := log.Append(e); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+
+	got, err := audit.Read(path)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if len(got) != 2 || got[0].Command != "ls" || *got[0].ExitCode != 0 || got[1].ExitCode != nil {
+		t.Fatalf("entries = %+v", got)
+	}
+	if !got[0].Succeeded() || got[1].Succeeded() {
+		t.Errorf("Succeeded = %v, %v", got[0].Succeeded(), got[1].Succeeded())
+	}
+}
+
+func TestSucceeded(t *testing.T) {
+	zero, one := 0, 1
+	tests := []struct {
+		entry audit.Entry
+		want  bool
+	}{
+		{audit.Entry{Approval: audit.ApprovalAuto, ExitCode: &zero}, true},
+		{audit.Entry{Approval: audit.ApprovalAuto}, false},
+		{audit.Entry{Approval: audit.ApprovalApproved, ExitCode: &one}, false},
+		{audit.Entry{Approval: audit.ApprovalAuto, Error: "pane closed"}, false},
+		{audit.Entry{Approval: audit.ApprovalRejected}, false},
+	}
+	for _, tt := range tests {
+		if got := tt.entry.Succeeded(); got != tt.want {
+			t.Errorf("%+v.Succeeded() = %v, want %v", tt.entry, got, tt.want)
+		}
+	}
+	if !(audit.Entry{Approval: audit.ApprovalAuto}).Unverified() {
+		t.Error("an entry without exit code is not unverified")
+	}
+}
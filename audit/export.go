@@ -0,0 +1,92 @@
+package audit
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Exportable returns the commands of a session that are not known to have
+// failed, in order: the ones that succeeded and the unverified ones. Keys
+// typed into panes are left out.
+func Exportable(entries []Entry, session string) []Entry {
+	var res []Entry
+	for _, e := range entries {
+		if e.Session == session && !e.Keys && (e.Succeeded() || e.Unverified()) {
+			res = append(res, e)
+		}
+	}
+	return res
+}
+
+// LastSession returns the session of the most recent entry
+func LastSession(entries []Entry) string {
+	if len(entries) == 0 {
+		return ""
+	}
+	return entries[len(entries)-1].Session
+}
+
+// unverifiedNote comments the commands whose exit code is unknown
+const unverifiedNote = "exit code unknown, check it before running"
+
+// Script renders the entries as a bash script, with each originating request
+// as a comment above the commands it triggered. Unverified commands are
+// commented out, as the script stops at the first failure.
+func Script(session string, entries []Entry) string {
+	var sb strings.Builder
+	sb.WriteString("#!/usr/bin/env bash\n")
+	fmt.Fprintf(&sb, "# Exported from aiterm session %s\n", session)
+	if len(entries) > 0 && entries[0].Cwd != "" {
+		fmt.Fprintf(&sb, "# Originally run in %s\n", entries[0].Cwd)
+	}
+	sb.WriteString("set -euo pipefail\n")
+
+	request := ""
+	for i, e := range entries {
+		if i == 0 || e.Request != request {
+			request = e.Request
+			sb.WriteString("\n")
+			for _, line := range strings.Split(strings.TrimSpace(request), "\n") {
+				sb.WriteString("# " + line + "\n")
+			}
+		}
+		if e.Unverified() {
+			sb.WriteString("# " + unverifiedNote + ":\n")
+			for _, line := range strings.Split(e.Command, "\n") {
+				sb.WriteString("# " + line + "\n")
+			}
+			continue
+		}
+		sb.WriteString(e.Command + "\n")
+	}
+	return sb.String()
+}
+
+// Runbook renders the entries as a Markdown runbook, one section per request.
+// Unverified commands are marked with a comment.
+func Runbook(session string, entries []Entry) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# aiterm session %s\n", session)
+	if len(entries) > 0 && entries[0].Cwd != "" {
+		fmt.Fprintf(&sb, "\nOriginally run in `%s`.\n", entries[0].Cwd)
+	}
+
+	request := ""
+	for i, e := range entries {
+		if i == 0 || e.Request != request {
+			if i > 0 {
+				sb.WriteString("```\n")
+			}
+			request = e.Request
+			fmt.Fprintf(&sb, "\n## %s\n\n```bash\n", strings.ReplaceAll(strings.TrimSpace(request), "\n", " "))
+		}
+		if e.Unverified() {
+			sb.WriteString("# " + unverifiedNote + "\n")
+		}
+		sb.WriteString(e.Command + "\n")
+	}
+	if len(entries) > 0 {
+		sb.WriteString("```\n")
+	}
+	return sb.String()
+}
@@ -0,0 +1,60 @@
+package audit_test
+
+import (
+	"testing"
+
+	"github.com/aki-colt/aiterm/audit"
+)
+
+func exportEntries() []audit.Entry {
+	zero, one := 0, 1
+	return []audit.Entry{
+		{Session: "s1", Request: "build it", Command: "make", Cwd: "/src", ExitCode: &zero, Approval: audit.ApprovalAuto},
+		{Session: "s2", Request: "other", Command: "ls", Approval: audit.ApprovalAuto},
+		{Session: "s1", Request: "build it", Command: "make install", ExitCode: &one, Approval: audit.ApprovalAuto},
+		{Session: "s1", Request: "build it", Command: "rm -rf /", Approval: audit.ApprovalRejected},
+		{Session: "s1", Request: "build it", Command: "sudo make install", ExitCode: &zero, Approval: audit.ApprovalApproved},
+		{Session: "s1", Request: "build it", Command: "y Enter", Keys: true, Approval: audit.ApprovalAuto},
+		{Session: "s1", Request: "run tests\nverbosely", Command: "make test V=1", Approval: audit.ApprovalAuto},
+	}
+}
+
+func TestScript(t *testing.T) {
+	entries := audit.Exportable(exportEntries(), "s1")
+	got := audit.Script("s1", entries)
+	want := `#!/usr/bin/env bash
+# Exported from aiterm session s1
+# Originally run in /src
+set -euo pipefail
+
+# build it
+make
+sudo make install
+
+# run tests
+# verbosely
+# exit code unknown, check it before running:
+# make test V=1
+`
+	if got != want {
+		t.Errorf("Script =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestRunbook(t *testing.T) {
+	entries := audit.Exportable(exportEntries(), "s1")
+	got := audit.Runbook("s1", entries)
+	want := "# aiterm session s1\n\nOriginally run in `/src`.\n\n## build it\n\n```bash\nmake\nsudo make install\n```\n\n## run tests verbosely\n\n```bash\n# exit code unknown, check it before running\nmake test V=1\n```\n"
+	if got != want {
+		t.Errorf("Runbook =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestLastSession(t *testing.T) {
+	if got := audit.LastSession(exportEntries()); got != "s1" {
+		t.Errorf("LastSession = %q", got)
+	}
+	if got := audit.LastSession(nil); got != "" {
+		t.Errorf("LastSession(nil) = %q", got)
+	}
+}
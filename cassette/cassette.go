@@ -0,0 +1,66 @@
+// Package cassette records a session's model responses and command outputs to
+// a file and replays them later without network or shell side effects.
+package cassette
+
+import (
+	"encoding/json"
+	"os"
+)
+
+// Interaction kinds
+const (
+	KindInput   = "input"
+	KindModel   = "model"
+	KindCommand = "command"
+)
+
+// Interaction is one recorded exchange. Only the fields of its kind are set.
+type Interaction struct {
+	Kind string `json:"kind"`
+
+	// KindInput
+	Input string `json:"input,omitempty"`
+
+	// KindModel
+	Request     json.RawMessage `json:"request,omitempty"`
+	Status      int             `json:"status,omitempty"`
+	ContentType string          `json:"content_type,omitempty"`
+	Response    string          `json:"response,omitempty"`
+
+	// KindCommand
+	Command  string `json:"command,omitempty"`
+	Pane     string `json:"pane,omitempty"`
+	Output   string `json:"output,omitempty"`
+	ExitCode int    `json:"exit_code,omitempty"`
+	Cwd      string `json:"cwd,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// Cassette is the content of a recording
+type Cassette struct {
+	Version      int           `json:"version"`
+	Model        string        `json:"model"`
+	Interactions []Interaction `json:"interactions"`
+}
+
+// Load reads a cassette file
+func Load(path string) (*Cassette, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cassette{}
+	if err := json.Unmarshal(data, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Save writes the cassette to path
+func (c *Cassette) Save(path string) error {
+	data, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o600)
+}
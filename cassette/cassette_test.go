@@ -0,0 +1,94 @@
+package cassette_test
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aki-colt/aiterm/ai"
+	"github.com/aki-colt/aiterm/cassette"
+	"github.com/aki-colt/aiterm/internal/llmtest"
+	"github.com/openai/openai-go/option"
+)
+
+type recorder struct {
+	events []string
+}
+
+func (r *recorder) HandleEvent(e ai.Event) {
+	s := string(e.Type)
+	switch e.Type {
+	case ai.EventTextDelta:
+		s += ":" + e.Text
+	case ai.EventToolCallFinished:
+		s += ":" + e.Result
+	case ai.EventError:
+		s += ":" + e.Err.Error()
+	}
+	r.events = append(r.events, s)
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "session.json")
+	cfg := ai.AiConfig{Token: "test", Model: "test-model"}
+
+	// Record against the fake server and executor
+	srv := llmtest.NewServer(
+		llmtest.Call("call_1", "executeCommand", `{"cmd":"ls"}`),
+		llmtest.Text("Two ", "files."),
+	)
+	defer srv.Close()
+	exec := llmtest.NewExecutor()
+	exec.Outputs["ls"] = "a.txt\nb.txt"
+	rec := cassette.NewRecorder(path, cfg.Model)
+	live := &recorder{}
+	cfg.URL = srv.URL
+	client := ai.Init(rec.Executor(exec), live, cfg,
+		option.WithHTTPClient(&http.Client{Transport: rec.Transport(nil)}))
+	rec.Input("list files")
+	if err := client.Run(context.Background(), "list files"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if err := rec.Save(); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	// Replay with no server and no executor behind it
+	c, err := cassette.Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(c.Interactions) != 4 {
+		t.Fatalf("interactions = %+v", c.Interactions)
+	}
+	player := cassette.NewPlayer(c)
+	input, ok := player.NextInput()
+	if !ok || input != "list files" {
+		t.Fatalf("NextInput = %q, %v", input, ok)
+	}
+	replayed := &recorder{}
+	cfg.URL = "http://replay.invalid"
+	client = ai.Init(player, replayed, cfg,
+		option.WithHTTPClient(&http.Client{Transport: player.Transport()}))
+	if err := client.Run(context.Background(), input); err != nil {
+		t.Fatalf("replay Run: %v", err)
+	}
+	if !reflect.DeepEqual(live.events, replayed.events) {
+		t.Errorf("replayed events = %v\nwant %v", replayed.events, live.events)
+	}
+}
+
+func TestReplayMismatch(t *testing.T) {
+	player := cassette.NewPlayer(&cassette.Cassette{Interactions: []cassette.Interaction{
+		{Kind: cassette.KindCommand, Command: "ls", Output: "a.txt"},
+	}})
+	if _, err := player.Execute("rm -rf /"); err == nil || !strings.Contains(err.Error(), "mismatch") {
+		t.Errorf("Execute = %v, want mismatch", err)
+	}
+	if _, err := player.Execute("ls"); err == nil {
+		t.Error("Execute succeeded after the cassette ran out")
+	}
+}
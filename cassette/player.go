@@ -0,0 +1,138 @@
+package cassette
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aki-colt/aiterm/ai"
+)
+
+// Player replays a cassette. Inputs, model responses and commands are each
+// replayed in the order they were recorded.
+type Player struct {
+	mutex    sync.Mutex
+	cassette *Cassette
+	next     map[string]int // position of the next interaction of each kind
+	// Delay is waited between streamed events, to pace demos
+	Delay time.Duration
+}
+
+func NewPlayer(c *Cassette) *Player {
+	return &Player{cassette: c, next: make(map[string]int)}
+}
+
+// Model returns the model the cassette was recorded with
+func (p *Player) Model() string {
+	return p.cassette.Model
+}
+
+// take returns the next interaction of the given kind
+func (p *Player) take(kind string) (Interaction, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i := p.next[kind]; i < len(p.cassette.Interactions); i++ {
+		if p.cassette.Interactions[i].Kind == kind {
+			p.next[kind] = i + 1
+			return p.cassette.Interactions[i], true
+		}
+	}
+	p.next[kind] = len(p.cassette.Interactions)
+	return Interaction{}, false
+}
+
+// NextInput returns the next recorded user request, if any
+func (p *Player) NextInput() (string, bool) {
+	i, ok := p.take(KindInput)
+	return i.Input, ok
+}
+
+// PeekInput returns the next recorded user request without consuming it
+func (p *Player) PeekInput() (string, bool) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for i := p.next[KindInput]; i < len(p.cassette.Interactions); i++ {
+		if p.cassette.Interactions[i].Kind == KindInput {
+			return p.cassette.Interactions[i].Input, true
+		}
+	}
+	return "", false
+}
+
+// Execute replays the next recorded command. It fails if the model asked for
+// a different command than the one recorded.
+func (p *Player) Execute(command string) (ai.CommandResult, error) {
+	return p.ExecuteIn("", command)
+}
+
+// ExecuteIn replays the next recorded command, which must have run in pane
+func (p *Player) ExecuteIn(pane, command string) (ai.CommandResult, error) {
+	i, ok := p.take(KindCommand)
+	if !ok {
+		return ai.CommandResult{}, fmt.Errorf("cassette has no more commands, got %q", command)
+	}
+	if i.Command != command || i.Pane != pane {
+		return ai.CommandResult{}, fmt.Errorf("cassette mismatch: recorded command %q in pane %q, got %q in pane %q", i.Command, i.Pane, command, pane)
+	}
+	if i.Error != "" {
+		return ai.CommandResult{}, errors.New(i.Error)
+	}
+	return ai.CommandResult{Output: i.Output, ExitCode: i.ExitCode, Cwd: i.Cwd}, nil
+}
+
+// Transport serves the recorded model responses instead of the network
+func (p *Player) Transport() http.RoundTripper {
+	return playerTransport{p}
+}
+
+type playerTransport struct {
+	player *Player
+}
+
+func (t playerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		req.Body.Close()
+	}
+	i, ok := t.player.take(KindModel)
+	if !ok {
+		return nil, errors.New("cassette has no more model responses")
+	}
+	var body io.Reader = strings.NewReader(i.Response)
+	if t.player.Delay > 0 {
+		body = &pacedReader{events: strings.SplitAfter(i.Response, "\n\n"), delay: t.player.Delay}
+	}
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", i.Status, http.StatusText(i.Status)),
+		StatusCode: i.Status,
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": []string{i.ContentType}},
+		Body:       io.NopCloser(body),
+		Request:    req,
+	}, nil
+}
+
+// pacedReader hands out one server-sent event at a time, waiting before each
+type pacedReader struct {
+	events []string
+	buf    bytes.Buffer
+	delay  time.Duration
+}
+
+func (r *pacedReader) Read(p []byte) (int, error) {
+	if r.buf.Len() == 0 {
+		if len(r.events) == 0 {
+			return 0, io.EOF
+		}
+		time.Sleep(r.delay)
+		r.buf.WriteString(r.events[0])
+		r.events = r.events[1:]
+	}
+	return r.buf.Read(p)
+}
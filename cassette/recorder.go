@@ -0,0 +1,126 @@
+package cassette
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/aki-colt/aiterm/ai"
+)
+
+// Recorder captures a live session
+type Recorder struct {
+	mutex    sync.Mutex
+	path     string
+	cassette Cassette
+}
+
+func NewRecorder(path, model string) *Recorder {
+	return &Recorder{
+		path:     path,
+		cassette: Cassette{Version: 1, Model: model},
+	}
+}
+
+// add appends an interaction and returns its index
+func (r *Recorder) add(i Interaction) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.cassette.Interactions = append(r.cassette.Interactions, i)
+	return len(r.cassette.Interactions) - 1
+}
+
+// Input records a request typed by the user
+func (r *Recorder) Input(text string) {
+	r.add(Interaction{Kind: KindInput, Input: text})
+}
+
+// Save writes everything recorded so far to the cassette file
+func (r *Recorder) Save() error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.cassette.Save(r.path)
+}
+
+// Transport wraps base so that every model response is recorded
+func (r *Recorder) Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &recordingTransport{recorder: r, base: base}
+}
+
+type recordingTransport struct {
+	recorder *Recorder
+	base     http.RoundTripper
+}
+
+func (t *recordingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+
+	i := Interaction{Kind: KindModel, Status: resp.StatusCode, ContentType: resp.Header.Get("Content-Type")}
+	if json.Valid(body) {
+		i.Request = body
+	}
+	// The interaction takes its place now, its response is filled in as the
+	// stream is read
+	index := t.recorder.add(i)
+	resp.Body = &recordingBody{ReadCloser: resp.Body, recorder: t.recorder, index: index}
+	return resp, nil
+}
+
+// recordingBody copies a response body into the cassette while it is read
+type recordingBody struct {
+	io.ReadCloser
+	recorder *Recorder
+	index    int
+}
+
+func (b *recordingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.recorder.mutex.Lock()
+		b.recorder.cassette.Interactions[b.index].Response += string(p[:n])
+		b.recorder.mutex.Unlock()
+	}
+	return n, err
+}
+
+// Executor wraps e so that every command result is recorded
+func (r *Recorder) Executor(e ai.Executor) ai.Executor {
+	return &recordingExecutor{recorder: r, executor: e}
+}
+
+type recordingExecutor struct {
+	recorder *Recorder
+	executor ai.Executor
+}
+
+func (e *recordingExecutor) Execute(command string) (ai.CommandResult, error) {
+	return e.ExecuteIn("", command)
+}
+
+func (e *recordingExecutor) ExecuteIn(pane, command string) (ai.CommandResult, error) {
+	res, err := ai.ExecuteIn(e.executor, pane, command)
+	i := Interaction{Kind: KindCommand, Command: command, Pane: pane, Output: res.Output, ExitCode: res.ExitCode, Cwd: res.Cwd}
+	if err != nil {
+		i.Error = err.Error()
+	}
+	e.recorder.add(i)
+	return res, err
+}
@@ -0,0 +1,546 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aki-colt/aiterm/ai"
+	"github.com/aki-colt/aiterm/internal/shell"
+	"github.com/aki-colt/aiterm/redact"
+	"github.com/aki-colt/aiterm/remote"
+	"github.com/aki-colt/aiterm/terminal"
+	"github.com/rivo/tview"
+)
+
+// commandEnv is what the built-in slash commands act on
+type commandEnv struct {
+	app         *tview.Application
+	view        *terminal.TranscriptView
+	input       *terminal.PromptEditor
+	status      *terminal.StatusBar
+	aiClient    *ai.AiClient
+	session     *session
+	registry    *terminal.Registry
+	ssh         remote.Options // defaults for /connect
+	redact      redact.Options // for /redact on
+	fixAttempts int            // default budget of /fix
+	// ask sends a request to the model with hidden context before it, and
+	// generate shows a request and runs the model with run
+	ask      func(input, hidden string)
+	generate func(input string, run func(ctx context.Context))
+	// generating reports whether the model runs, until its last tool call
+	// returns even once it was cancelled
+	generating func() bool
+
+	// working is set while background work runs, on the UI goroutine
+	working bool
+
+	mutex  sync.Mutex
+	models []string // fetched in the background for /model completion
+}
+
+// print adds a message to the dialog, it must be called on the UI goroutine
+func (e *commandEnv) print(text string) {
+	e.view.Transcript().AddInfo(text)
+	e.view.Refresh()
+}
+
+// background runs work off the UI goroutine, since executors can take long,
+// then the function it returns on the UI goroutine, or shows its error. The
+// input stays disabled until then, so that no request runs the model while
+// the conversation or the executor is about to change. It refuses to start
+// while the model runs.
+func (e *commandEnv) background(work func() (func(), error)) error {
+	if e.generating() {
+		return fmt.Errorf("wait for the model to finish")
+	}
+	e.working = true
+	e.input.SetDisabled(true)
+	go func() {
+		done, err := work()
+		e.app.QueueUpdateDraw(func() {
+			e.working = false
+			e.input.SetDisabled(false)
+			if err != nil {
+				e.view.Transcript().AddError(err.Error())
+				e.view.Refresh()
+				return
+			}
+			done()
+		})
+	}()
+	return nil
+}
+
+// parseFix parses the arguments of /fix
+func parseFix(args string, attempts int) (ai.FixOptions, error) {
+	opts := ai.FixOptions{MaxAttempts: attempts}
+	if rest, ok := strings.CutPrefix(args, "-n "); ok {
+		n, rest, _ := strings.Cut(strings.TrimSpace(rest), " ")
+		var err error
+		if opts.MaxAttempts, err = strconv.Atoi(n); err != nil || opts.MaxAttempts < 1 {
+			return opts, fmt.Errorf("-n takes a number of attempts, not %q", n)
+		}
+		args = rest
+	}
+	if goal, verify, ok := strings.Cut(args, " -- "); ok {
+		opts.Goal, args = strings.TrimSpace(goal), verify
+	}
+	opts.Verify = strings.TrimSpace(args)
+	if opts.Verify == "" {
+		return opts, fmt.Errorf("usage: /fix [-n attempts] [goal --] <verify cmd>")
+	}
+	return opts, nil
+}
+
+// completePane completes the names of the tmux panes
+func (e *commandEnv) completePane(arg string) []string {
+	tc, ok := e.session.base.(*terminal.TerminalController)
+	if !ok {
+		return nil
+	}
+	var res []string
+	for _, name := range tc.PaneNames() {
+		if strings.HasPrefix(name, arg) {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// explainLines is how many lines of scrollback /explain sends
+const explainLines = 200
+
+// explain asks the model about the last command run in a pane, main by
+// default, from its scrollback
+func (e *commandEnv) explain(pane string) error {
+	tc, ok := e.session.base.(*terminal.TerminalController)
+	if !ok {
+		return fmt.Errorf("/explain needs commands to run in a tmux pane")
+	}
+	if pane == "" {
+		pane = terminal.MainPane
+	}
+	ask := fmt.Sprintf("Explain the result of the last command in the %s pane. If it failed, tell why and propose a command to fix it, without running it.", pane)
+	// With shell integration the last command is known exactly
+	if records, err := tc.Timeline(pane); err == nil && len(records) > 0 {
+		r := records[len(records)-1]
+		e.ask(ask, fmt.Sprintf("The last command of the %s pane was `%s`, run in %s. It exited with %d after %s. Its output:\n```\n%s\n```",
+			pane, r.Command, r.Cwd, r.ExitCode, r.End.Sub(r.Start).Round(time.Millisecond), r.Output))
+		return nil
+	}
+	scrollback, err := tc.Scrollback(pane, explainLines)
+	if err != nil {
+		return err
+	}
+	if scrollback == "" {
+		return fmt.Errorf("pane %s is empty", pane)
+	}
+	e.ask(ask, fmt.Sprintf("The end of the %s pane, with the commands I typed myself:\n```\n%s\n```", pane, scrollback))
+	return nil
+}
+
+// timelineLength is how many commands /timeline lists
+const timelineLength = 20
+
+// timeline lists the last commands of a pane with shell integration
+func (e *commandEnv) timeline(pane string) error {
+	tc, ok := e.session.base.(*terminal.TerminalController)
+	if !ok {
+		return fmt.Errorf("/timeline needs commands to run in a tmux pane")
+	}
+	records, err := tc.Timeline(pane)
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 {
+		e.print("No command has run yet")
+		return nil
+	}
+	var sb strings.Builder
+	for _, r := range records[max(0, len(records)-timelineLength):] {
+		color := "green"
+		if r.ExitCode != 0 {
+			color = "red"
+		}
+		fmt.Fprintf(&sb, "\n%s [%s]%3d[-] %8s  %s", r.Start.Format("15:04:05"), color, r.ExitCode,
+			r.End.Sub(r.Start).Round(100*time.Millisecond), tview.Escape(r.Command))
+	}
+	e.print("Commands of the pane, with their exit codes:" + sb.String())
+	return nil
+}
+
+// registerCommands adds the built-in slash commands to the registry
+func registerCommands(e *commandEnv) {
+	r := e.registry
+
+	r.Register(terminal.SlashCommand{
+		Name: "help",
+		Help: "Show this list",
+		Run: func(string) error {
+			e.print(tview.Escape(r.Help()))
+			return nil
+		},
+	})
+
+	r.Register(terminal.SlashCommand{
+		Name: "clear",
+		Help: "Clear the dialog and start a new conversation",
+		Run: func(string) error {
+			e.aiClient.Reset()
+			e.view.Transcript().Clear()
+			e.view.Refresh()
+			e.status.Refresh()
+			return nil
+		},
+	})
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		models, err := e.aiClient.ListModels(ctx)
+		if err == nil {
+			e.mutex.Lock()
+			e.models = models
+			e.mutex.Unlock()
+		}
+	}()
+	r.Register(terminal.SlashCommand{
+		Name: "model",
+		Args: "[name]",
+		Help: "Show or switch the model",
+		Complete: func(arg string) []string {
+			e.mutex.Lock()
+			defer e.mutex.Unlock()
+			var res []string
+			for _, m := range e.models {
+				if strings.HasPrefix(m, arg) {
+					res = append(res, m)
+				}
+			}
+			return res
+		},
+		Run: func(args string) error {
+			if args != "" {
+				e.aiClient.SetModel(args)
+				e.status.Refresh()
+			}
+			e.print("Model: " + tview.Escape(e.aiClient.Model()))
+			return nil
+		},
+	})
+
+	r.Register(terminal.SlashCommand{
+		Name: "save",
+		Args: "[file]",
+		Help: "Save the dialog to a text file",
+		Run: func(args string) error {
+			path := args
+			if path == "" {
+				path = fmt.Sprintf("aiterm-%s.txt", e.aiClient.Session)
+			}
+			if err := os.WriteFile(path, []byte(e.view.Transcript().PlainText()), 0o644); err != nil {
+				return err
+			}
+			e.print("Saved dialog to " + tview.Escape(path))
+			return nil
+		},
+	})
+
+	r.Register(terminal.SlashCommand{
+		Name: "undo",
+		Help: "Revert the files changed by the last command (needs -snapshot)",
+		Run: func(string) error {
+			if e.session.store == nil {
+				return fmt.Errorf("start aiterm with -snapshot to undo commands")
+			}
+			cp, changes, err := e.session.store.Undo()
+			if err != nil {
+				return err
+			}
+			var sb strings.Builder
+			for _, c := range changes {
+				sb.WriteString("\n" + c.String())
+			}
+			for _, path := range cp.Skipped {
+				sb.WriteString("\nnot reverted, could not be checkpointed: " + path)
+			}
+			summary := sb.String()
+			if len(changes) == 0 {
+				summary = "\nno file had changed"
+			}
+			e.aiClient.AddContext(fmt.Sprintf("I undid the command `%s`, files are back as they were before it:%s", cp.Command, summary))
+			e.print("Reverted [yellow]" + tview.Escape(cp.Command) + "[-]" + tview.Escape(summary))
+			return nil
+		},
+	})
+
+	r.Register(terminal.SlashCommand{
+		Name: "forget",
+		Help: "Forget the last request and its answer",
+		Run: func(string) error {
+			request, ok := e.aiClient.Undo()
+			if !ok {
+				return fmt.Errorf("nothing to forget")
+			}
+			e.print("Forgot: " + tview.Escape(request))
+			return nil
+		},
+	})
+
+	r.Register(terminal.SlashCommand{
+		Name: "cwd",
+		Args: "[dir]",
+		Help: "Show or change the working directory of the pane",
+		Run: func(args string) error {
+			if args == "" {
+				return e.background(func() (func(), error) {
+					cwd, err := e.session.cwd()
+					return func() {
+						e.print("Working directory: " + tview.Escape(cwd))
+					}, err
+				})
+			}
+			executor := e.session.executor
+			return e.background(func() (func(), error) {
+				res, err := executor.Execute("cd " + shell.Quote(args))
+				return func() {
+					e.aiClient.AddContext("I changed the working directory to " + res.Cwd)
+					e.status.SetCwd(res.Cwd)
+					e.print("Working directory: " + tview.Escape(res.Cwd))
+				}, err
+			})
+		},
+	})
+
+	r.Register(terminal.SlashCommand{
+		Name: "redact",
+		Args: "[on|off]",
+		Help: "Show or switch the masking of secrets sent to the model",
+		Complete: func(arg string) []string {
+			var res []string
+			for _, s := range []string{"on", "off"} {
+				if strings.HasPrefix(s, arg) {
+					res = append(res, s)
+				}
+			}
+			return res
+		},
+		Run: func(args string) error {
+			switch args {
+			case "":
+			case "on":
+				e.aiClient.Redact = redactFunc(e.redact)
+			case "off":
+				e.aiClient.Redact = nil
+			default:
+				return fmt.Errorf("usage: /redact [on|off]")
+			}
+			if e.aiClient.Redact == nil {
+				e.print("Secrets are [red]sent as they are[-] to the model")
+			} else {
+				e.print("Secrets are masked before they are sent to the model")
+			}
+			return nil
+		},
+	})
+
+	r.Register(terminal.SlashCommand{
+		Name: "plan",
+		Args: "[on|off]",
+		Help: "Show or switch the review of a plan before tasks with several commands",
+		Complete: func(arg string) []string {
+			var res []string
+			for _, s := range []string{"on", "off"} {
+				if strings.HasPrefix(s, arg) {
+					res = append(res, s)
+				}
+			}
+			return res
+		},
+		Run: func(args string) error {
+			switch args {
+			case "":
+			case "on":
+				e.aiClient.SetPlanning(true)
+			case "off":
+				e.aiClient.SetPlanning(false)
+			default:
+				return fmt.Errorf("usage: /plan [on|off]")
+			}
+			if e.aiClient.Planning() {
+				e.print("The model proposes a plan for review before tasks with several commands")
+			} else {
+				e.print("The model runs commands without proposing a plan")
+			}
+			return nil
+		},
+	})
+
+	r.Register(terminal.SlashCommand{
+		Name: "connect",
+		Args: "[user@host]",
+		Help: "Run the next commands on a host over SSH",
+		Run: func(args string) error {
+			opts := e.ssh
+			if args != "" {
+				opts.Target = args
+			}
+			if opts.Target == "" {
+				return fmt.Errorf("usage: /connect user@host, or set [ssh] host")
+			}
+			// A tool call must not switch executors halfway
+			if e.generating() {
+				return fmt.Errorf("wait for the model to finish")
+			}
+			if err := e.session.canConnect(); err != nil {
+				return err
+			}
+			e.print("Connecting to " + tview.Escape(opts.Target) + "...")
+			// The handshake can take long, the UI keeps running meanwhile
+			return e.background(func() (func(), error) {
+				r, err := remote.Dial(opts)
+				if err != nil {
+					return nil, err
+				}
+				cwd, cwdErr := r.Cwd()
+				return func() {
+					e.session.connect(r)
+					e.aiClient.Executor = e.session.executor
+					e.aiClient.SetPanes(nil)
+					e.aiClient.SetKeySender(nil)
+					e.aiClient.SetEnvironment(r.Describe())
+					e.aiClient.AddContext("From now on, commands run on " + r.Target() + " over SSH.")
+					if cwdErr == nil {
+						e.status.SetCwd(cwd)
+					}
+					e.print("Connected to " + tview.Escape(r.Target()))
+				}, nil
+			})
+		},
+	})
+
+	r.Register(terminal.SlashCommand{
+		Name: "run",
+		Args: "<cmd>",
+		Help: "Run a command yourself and add its output to the conversation",
+		Run: func(args string) error {
+			if args == "" {
+				return fmt.Errorf("usage: /run <cmd>")
+			}
+			executor := e.session.executor
+			return e.background(func() (func(), error) {
+				res, err := executor.Execute(args)
+				return func() {
+					e.aiClient.AddContext(fmt.Sprintf("I ran `%s` myself. Its output:\n%s", args, res.Output))
+					e.print("[yellow]$ " + tview.Escape(args) + "[-]\n" + tview.Escape(res.Output))
+				}, err
+			})
+		},
+	})
+
+	r.Register(terminal.SlashCommand{
+		Name:     "explain",
+		Args:     "[pane]",
+		Help:     "Explain the last command of a pane, yours included, and propose a fix",
+		Complete: e.completePane,
+		Run:      e.explain,
+	})
+
+	r.Register(terminal.SlashCommand{
+		Name: "fix",
+		Args: "[-n attempts] [goal --] <verify cmd>",
+		Help: "Fix until the verify command succeeds, e.g. /fix make the tests pass -- go test ./...",
+		Run: func(args string) error {
+			opts, err := parseFix(args, e.fixAttempts)
+			if err != nil {
+				return err
+			}
+			e.generate("/fix "+args, func(ctx context.Context) {
+				e.aiClient.FixUntilGreen(ctx, opts)
+			})
+			return nil
+		},
+	})
+
+	r.Register(terminal.SlashCommand{
+		Name:     "timeline",
+		Args:     "[pane]",
+		Help:     "List the last commands of a pane, yours included, with their exit codes",
+		Complete: e.completePane,
+		Run:      e.timeline,
+	})
+
+	r.Register(terminal.SlashCommand{
+		Name: "context",
+		Help: "Show the size of the conversation",
+		Run: func(string) error {
+			messages, size := e.aiClient.ContextSize()
+			tokens := fmt.Sprintf("about %d tokens", size/4)
+			if n := e.aiClient.ContextTokens(); n > 0 {
+				tokens = fmt.Sprintf("%d tokens at the last reply", n)
+			}
+			e.print(fmt.Sprintf("Context: %d messages, %d bytes (%s), %d commands run, model %s",
+				messages, size, tokens, len(e.aiClient.Commands()), tview.Escape(e.aiClient.Model())))
+			return nil
+		},
+	})
+
+	r.Register(terminal.SlashCommand{
+		Name: "export",
+		Args: "[sh|md] [file]",
+		Help: "Export the successful commands as a script or runbook",
+		Complete: func(arg string) []string {
+			var res []string
+			for _, f := range []string{"sh", "md"} {
+				if strings.HasPrefix(f, arg) {
+					res = append(res, f)
+				}
+			}
+			return res
+		},
+		Run: func(args string) error {
+			e.print(exportCommand(args, e.aiClient.Session, e.aiClient.Commands()))
+			return nil
+		},
+	})
+
+	r.Register(terminal.SlashCommand{
+		Name: "copy",
+		Args: "[n]",
+		Help: "Copy the n-th code block of the replies, the last by default",
+		Run: func(args string) error {
+			blocks := e.view.Transcript().CodeBlocks()
+			if len(blocks) == 0 {
+				return fmt.Errorf("no code block to copy")
+			}
+			n := len(blocks)
+			if args != "" {
+				var err error
+				if n, err = strconv.Atoi(args); err != nil || n < 1 || n > len(blocks) {
+					return fmt.Errorf("no code block #%s, there are %d", args, len(blocks))
+				}
+			}
+			if err := terminal.CopyToClipboard(blocks[n-1]); err != nil {
+				return err
+			}
+			e.print(fmt.Sprintf("Copied code block #%d", n))
+			return nil
+		},
+	})
+
+	r.Register(terminal.SlashCommand{
+		Name: "quit",
+		Help: "Exit aiterm",
+		Run: func(string) error {
+			e.session.close()
+			e.app.Stop()
+			return nil
+		},
+	})
+}
@@ -0,0 +1,166 @@
+// Package container runs commands inside a Docker or Podman container, with
+// the project directory mounted at the same path.
+package container
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aki-colt/aiterm/ai"
+	"github.com/aki-colt/aiterm/internal/shell"
+)
+
+// ErrNoRuntime is returned when neither docker nor podman is installed
+var ErrNoRuntime = errors.New("no container runtime found, install docker or podman")
+
+// Options configures the container executor, from the [container] section
+type Options struct {
+	Runtime string // "docker", "podman", or empty for the first installed
+	Image   string // image of the container started for the session
+	Name    string // existing container to use instead of starting one
+	Dir     string // project directory mounted in a started container
+}
+
+// Container is an executor running commands with `exec` in a container. A
+// container started for the session is removed by Close.
+type Container struct {
+	opts    Options
+	id      string
+	started bool
+	mutex   sync.Mutex
+	cwd     string
+}
+
+// New finds the runtime and starts a container from the image, or checks that
+// the named container is running
+func New(opts Options) (*Container, error) {
+	if opts.Runtime == "" {
+		for _, r := range []string{"docker", "podman"} {
+			if _, err := exec.LookPath(r); err == nil {
+				opts.Runtime = r
+				break
+			}
+		}
+		if opts.Runtime == "" {
+			return nil, ErrNoRuntime
+		}
+	} else if _, err := exec.LookPath(opts.Runtime); err != nil {
+		return nil, fmt.Errorf("container runtime %s: %w", opts.Runtime, err)
+	}
+
+	c := &Container{opts: opts}
+	if opts.Name != "" {
+		running, err := c.run("inspect", "--format", "{{.State.Running}}", opts.Name)
+		if err != nil {
+			return nil, err
+		}
+		if running != "true" {
+			return nil, fmt.Errorf("container %s is not running", opts.Name)
+		}
+		c.id = opts.Name
+		cwd, err := c.run("exec", c.id, "pwd")
+		if err != nil {
+			return nil, err
+		}
+		c.cwd = cwd
+		return c, nil
+	}
+
+	if opts.Image == "" {
+		return nil, errors.New("set the image or the name of a container to run commands in")
+	}
+	dir := opts.Dir
+	if dir == "" {
+		var err error
+		if dir, err = os.Getwd(); err != nil {
+			return nil, err
+		}
+	}
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+	c.opts.Dir = dir
+	suffix := make([]byte, 4)
+	rand.Read(suffix)
+	id, err := c.run("run", "--detach", "--rm",
+		"--name", "aiterm-"+hex.EncodeToString(suffix),
+		"--volume", dir+":"+dir,
+		"--workdir", dir,
+		"--entrypoint", "sh",
+		opts.Image, "-c", "trap 'exit 0' TERM; while :; do sleep 3600 & wait $!; done")
+	if err != nil {
+		return nil, err
+	}
+	c.id, c.started, c.cwd = id, true, dir
+	return c, nil
+}
+
+// run runs the container runtime and returns its trimmed output
+func (c *Container) run(args ...string) (string, error) {
+	cmd := exec.Command(c.opts.Runtime, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s %s: %w: %s", c.opts.Runtime, args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// ID returns the id or name of the container
+func (c *Container) ID() string {
+	return c.id
+}
+
+// Cwd returns the directory the next command runs in
+func (c *Container) Cwd() (string, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.cwd, nil
+}
+
+func (c *Container) Execute(command string) (ai.CommandResult, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	fallback := c.opts.Dir
+	if fallback == "" {
+		fallback = "/"
+	}
+	cmd := exec.Command(c.opts.Runtime, "exec", c.id, "sh", "-c", shell.Script("", c.cwd, fallback, command))
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	err := cmd.Run()
+
+	output, code, cwd := shell.Parse(out.String())
+	res := ai.CommandResult{Output: output, ExitCode: code, Cwd: c.cwd}
+	if cwd != "" {
+		c.cwd, res.Cwd = cwd, cwd
+	}
+	if code < 0 {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return res, fmt.Errorf("failed to run %s exec: %w", c.opts.Runtime, err)
+		}
+		res.ExitCode = exitErr.ExitCode()
+	}
+	return res, nil
+}
+
+// Close removes the container if it was started for the session
+func (c *Container) Close() error {
+	if !c.started {
+		return nil
+	}
+	_, err := c.run("rm", "--force", c.id)
+	return err
+}
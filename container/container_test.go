@@ -0,0 +1,58 @@
+package container_test
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/aki-colt/aiterm/container"
+)
+
+func TestNoRuntime(t *testing.T) {
+	t.Setenv("PATH", t.TempDir())
+	if _, err := container.New(container.Options{Image: "ubuntu:24.04"}); !errors.Is(err, container.ErrNoRuntime) {
+		t.Errorf("New = %v, want ErrNoRuntime", err)
+	}
+	if _, err := container.New(container.Options{Runtime: "podman", Image: "ubuntu:24.04"}); err == nil {
+		t.Error("New succeeded without podman")
+	}
+}
+
+// TestPodman runs against a local podman and an image pulled beforehand,
+// AITERM_TEST_IMAGE or ubuntu:24.04
+func TestPodman(t *testing.T) {
+	if _, err := exec.LookPath("podman"); err != nil {
+		t.Skip("podman is not installed")
+	}
+	image := os.Getenv("AITERM_TEST_IMAGE")
+	if image == "" {
+		image = "ubuntu:24.04"
+	}
+	if exec.Command("podman", "image", "exists", image).Run() != nil {
+		t.Skipf("image %s is not pulled", image)
+	}
+
+	dir := t.TempDir()
+	c, err := container.New(container.Options{Runtime: "podman", Image: image, Dir: dir})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer c.Close()
+
+	res, err := c.Execute("mkdir sub && cd sub && echo hello > f.txt && cat f.txt")
+	if err != nil {
+		t.Fatalf("Execute: %v", err)
+	}
+	if res.Output != "hello" || res.ExitCode != 0 || res.Cwd != filepath.Join(dir, "sub") {
+		t.Errorf("result = %+v", res)
+	}
+	// The working directory is mounted
+	if data, err := os.ReadFile(filepath.Join(dir, "sub", "f.txt")); err != nil || string(data) != "hello\n" {
+		t.Errorf("host file = %q, %v", data, err)
+	}
+	if res, _ := c.Execute("false"); res.ExitCode != 1 {
+		t.Errorf("exit code = %d", res.ExitCode)
+	}
+}
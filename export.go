@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/aki-colt/aiterm/audit"
+	"github.com/rivo/tview"
+)
+
+// renderExport turns the commands of a session that did not fail into a bash
+// script, or a Markdown runbook when format is "md"
+func renderExport(format, session string, entries []audit.Entry) (string, error) {
+	entries = audit.Exportable(entries, session)
+	if len(entries) == 0 {
+		return "", fmt.Errorf("no successful commands in session %s", session)
+	}
+	switch format {
+	case "sh":
+		return audit.Script(session, entries), nil
+	case "md":
+		return audit.Runbook(session, entries), nil
+	default:
+		return "", fmt.Errorf("unknown export format %q, use sh or md", format)
+	}
+}
+
+// writeExport writes an export to path with the right permissions for its format
+func writeExport(path, format, content string) error {
+	perm := os.FileMode(0o644)
+	if format == "sh" {
+		perm = 0o755
+	}
+	return os.WriteFile(path, []byte(content), perm)
+}
+
+// runExport implements `aiterm export [-format sh|md] [-o file] <session|last>`
+func runExport(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", "sh", "Export as a bash script (sh) or a Markdown runbook (md)")
+	output := fs.String("o", "", "Write to this file instead of stdout")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: aiterm export [-format sh|md] [-o file] <session|last>")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	entries := auditEntries()
+	session := fs.Arg(0)
+	if session == "last" {
+		session = audit.LastSession(entries)
+	}
+	content, err := renderExport(*format, session, entries)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error exporting session: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if *output == "" {
+		fmt.Print(content)
+		return
+	}
+	if err := writeExport(*output, *format, content); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing export: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// exportCommand handles `/export [sh|md] [file]` typed in the dialog and
+// returns the message to show
+func exportCommand(args string, session string, entries []audit.Entry) string {
+	format, path := "sh", ""
+	for _, arg := range strings.Fields(args) {
+		if arg == "sh" || arg == "md" {
+			format = arg
+		} else {
+			path = arg
+		}
+	}
+	if path == "" {
+		path = fmt.Sprintf("aiterm-%s.%s", session, format)
+	}
+	content, err := renderExport(format, session, entries)
+	if err == nil {
+		err = writeExport(path, format, content)
+	}
+	if err != nil {
+		return "[red]" + tview.Escape(err.Error()) + "[-]"
+	}
+	return "Exported session to " + tview.Escape(path)
+}
@@ -3,12 +3,16 @@ module github.com/aki-colt/aiterm
 go 1.22.2
 
 require (
+	github.com/alecthomas/chroma/v2 v2.14.0
 	github.com/gdamore/tcell/v2 v2.8.1
 	github.com/openai/openai-go v0.1.0-beta.2
 	github.com/rivo/tview v0.0.0-20250325173046-7b72abf45814
+	golang.org/x/crypto v0.32.0
+	gopkg.in/ini.v1 v1.67.0
 )
 
 require (
+	github.com/dlclark/regexp2 v1.11.0 // indirect
 	github.com/gdamore/encoding v1.0.1 // indirect
 	github.com/lucasb-eyer/go-colorful v1.2.0 // indirect
 	github.com/mattn/go-runewidth v0.0.16 // indirect
@@ -20,5 +24,4 @@ require (
 	golang.org/x/sys v0.29.0 // indirect
 	golang.org/x/term v0.28.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
-	gopkg.in/ini.v1 v1.67.0 // indirect
 )
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/aki-colt/aiterm/audit"
+)
+
+// auditEntries loads the audit log configured in ~/.aitermrc
+func auditEntries() []audit.Entry {
+	config, _ := readConfig()
+	if config.AuditPath == "" {
+		fmt.Fprintln(os.Stderr, "The audit log is disabled in ~/.aitermrc")
+		os.Exit(1)
+	}
+	entries, err := audit.Read(config.AuditPath)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "Error reading audit log: %s\n", err.Error())
+		os.Exit(1)
+	}
+	return entries
+}
+
+// runHistory implements `aiterm history [-session id] [pattern]`, which lists
+// the audited commands whose command or request matches the pattern
+func runHistory(args []string) {
+	fs := flag.NewFlagSet("history", flag.ExitOnError)
+	session := fs.String("session", "", "Only show commands of this session")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: aiterm history [-session id] [pattern]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	var re *regexp.Regexp
+	if fs.NArg() > 0 {
+		var err error
+		re, err = regexp.Compile(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid pattern: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	for _, e := range auditEntries() {
+		if *session != "" && e.Session != *session {
+			continue
+		}
+		if re != nil && !re.MatchString(e.Command) && !re.MatchString(e.Request) {
+			continue
+		}
+		status := e.Approval
+		if e.Error != "" {
+			status = "error"
+		} else if e.ExitCode != nil {
+			status = "exit " + strconv.Itoa(*e.ExitCode)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t# %s\n", e.Time.Local().Format("2006-01-02 15:04:05"), e.Session, status, e.Command, e.Request)
+	}
+}
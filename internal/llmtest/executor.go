@@ -0,0 +1,47 @@
+package llmtest
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aki-colt/aiterm/ai"
+)
+
+// Executor is a fake command executor with canned outputs
+type Executor struct {
+	mutex     sync.Mutex
+	Outputs   map[string]string
+	ExitCodes map[string]int
+	Errors    map[string]error
+	Cwd       string
+	commands  []string
+}
+
+func NewExecutor() *Executor {
+	return &Executor{
+		Outputs:   make(map[string]string),
+		ExitCodes: make(map[string]int),
+		Errors:    make(map[string]error),
+		Cwd:       "/work",
+	}
+}
+
+func (e *Executor) Execute(command string) (ai.CommandResult, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.commands = append(e.commands, command)
+	if err, ok := e.Errors[command]; ok {
+		return ai.CommandResult{}, err
+	}
+	if out, ok := e.Outputs[command]; ok {
+		return ai.CommandResult{Output: out, ExitCode: e.ExitCodes[command], Cwd: e.Cwd}, nil
+	}
+	return ai.CommandResult{}, fmt.Errorf("unexpected command %q", command)
+}
+
+// Commands returns the commands executed so far
+func (e *Executor) Commands() []string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return append([]string(nil), e.commands...)
+}
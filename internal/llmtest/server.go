@@ -0,0 +1,170 @@
+// Package llmtest provides a fake OpenAI-compatible chat server and a fake
+// executor so the agent loop can be tested without network or tmux.
+package llmtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// ToolCall is a tool call the fake model asks for
+type ToolCall struct {
+	ID        string
+	Name      string
+	Arguments string
+}
+
+// Response is one scripted reply of the fake model
+type Response struct {
+	Text      []string   // content deltas, streamed in order
+	ToolCalls []ToolCall // tool calls streamed after the text
+	Refusal   string
+	Status    int  // when set, reply with this HTTP status and an error body instead
+	Hang      bool // stream the text, then block until the request is canceled
+	// Usage, when set, is sent in a final chunk without choices
+	PromptTokens     int64
+	CompletionTokens int64
+}
+
+// Text returns a response that streams the given content deltas
+func Text(deltas ...string) Response {
+	return Response{Text: deltas}
+}
+
+// Call returns a response that asks for a single tool call
+func Call(id, name, arguments string) Response {
+	return Response{ToolCalls: []ToolCall{{ID: id, Name: name, Arguments: arguments}}}
+}
+
+// Server replays scripted responses, one per chat completion request
+type Server struct {
+	*httptest.Server
+	mutex     sync.Mutex
+	responses []Response
+	requests  []map[string]any
+}
+
+func NewServer(responses ...Response) *Server {
+	s := &Server{responses: responses}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	return s
+}
+
+// Requests returns the decoded bodies of the requests received so far
+func (s *Server) Requests() []map[string]any {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return append([]map[string]any(nil), s.requests...)
+}
+
+// Messages returns the messages sent with the n-th request
+func (s *Server) Messages(n int) []map[string]any {
+	reqs := s.Requests()
+	if n >= len(reqs) {
+		return nil
+	}
+	var msgs []map[string]any
+	raw, _ := json.Marshal(reqs[n]["messages"])
+	json.Unmarshal(raw, &msgs)
+	return msgs
+}
+
+func (s *Server) serve(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/chat/completions" {
+		http.NotFound(w, r)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	var req map[string]any
+	json.Unmarshal(body, &req)
+
+	s.mutex.Lock()
+	s.requests = append(s.requests, req)
+	if len(s.responses) == 0 {
+		s.mutex.Unlock()
+		writeError(w, http.StatusBadRequest, "no scripted response left")
+		return
+	}
+	resp := s.responses[0]
+	s.responses = s.responses[1:]
+	s.mutex.Unlock()
+
+	if resp.Status != 0 {
+		writeError(w, resp.Status, fmt.Sprintf("scripted error %d", resp.Status))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	flusher, _ := w.(http.Flusher)
+	send := func(delta map[string]any, finish any) {
+		chunk := map[string]any{
+			"id":      "chatcmpl-test",
+			"object":  "chat.completion.chunk",
+			"created": 0,
+			"model":   req["model"],
+			"choices": []map[string]any{{"index": 0, "delta": delta, "finish_reason": finish}},
+		}
+		data, _ := json.Marshal(chunk)
+		fmt.Fprintf(w, "data: %s\n\n", data)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+
+	send(map[string]any{"role": "assistant"}, nil)
+	for _, text := range resp.Text {
+		send(map[string]any{"content": text}, nil)
+	}
+	if resp.Hang {
+		<-r.Context().Done()
+		return
+	}
+	if resp.Refusal != "" {
+		send(map[string]any{"refusal": resp.Refusal}, nil)
+	}
+	for i, call := range resp.ToolCalls {
+		// Split the arguments to exercise the accumulation of deltas
+		half := len(call.Arguments) / 2
+		send(map[string]any{"tool_calls": []map[string]any{{
+			"index": i, "id": call.ID, "type": "function",
+			"function": map[string]any{"name": call.Name, "arguments": call.Arguments[:half]},
+		}}}, nil)
+		send(map[string]any{"tool_calls": []map[string]any{{
+			"index":    i,
+			"function": map[string]any{"arguments": call.Arguments[half:]},
+		}}}, nil)
+	}
+	finish := "stop"
+	if len(resp.ToolCalls) > 0 {
+		finish = "tool_calls"
+	}
+	send(map[string]any{}, finish)
+	if resp.PromptTokens > 0 || resp.CompletionTokens > 0 {
+		data, _ := json.Marshal(map[string]any{
+			"id":      "chatcmpl-test",
+			"object":  "chat.completion.chunk",
+			"created": 0,
+			"model":   req["model"],
+			"choices": []any{},
+			"usage": map[string]any{
+				"prompt_tokens":     resp.PromptTokens,
+				"completion_tokens": resp.CompletionTokens,
+				"total_tokens":      resp.PromptTokens + resp.CompletionTokens,
+			},
+		})
+		fmt.Fprintf(w, "data: %s\n\n", data)
+	}
+	fmt.Fprint(w, "data: [DONE]\n\n")
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{
+		"error": map[string]any{"message": msg, "type": "invalid_request_error"},
+	})
+}
@@ -0,0 +1,49 @@
+// Package shell builds the scripts that executors without a terminal run
+// commands with. The script reports the exit code and working directory of
+// the command after its output.
+package shell
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// marker ends the output of a command with its exit code and working
+// directory
+const marker = "__aiterm_done__"
+
+// Quote quotes s for a POSIX shell
+func Quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// Script returns a script running the prelude, then command in dir, or in
+// fallback when dir is gone
+func Script(prelude, dir, fallback, command string) string {
+	var sb strings.Builder
+	sb.WriteString(prelude)
+	fmt.Fprintf(&sb, "cd %s 2>/dev/null || cd %s\n", Quote(dir), Quote(fallback))
+	fmt.Fprintf(&sb, "{\n%s\n}\n", command)
+	fmt.Fprintf(&sb, "printf '\\n%s %%d %%s\\n' \"$?\" \"$PWD\"\n", marker)
+	return sb.String()
+}
+
+// Parse splits the output of a script into the output of the command, its
+// exit code and the directory it ended in. The exit code is -1 and the
+// directory empty when the command exited the shell.
+func Parse(out string) (output string, code int, cwd string) {
+	i := strings.LastIndex(out, "\n"+marker+" ")
+	if i < 0 {
+		return strings.TrimRight(out, "\n"), -1, ""
+	}
+	fields := strings.SplitN(strings.TrimSpace(out[i+len(marker)+2:]), " ", 2)
+	code, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return strings.TrimRight(out, "\n"), -1, ""
+	}
+	if len(fields) == 2 {
+		cwd = fields[1]
+	}
+	return strings.TrimRight(out[:i], "\n"), code, cwd
+}
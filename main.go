@@ -5,12 +5,19 @@ import (
 	"context"
 	"flag"
 	"fmt"
+	"net/url"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strings"
 	"time"
 
 	"github.com/aki-colt/aiterm/ai"
+	"github.com/aki-colt/aiterm/audit"
+	"github.com/aki-colt/aiterm/container"
+	"github.com/aki-colt/aiterm/redact"
+	"github.com/aki-colt/aiterm/remote"
+	"github.com/aki-colt/aiterm/sandbox"
 	"github.com/aki-colt/aiterm/terminal"
 	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
@@ -19,8 +26,49 @@ import (
 
 var version = "v0.01.0"
 
+var (
+	prompt  = flag.String("p", "", "Run a single request without the chat UI and print events as JSON lines")
+	confirm = flag.Bool("confirm", false, "Ask before running each command")
+	plan    = flag.Bool("plan", false, "Have the model propose a plan for review before tasks with several commands")
+)
+
+// Config is everything read from ~/.aitermrc
+type Config struct {
+	AI ai.AiConfig
+	// AuditPath is where executed commands are logged, empty disables the log
+	AuditPath string
+	// Models holds the context window and prices of models, from the
+	// [models.<name>] sections
+	Models map[string]ai.ModelInfo
+	Keys   terminal.KeyMap
+	Theme  terminal.Theme
+	// Executor is where commands run: "tmux", "sandbox", "container" or "ssh"
+	Executor  string
+	Sandbox   sandbox.Options
+	Container container.Options
+	SSH       remote.Options
+	Tmux      terminal.PaneOptions
+	// Redact masks secrets sent to the model unless RedactOff is set
+	Redact    redact.Options
+	RedactOff bool
+	// FixAttempts is the default budget of /fix, from the [fix] section
+	FixAttempts int
+}
+
 func main() {
 	showVersion()
+	switch flag.Arg(0) {
+	case "history":
+		runHistory(flag.Args()[1:])
+		return
+	case "export":
+		runExport(flag.Args()[1:])
+		return
+	}
+	if *prompt != "" {
+		runPrompt(*prompt)
+		return
+	}
 	startApp()
 }
 
@@ -35,107 +83,301 @@ func showVersion() {
 
 func startApp() {
 	// Check and get config first
-	cfg := checkAIConfig()
+	s, cfg := openSession()
 
 	// Start app
 	app := tview.NewApplication()
+	pages := tview.NewPages()
 
-	dialogView, dialogInput := terminal.NewDialogComponents()
+	dialogView, dialogInput := terminal.NewDialogComponents(app, terminal.LoadPromptHistory(terminal.DefaultPromptHistoryPath()))
+	dialogView.SetKeyMap(cfg.Keys)
+	dialogView.Transcript().SetTheme(cfg.Theme)
+	dialogInput.SetKeyMap(cfg.Keys)
 
-	tc := terminal.NewTerminalController()
-
-	dialogView.SetText(dialogView.GetText(true) + "\nAI: " + "Tell me what you want to do and I will execute the cmd on the right pane.")
+	greeting := "Tell me what you want to do and I will execute the cmd on the right pane."
+	switch cfg.Executor {
+	case "tmux":
+		if tc, ok := s.base.(*terminal.TerminalController); ok && (cfg.Tmux.Pane != "" || cfg.Tmux.Window || cfg.Tmux.Vertical) {
+			greeting = "Tell me what you want to do and I will execute the cmd in tmux pane " + tc.Pane() + "."
+		}
+	case "sandbox":
+		greeting = "Tell me what you want to do and I will execute the cmd in a sandbox, where changes to your files are not kept."
+	case "container":
+		greeting = "Tell me what you want to do and I will execute the cmd in a container."
+	case "ssh":
+		greeting = "Tell me what you want to do and I will execute the cmd on " + cfg.SSH.Target + "."
+	}
+	dialogView.Transcript().AddAssistant(greeting)
+	if tc, ok := s.base.(*terminal.TerminalController); ok {
+		if err := tc.IntegrationError(); err != nil {
+			dialogView.Transcript().AddInfo("[yellow]Shell integration is off: " + tview.Escape(err.Error()) + "[-]")
+		}
+	}
+	dialogView.Refresh()
 
-	aiClient := ai.Init(tc, dialogView, cfg)
+	handler := terminal.NewDialogHandler(app, dialogView)
+	if tc, ok := s.base.(*terminal.TerminalController); ok {
+		tc.HandOff = func(pane, program string) {
+			app.QueueUpdateDraw(func() {
+				dialogView.Transcript().AddInfo(fmt.Sprintf("[yellow]%s needs the keyboard: the focus moved to pane %s, quit %s to continue[-]",
+					tview.Escape(program), tview.Escape(pane), tview.Escape(program)))
+				dialogView.Refresh()
+			})
+		}
+		tc.AskPassword = terminal.NewPasswordAsker(app, pages)
+	}
+	aiClient := newAiClient(s, handler, cfg)
+	provider := cfg.AI.URL
+	if u, err := url.Parse(cfg.AI.URL); err == nil && u.Host != "" {
+		provider = u.Host
+	}
+	status := terminal.NewStatusBar(aiClient, provider, cfg.Models)
+	handler.Status = status
+	if cwd, err := s.cwd(); err == nil {
+		status.SetCwd(cwd)
+	}
+	status.Refresh()
+	if *confirm {
+		aiClient.Approve = terminal.NewApprover(app, pages, cfg.Keys)
+	}
+	aiClient.ReviewPlan = terminal.NewPlanReviewer(app, pages)
 
 	generating := false
 	var currentCancel context.CancelFunc
 
-	dialogInput.SetDoneFunc(func(key tcell.Key) {
-		if key == tcell.KeyEnter {
-			input := dialogInput.GetText()
-			if input != "" {
-				generating = true
-				fmt.Fprint(dialogView, "\n\n[green]You: "+input+"[-]\n\nAI: ")
-				dialogView.ScrollToEnd()
-				dialogInput.SetDisabled(true)
-				dialogInput.SetText("generating.")
-				ctx, cancel := context.WithCancel(context.Background())
-				currentCancel = cancel
-				go func() {
-					defer func() {
-						if e := recover(); e != nil {
-							app.QueueUpdateDraw(func() {
-								fmt.Fprintf(dialogView, "/n[red]%v[-]", e)
-							})
-						}
-						currentCancel()
-					}()
-					err := aiClient.Run(ctx, input, app)
-					if err != nil {
-						app.QueueUpdateDraw(func() {
-							fmt.Fprint(dialogView, "/n[red]"+err.Error()+"[-]")
-						})
-					}
-					generating = false
-				}()
-				// Animation effect
-				go generatingAnime(ctx, dialogInput, app)
+	// When replaying, offer the next recorded request as the placeholder
+	// and send it on an empty Enter
+	showNextInput := func() {
+		if s.player != nil {
+			next, _ := s.player.PeekInput()
+			dialogInput.SetPlaceholder(next)
+		}
+	}
+	showNextInput()
+
+	registry := terminal.NewRegistry()
+	env := &commandEnv{app: app, view: dialogView, input: dialogInput, status: status, aiClient: aiClient, session: s, registry: registry, ssh: cfg.SSH, redact: cfg.Redact, fixAttempts: cfg.FixAttempts}
+	registerCommands(env)
+
+	// generate shows input as a request of the user and runs the model with
+	// run until it returns
+	generate := func(input string, run func(ctx context.Context)) {
+		s.input(input)
+		generating = true
+		dialogView.Transcript().AddUser(input)
+		dialogView.Refresh()
+		status.Start()
+		dialogInput.SetDisabled(true)
+		dialogInput.SetText("generating.")
+		ctx, cancel := context.WithCancel(context.Background())
+		currentCancel = cancel
+		go func() {
+			defer func() {
+				if e := recover(); e != nil {
+					app.QueueUpdateDraw(func() {
+						dialogView.Transcript().AddError(fmt.Sprint(e))
+						dialogView.Refresh()
+					})
+				}
+				currentCancel()
+			}()
+			// Errors are shown by the dialog handler
+			run(ctx)
+			app.QueueUpdateDraw(func() {
+				generating = false
+				showNextInput()
+			})
+		}()
+		// Animation effect
+		go generatingAnime(ctx, dialogInput, app)
+	}
+	// ask sends a request to the model, after hidden context the dialog does
+	// not show, such as attachments
+	ask := func(input, hidden string) {
+		if hidden != "" {
+			aiClient.AddContext(hidden)
+		}
+		generate(input, func(ctx context.Context) {
+			aiClient.Run(ctx, input)
+		})
+	}
+	env.generate = generate
+	env.ask = ask
+	env.generating = func() bool { return generating }
+
+	submit := func(input string) {
+		if input == "" && s.player != nil {
+			input, _ = s.player.NextInput()
+		}
+		if terminal.IsCommand(input) {
+			dialogInput.SetText("")
+			if err := registry.Dispatch(input); err != nil {
+				dialogView.Transcript().AddError(err.Error())
+				dialogView.Refresh()
 			}
+			return
+		}
+		if input != "" {
+			// The input comes back once a run is cancelled, before it returns
+			if generating {
+				dialogView.Transcript().AddError("The last request is still stopping, try again")
+				dialogView.Refresh()
+				return
+			}
+			attached, attachments := terminal.ReadAttachments(input, s.attachments())
+			ask(input, attached)
+			if len(attachments) > 0 {
+				dialogView.Transcript().AddInfo(attachmentSummary(attachments))
+				dialogView.Refresh()
+			}
+		}
+	}
+
+	// Tab completes slash commands and their arguments, and @references. The
+	// focus-chat keys move the focus to the dialog for scrolling, and the
+	// focus-input keys or Enter bring it back.
+	dialogInput.SetSubmitFunc(submit).SetCompleteFunc(func(text string) []string {
+		if candidates := registry.Complete(text); candidates != nil {
+			return candidates
 		}
+		return terminal.CompleteAttachment(text, s.attachments().Dir)
+	})
+	dialogInput.SetDoneFunc(func(key tcell.Key) {
+		app.SetFocus(dialogView)
+	})
+	dialogView.SetDoneFunc(func(key tcell.Key) {
+		app.SetFocus(dialogInput)
 	})
 
 	mainFlex := tview.NewFlex().
 		SetDirection(tview.FlexRow).
 		AddItem(dialogView, 0, 1, false).
+		AddItem(status, 1, 0, false).
 		AddItem(dialogInput, 1, 0, true)
+	dialogInput.SetResizeFunc(func(height int) {
+		mainFlex.ResizeItem(dialogInput, height, 0)
+	})
 
+	pages.AddPage("main", mainFlex, true, true)
+
+	keys := cfg.Keys
 	app.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
-		switch event.Key() {
-		case tcell.KeyCtrlC:
-			if generating {
-				generating = false
-				currentCancel()
-				return nil // 消费事件
-			} else {
-				tc.Stop()
-				app.Stop()
+		cancel := generating && keys.Matches(terminal.ActionCancel, event)
+		quit := !cancel && keys.Matches(terminal.ActionQuit, event)
+		// Leave the other keys to the approval modal while it is shown
+		if front, _ := pages.GetFrontPage(); front != "main" && !cancel && !quit {
+			return event
+		}
+		switch {
+		case cancel:
+			// generating stays set until the run returns
+			currentCancel()
+			if tc, ok := s.base.(*terminal.TerminalController); ok {
+				tc.Interrupt()
+			}
+		case quit:
+			s.close()
+			app.Stop()
+		case keys.Matches(terminal.ActionScrollUp, event):
+			dialogView.ScrollPage(-1)
+		case keys.Matches(terminal.ActionScrollDown, event):
+			dialogView.ScrollPage(1)
+		case keys.Matches(terminal.ActionExplain, event):
+			if generating || env.working {
 				return nil
 			}
-		case tcell.KeyUp:
-			app.SetFocus(dialogView)
-		case tcell.KeyDown:
-			app.SetFocus(dialogInput)
+			if err := env.explain(""); err != nil {
+				dialogView.Transcript().AddError(err.Error())
+				dialogView.Refresh()
+			}
+		default:
+			return event
 		}
-		return event
+		return nil
 	})
-	if err := app.SetRoot(mainFlex, true).SetFocus(dialogInput).Run(); err != nil {
+	app.EnablePaste(true)
+	if err := app.SetRoot(pages, true).SetFocus(dialogInput).Run(); err != nil {
 		panic(err)
 	}
 }
 
-func checkAIConfig() ai.AiConfig {
-	// Get user home directory
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error getting home directory: %s\n", err.Error())
+// runPrompt runs a single request against the tmux pane and prints the agent
+// events to stdout, one JSON object per line
+func runPrompt(input string) {
+	s, cfg := openSession()
+	defer s.close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	aiClient := newAiClient(s, ai.NewJSONLinesHandler(os.Stdout), cfg)
+	s.input(input)
+	if err := aiClient.Run(ctx, input); err != nil {
+		s.close()
 		os.Exit(1)
 	}
-	configPath := filepath.Join(homeDir, ".aitermrc")
+}
 
-	// Detect and load configuration
-	config, err := loadConfig(configPath)
-	if err != nil || config.URL == "" || config.Token == "" || config.Model == "" {
+// newAiClient creates the AI client for a new session and attaches the audit
+// log if it is enabled
+func newAiClient(s *session, handler ai.Handler, cfg Config) *ai.AiClient {
+	aiClient := ai.Init(s.executor, handler, cfg.AI, s.options...)
+	aiClient.Session = audit.NewSessionID()
+	if r, ok := s.base.(*remote.Remote); ok {
+		aiClient.SetEnvironment(r.Describe())
+	}
+	if panes, ok := s.base.(ai.Panes); ok {
+		aiClient.SetPanes(panes)
+	}
+	if !cfg.RedactOff {
+		aiClient.Redact = redactFunc(cfg.Redact)
+	}
+	aiClient.SetPlanning(*plan)
+	if keys, ok := s.base.(ai.KeySender); ok {
+		aiClient.SetKeySender(keys)
+	}
+	if cfg.AuditPath != "" {
+		log, err := audit.Open(cfg.AuditPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error opening audit log: %s\n", err.Error())
+			os.Exit(1)
+		}
+		aiClient.Audit = log
+	}
+	return aiClient
+}
+
+// attachmentSummary lists what was attached to a prompt, and what could not be
+func attachmentSummary(attachments []terminal.Attachment) string {
+	parts := make([]string, len(attachments))
+	for i, a := range attachments {
+		parts[i] = a.String()
+	}
+	return "Attached " + strings.Join(parts, ", ")
+}
+
+// redactFunc returns the function masking secrets for the AI client. The
+// options were checked when the config was loaded.
+func redactFunc(opts redact.Options) func(string) (string, map[string]int) {
+	r, _ := redact.New(opts)
+	return func(text string) (string, map[string]int) {
+		return r.Redact(text)
+	}
+}
+
+func checkAIConfig() Config {
+	config, configPath := readConfig()
+	if config.AI.URL == "" || config.AI.Token == "" || config.AI.Model == "" {
 		// Configuration missing, start configuration UI and get config from user
-		config = configureAI()
+		config.AI = configureAI()
 		// check if config valid
-		if err := config.Validate(); err != nil {
+		if err := config.AI.Validate(); err != nil {
 			fmt.Fprintf(os.Stderr, "Error AI config: %s\n", err.Error())
 			os.Exit(1)
 		}
 		fmt.Println("Your config will be saved in ~/.aitermrc. Edit it if you want change provider information.")
 		// Save configuration
-		if err := saveConfig(configPath, config); err != nil {
+		if err := saveConfig(configPath, config.AI); err != nil {
 			fmt.Fprintf(os.Stderr, "Error saving config: %s\n", err.Error())
 			os.Exit(1)
 		}
@@ -143,9 +385,30 @@ func checkAIConfig() ai.AiConfig {
 	return config
 }
 
+// readConfig loads ~/.aitermrc and exits if it cannot be read or is invalid.
+// It also returns the path of the file.
+func readConfig() (Config, string) {
+	// Get user home directory
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error getting home directory: %s\n", err.Error())
+		os.Exit(1)
+	}
+	configPath := filepath.Join(homeDir, ".aitermrc")
+
+	// Detect and load configuration
+	config, err := loadConfig(configPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading %s: %s\n", configPath, err.Error())
+		os.Exit(1)
+	}
+	return config, configPath
+}
+
 // loadConfig load config from .aitermrc
-func loadConfig(path string) (ai.AiConfig, error) {
-	config := ai.AiConfig{}
+func loadConfig(path string) (Config, error) {
+	config := Config{Keys: terminal.DefaultKeyMap(), Theme: terminal.DefaultTheme(), Executor: "tmux"}
+	config.AuditPath, _ = audit.DefaultPath()
 	cfg, err := ini.Load(path)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -155,22 +418,136 @@ func loadConfig(path string) (ai.AiConfig, error) {
 	}
 
 	section := cfg.Section("ai")
-	config.URL = section.Key("url").String()
-	config.Token = section.Key("token").String()
-	config.Model = section.Key("model").String()
+	config.AI.URL = section.Key("url").String()
+	config.AI.Token = section.Key("token").String()
+	config.AI.Model = section.Key("model").String()
+
+	section = cfg.Section("audit")
+	if !section.Key("enabled").MustBool(true) {
+		config.AuditPath = ""
+	} else if path := section.Key("path").String(); path != "" {
+		config.AuditPath = path
+	}
+
+	config.Models = map[string]ai.ModelInfo{}
+	for _, section := range cfg.Sections() {
+		name, ok := strings.CutPrefix(section.Name(), "models.")
+		if !ok || name == "" {
+			continue
+		}
+		var info ai.ModelInfo
+		if info.Context, err = section.Key("context").Int64(); err != nil && section.HasKey("context") {
+			return config, fmt.Errorf("[%s] context: %w", section.Name(), err)
+		}
+		if info.InputPrice, err = section.Key("input_price").Float64(); err != nil && section.HasKey("input_price") {
+			return config, fmt.Errorf("[%s] input_price: %w", section.Name(), err)
+		}
+		if info.OutputPrice, err = section.Key("output_price").Float64(); err != nil && section.HasKey("output_price") {
+			return config, fmt.Errorf("[%s] output_price: %w", section.Name(), err)
+		}
+		config.Models[name] = info
+	}
+
+	section = cfg.Section("executor")
+	config.Executor = section.Key("type").In("tmux", []string{"tmux", "sandbox", "container", "ssh"})
+	if section.HasKey("type") && config.Executor != section.Key("type").String() {
+		return config, fmt.Errorf("[executor] type: unknown executor %q, expected tmux, sandbox, container or ssh", section.Key("type").String())
+	}
+
+	section = cfg.Section("redact")
+	config.RedactOff = !section.Key("enabled").MustBool(true)
+	config.Redact.Entropy = section.Key("entropy").MustBool(true)
+	for name, pattern := range section.KeysHash() {
+		if name != "enabled" && name != "entropy" {
+			if config.Redact.Patterns == nil {
+				config.Redact.Patterns = map[string]string{}
+			}
+			config.Redact.Patterns[name] = pattern
+		}
+	}
+	if _, err := redact.New(config.Redact); err != nil {
+		return config, fmt.Errorf("[redact] %w", err)
+	}
+
+	section = cfg.Section("fix")
+	config.FixAttempts = section.Key("attempts").MustInt(ai.DefaultFixAttempts)
+	if config.FixAttempts < 1 {
+		return config, fmt.Errorf("[fix] attempts: expected at least 1, not %d", config.FixAttempts)
+	}
+
+	section = cfg.Section("tmux")
+	config.Tmux.Pane = section.Key("pane").String()
+	switch split := section.Key("split").String(); split {
+	case "", "h", "v":
+		config.Tmux.Vertical = split == "v"
+	default:
+		return config, fmt.Errorf("[tmux] split: expected h or v, not %q", split)
+	}
+	if section.HasKey("size") {
+		if config.Tmux.Size, err = section.Key("size").Int(); err != nil {
+			return config, fmt.Errorf("[tmux] size: %w", err)
+		}
+	}
+	config.Tmux.Window = section.Key("window").MustBool(false)
+	config.Tmux.Keep = section.Key("keep").MustBool(false)
+	config.Tmux.Integration = section.Key("integration").MustBool(false)
+
+	section = cfg.Section("sandbox")
+	config.Sandbox.Backend = section.Key("backend").String()
+	config.Sandbox.Dir = section.Key("dir").String()
+	config.Sandbox.Network = section.Key("network").MustBool(false)
+	for name, d := range map[string]*time.Duration{"cpu": &config.Sandbox.CPU, "timeout": &config.Sandbox.Timeout} {
+		if !section.HasKey(name) {
+			continue
+		}
+		if *d, err = section.Key(name).Duration(); err != nil {
+			return config, fmt.Errorf("[sandbox] %s: %w", name, err)
+		}
+	}
+	if section.HasKey("memory") {
+		mb, err := section.Key("memory").Int64()
+		if err != nil {
+			return config, fmt.Errorf("[sandbox] memory: %w", err)
+		}
+		config.Sandbox.Memory = mb << 20
+	}
+
+	section = cfg.Section("container")
+	config.Container.Runtime = section.Key("runtime").String()
+	config.Container.Image = section.Key("image").String()
+	config.Container.Name = section.Key("name").String()
+	config.Container.Dir = section.Key("dir").String()
+
+	section = cfg.Section("ssh")
+	config.SSH.Target = section.Key("host").String()
+	config.SSH.Identities = section.Key("identity").Strings(",")
+	config.SSH.KnownHosts = section.Key("known_hosts").String()
+	config.SSH.UseAgent = section.Key("agent").MustBool(true)
+	if section.HasKey("timeout") {
+		if config.SSH.Timeout, err = section.Key("timeout").Duration(); err != nil {
+			return config, fmt.Errorf("[ssh] timeout: %w", err)
+		}
+	}
+
+	if config.Keys, err = terminal.ParseKeyMap(cfg.Section("keys").KeysHash()); err != nil {
+		return config, fmt.Errorf("[keys] %w", err)
+	}
+	if config.Theme, err = terminal.ParseTheme(cfg.Section("theme").KeysHash()); err != nil {
+		return config, fmt.Errorf("[theme] %w", err)
+	}
 	return config, nil
 }
 
-// saveConfig save config to .aitermrc
+// saveConfig save ai config to .aitermrc, keeping the other sections
 func saveConfig(path string, config ai.AiConfig) error {
-	cfg := ini.Empty()
-	section, err := cfg.NewSection("ai")
+	cfg, err := ini.Load(path)
 	if err != nil {
-		return err
+		cfg = ini.Empty()
 	}
-	section.NewKey("url", config.URL)
-	section.NewKey("token", config.Token)
-	section.NewKey("model", config.Model)
+	section := cfg.Section("ai")
+	section.Key("url").SetValue(config.URL)
+	section.Key("token").SetValue(config.Token)
+	section.Key("model").SetValue(config.Model)
 	return cfg.SaveTo(path)
 }
 
@@ -198,7 +575,7 @@ func configureAI() ai.AiConfig {
 }
 
 // show generating anime
-func generatingAnime(ctx context.Context, dialogInput *tview.InputField, app *tview.Application) {
+func generatingAnime(ctx context.Context, dialogInput *terminal.PromptEditor, app *tview.Application) {
 	ticker := time.NewTicker(500 * time.Millisecond)
 	defer ticker.Stop()
 	states := []string{".", "..", "..."}
@@ -0,0 +1,175 @@
+// Package redact masks secrets in command output before it is sent to the
+// model.
+package redact
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Options configures a Redactor, from the [redact] section
+type Options struct {
+	// Entropy also masks long random-looking strings
+	Entropy bool
+	// Patterns are extra regular expressions by name. When one has a group,
+	// only the first group is masked.
+	Patterns map[string]string
+}
+
+// Counts is the number of secrets masked, by kind
+type Counts map[string]int
+
+// Total returns the number of secrets masked
+func (c Counts) Total() int {
+	n := 0
+	for _, v := range c {
+		n += v
+	}
+	return n
+}
+
+// String lists the counts by kind, such as "2 aws-access-key, 1 jwt"
+func (c Counts) String() string {
+	kinds := make([]string, 0, len(c))
+	for kind := range c {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	parts := make([]string, len(kinds))
+	for i, kind := range kinds {
+		parts[i] = fmt.Sprintf("%d %s", c[kind], kind)
+	}
+	return strings.Join(parts, ", ")
+}
+
+type pattern struct {
+	kind  string
+	re    *regexp.Regexp
+	group int // the group masked, 0 for the whole match
+}
+
+// builtin are the detectors of common secrets, the most specific first
+var builtin = []pattern{
+	{"private-key", regexp.MustCompile(`-----BEGIN [A-Z0-9 ]*PRIVATE KEY( BLOCK)?-----[\s\S]*?(-----END [A-Z0-9 ]*PRIVATE KEY( BLOCK)?-----|\z)`), 0},
+	{"aws-access-key", regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`), 0},
+	{"aws-secret-key", regexp.MustCompile(`(?i)aws_secret_access_key[ \t]*[=:][ \t]*["']?([A-Za-z0-9/+=]{40})`), 1},
+	{"github-token", regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{40,})\b`), 0},
+	{"gitlab-token", regexp.MustCompile(`\bglpat-[A-Za-z0-9_-]{20,}`), 0},
+	{"slack-token", regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9-]{10,}`), 0},
+	{"stripe-key", regexp.MustCompile(`\b[rs]k_(live|test)_[A-Za-z0-9]{16,}`), 0},
+	{"api-key", regexp.MustCompile(`\bsk-[A-Za-z0-9_-]{20,}`), 0},
+	{"google-api-key", regexp.MustCompile(`\bAIza[0-9A-Za-z_-]{35}\b`), 0},
+	{"jwt", regexp.MustCompile(`\beyJ[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}\.[A-Za-z0-9_-]{10,}`), 0},
+	{"url-password", regexp.MustCompile(`\b[a-zA-Z][a-zA-Z0-9+.-]*://[^/\s:@]+:([^@\s/]+)@`), 1},
+	{"secret", regexp.MustCompile(`(?i)\b[a-z0-9_.-]*(password|passwd|secret|token|api_?key|access_?key|private_?key|credentials?)[a-z0-9_.-]*["']?[ \t]*[=:][ \t]*["']?([^\s"',;]{4,})`), 2},
+}
+
+// tokenRe finds the candidates for the entropy check
+var tokenRe = regexp.MustCompile(`[A-Za-z0-9+/=_-]{24,}`)
+
+// Redactor masks secrets in text
+type Redactor struct {
+	patterns []pattern
+	entropy  bool
+}
+
+// New returns a Redactor with the built-in detectors and the patterns of opts
+func New(opts Options) (*Redactor, error) {
+	r := &Redactor{patterns: append([]pattern(nil), builtin...), entropy: opts.Entropy}
+	names := make([]string, 0, len(opts.Patterns))
+	for name := range opts.Patterns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		re, err := regexp.Compile(opts.Patterns[name])
+		if err != nil {
+			return nil, fmt.Errorf("pattern %s: %w", name, err)
+		}
+		group := 0
+		if re.NumSubexp() > 0 {
+			group = 1
+		}
+		// Custom patterns go first, they know the secrets of this user best
+		r.patterns = append([]pattern{{name, re, group}}, r.patterns...)
+	}
+	return r, nil
+}
+
+// mask is what replaces a secret of a kind
+func mask(kind string) string {
+	return "[REDACTED:" + kind + "]"
+}
+
+// Redact returns text with its secrets masked and how many were masked
+func (r *Redactor) Redact(text string) (string, Counts) {
+	counts := Counts{}
+	for _, p := range r.patterns {
+		text = p.replace(text, counts)
+	}
+	if r.entropy {
+		text = tokenRe.ReplaceAllStringFunc(text, func(token string) string {
+			if !random(token) {
+				return token
+			}
+			counts["high-entropy"]++
+			return mask("high-entropy")
+		})
+	}
+	return text, counts
+}
+
+// replace masks the matches of the pattern in text
+func (p pattern) replace(text string, counts Counts) string {
+	matches := p.re.FindAllStringSubmatchIndex(text, -1)
+	if matches == nil {
+		return text
+	}
+	var sb strings.Builder
+	last := 0
+	for _, m := range matches {
+		start, end := m[2*p.group], m[2*p.group+1]
+		if start < 0 || strings.HasPrefix(text[start:end], "[REDACTED:") {
+			continue
+		}
+		sb.WriteString(text[last:start])
+		sb.WriteString(mask(p.kind))
+		last = end
+		counts[p.kind]++
+	}
+	sb.WriteString(text[last:])
+	return sb.String()
+}
+
+// random reports whether a token looks like a random secret: mixed case with
+// digits, high entropy, and not a path
+func random(token string) bool {
+	if strings.Count(token, "/") > 1 || strings.HasPrefix(token, "REDACTED") {
+		return false
+	}
+	var upper, lower, digit bool
+	freq := map[rune]float64{}
+	for _, c := range token {
+		switch {
+		case c >= 'A' && c <= 'Z':
+			upper = true
+		case c >= 'a' && c <= 'z':
+			lower = true
+		case c >= '0' && c <= '9':
+			digit = true
+		}
+		freq[c]++
+	}
+	if !upper || !lower || !digit {
+		return false
+	}
+	entropy := 0.0
+	for _, n := range freq {
+		p := n / float64(len(token))
+		entropy -= p * math.Log2(p)
+	}
+	return entropy >= 4.0
+}
@@ -0,0 +1,287 @@
+// Package remote runs commands on another host over SSH.
+package remote
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aki-colt/aiterm/ai"
+	"github.com/aki-colt/aiterm/internal/shell"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Options configures the SSH connection, from the -host flag and the [ssh]
+// section
+type Options struct {
+	Target     string   // [user@]host[:port]
+	Identities []string // private key files, ~/.ssh/id_* by default
+	KnownHosts string   // ~/.ssh/known_hosts by default
+	// UseAgent authenticates with the keys of the agent at $SSH_AUTH_SOCK
+	UseAgent bool
+	Timeout  time.Duration
+}
+
+// Remote is an executor running commands on a host over SSH, each in a new
+// session. The working directory persists from one command to the next.
+type Remote struct {
+	client *ssh.Client
+	agent  net.Conn // connection to the SSH agent, if any
+	target string   // user@host
+	home   string
+	system string // output of uname
+	shell  string
+	mutex  sync.Mutex
+	cwd    string
+}
+
+// parseTarget splits [user@]host[:port]
+func parseTarget(target string) (username, addr string, err error) {
+	host := target
+	if i := strings.LastIndex(target, "@"); i >= 0 {
+		username, host = target[:i], target[i+1:]
+	}
+	if host == "" {
+		return "", "", fmt.Errorf("missing host in %q", target)
+	}
+	if username == "" {
+		u, err := user.Current()
+		if err != nil {
+			return "", "", err
+		}
+		username = u.Username
+	}
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), "22")
+	}
+	return username, host, nil
+}
+
+// expandHome replaces a leading ~/ with the home directory
+func expandHome(path string) string {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	return path
+}
+
+// authMethods returns the agent, if any, then the keys that can be read
+// without a passphrase. The connection to the agent is returned to be closed
+// with the client.
+func authMethods(opts Options) ([]ssh.AuthMethod, net.Conn, error) {
+	var methods []ssh.AuthMethod
+	var agentConn net.Conn
+	if sock := os.Getenv("SSH_AUTH_SOCK"); opts.UseAgent && sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			agentConn = conn
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+	methods, err := keyMethods(opts, methods)
+	if err != nil && agentConn != nil {
+		agentConn.Close()
+		agentConn = nil
+	}
+	return methods, agentConn, err
+}
+
+// keyMethods adds the keys that can be read without a passphrase to methods
+func keyMethods(opts Options, methods []ssh.AuthMethod) ([]ssh.AuthMethod, error) {
+	identities := opts.Identities
+	if len(identities) == 0 {
+		home, _ := os.UserHomeDir()
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			identities = append(identities, filepath.Join(home, ".ssh", name))
+		}
+	}
+	var signers []ssh.Signer
+	for _, path := range identities {
+		path = expandHome(path)
+		data, err := os.ReadFile(path)
+		if err != nil {
+			if os.IsNotExist(err) && len(opts.Identities) == 0 {
+				continue
+			}
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		var missing *ssh.PassphraseMissingError
+		if errors.As(err, &missing) {
+			// Encrypted keys are expected to be in the agent
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if len(methods) == 0 {
+		return nil, errors.New("no SSH agent and no usable key, add a key to the agent or set identity in [ssh]")
+	}
+	return methods, nil
+}
+
+// hostKeyCallback checks host keys against known_hosts and explains failures
+func hostKeyCallback(path string) (ssh.HostKeyCallback, error) {
+	if path == "" {
+		home, _ := os.UserHomeDir()
+		path = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	path = expandHome(path)
+	check, err := knownhosts.New(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading known hosts: %w", err)
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := check(hostname, remote, key)
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) {
+			if len(keyErr.Want) == 0 {
+				return fmt.Errorf("%s is not in %s, connect once with ssh to check and add its key", hostname, path)
+			}
+			return fmt.Errorf("the host key of %s does not match the one in %s:%d, it may have been replaced or the connection intercepted",
+				hostname, keyErr.Want[0].Filename, keyErr.Want[0].Line)
+		}
+		return err
+	}, nil
+}
+
+// Dial connects to the host and detects its system and shell
+func Dial(opts Options) (*Remote, error) {
+	username, addr, err := parseTarget(opts.Target)
+	if err != nil {
+		return nil, err
+	}
+	check, err := hostKeyCallback(opts.KnownHosts)
+	if err != nil {
+		return nil, err
+	}
+	methods, agentConn, err := authMethods(opts)
+	if err != nil {
+		return nil, err
+	}
+	timeout := opts.Timeout
+	if timeout == 0 {
+		timeout = 10 * time.Second
+	}
+	client, err := dial(addr, timeout, &ssh.ClientConfig{
+		User:            username,
+		Auth:            methods,
+		HostKeyCallback: check,
+	})
+	if err != nil {
+		if agentConn != nil {
+			agentConn.Close()
+		}
+		return nil, fmt.Errorf("connecting to %s: %w", opts.Target, err)
+	}
+
+	r := &Remote{client: client, agent: agentConn, target: username + "@" + strings.TrimSuffix(addr, ":22")}
+	out, err := r.run(`uname -srm; printf '%s\n' "$SHELL"; pwd`)
+	if err != nil {
+		r.Close()
+		return nil, fmt.Errorf("detecting the system of %s: %w", r.target, err)
+	}
+	lines := strings.Split(strings.TrimSpace(out), "\n")
+	for len(lines) < 3 {
+		lines = append(lines, "")
+	}
+	r.system, r.shell, r.home = lines[0], lines[1], lines[2]
+	r.cwd = r.home
+	return r, nil
+}
+
+// dial connects to addr and authenticates within timeout. The timeout of
+// ssh.ClientConfig only bounds the TCP connection, not the handshake.
+func dial(addr string, timeout time.Duration, config *ssh.ClientConfig) (*ssh.Client, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// run runs a command in a new session and returns its combined output
+func (r *Remote) run(command string) (string, error) {
+	session, err := r.client.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	out, err := session.CombinedOutput(command)
+	return string(out), err
+}
+
+// Target returns user@host
+func (r *Remote) Target() string {
+	return r.target
+}
+
+// Describe tells the model where its commands run
+func (r *Remote) Describe() string {
+	system := r.system
+	if system == "" {
+		system = "an unknown system"
+	}
+	desc := fmt.Sprintf("Commands run over SSH on %s, %s", r.target, system)
+	if r.shell != "" {
+		desc += ", login shell " + r.shell
+	}
+	return desc + ". Commands are run by sh. Programs found by checkCommand and getAvailableCommands are those of the local machine, not of this host; check for a program with `command -v` instead."
+}
+
+// Cwd returns the directory the next command runs in
+func (r *Remote) Cwd() (string, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.cwd, nil
+}
+
+func (r *Remote) Execute(command string) (ai.CommandResult, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	// The login shell may not be POSIX, so the script is handed to sh
+	out, err := r.run("sh -c " + shell.Quote(shell.Script("", r.cwd, r.home, command)))
+	output, code, cwd := shell.Parse(out)
+	res := ai.CommandResult{Output: output, ExitCode: code, Cwd: r.cwd}
+	if cwd != "" {
+		r.cwd, res.Cwd = cwd, cwd
+	}
+	if code < 0 {
+		var exitErr *ssh.ExitError
+		if !errors.As(err, &exitErr) {
+			return res, fmt.Errorf("running the command on %s: %w", r.target, err)
+		}
+		res.ExitCode = exitErr.ExitStatus()
+	}
+	return res, nil
+}
+
+// Close closes the connection, and the one to the agent
+func (r *Remote) Close() error {
+	if r.agent != nil {
+		r.agent.Close()
+	}
+	return r.client.Close()
+}
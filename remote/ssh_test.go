@@ -0,0 +1,186 @@
+package remote_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aki-colt/aiterm/remote"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// server is an in-process SSH server running exec requests with the local sh
+type server struct {
+	addr    string
+	hostKey ssh.PublicKey
+}
+
+func newServer(t *testing.T, clientKey ssh.PublicKey) *server {
+	t.Helper()
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(_ ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, errors.New("unknown key")
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go serveConn(conn, config)
+		}
+	}()
+	return &server{addr: l.Addr().String(), hostKey: hostSigner.PublicKey()}
+}
+
+func serveConn(conn net.Conn, config *ssh.ServerConfig) {
+	_, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	for newChan := range chans {
+		if newChan.ChannelType() != "session" {
+			newChan.Reject(ssh.UnknownChannelType, "")
+			continue
+		}
+		ch, requests, err := newChan.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			defer ch.Close()
+			for req := range requests {
+				if req.Type != "exec" {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+				command := string(req.Payload[4:])
+				cmd := exec.Command("sh", "-c", command)
+				cmd.Env = append(os.Environ(), "SHELL=/bin/testsh")
+				cmd.Stdout, cmd.Stderr = ch, ch.Stderr()
+				status := make([]byte, 4)
+				if err := cmd.Run(); err != nil {
+					var exitErr *exec.ExitError
+					if errors.As(err, &exitErr) {
+						binary.BigEndian.PutUint32(status, uint32(exitErr.ExitCode()))
+					}
+				}
+				ch.SendRequest("exit-status", false, status)
+				return
+			}
+		}()
+	}
+}
+
+// clientKey writes a new private key and returns its path and public key
+func clientKey(t *testing.T) (string, ssh.PublicKey) {
+	t.Helper()
+	_, priv, _ := ed25519.GenerateKey(rand.Reader)
+	block, err := ssh.MarshalPrivateKey(priv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(path, pem.EncodeToMemory(block), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	signer, _ := ssh.NewSignerFromKey(priv)
+	return path, signer.PublicKey()
+}
+
+// writeKnownHosts writes a known_hosts file trusting key for addr, or an
+// empty one when key is nil
+func writeKnownHosts(t *testing.T, addr string, key ssh.PublicKey) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	content := ""
+	if key != nil {
+		content = knownhosts.Line([]string{addr}, key) + "\n"
+	}
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestRemote(t *testing.T) {
+	identity, pub := clientKey(t)
+	srv := newServer(t, pub)
+	knownHosts := writeKnownHosts(t, srv.addr, srv.hostKey)
+	dir := t.TempDir()
+
+	r, err := remote.Dial(remote.Options{Target: "alice@" + srv.addr, Identities: []string{identity}, KnownHosts: knownHosts})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer r.Close()
+
+	if desc := r.Describe(); !strings.Contains(desc, "alice@") || !strings.Contains(desc, "/bin/testsh") {
+		t.Errorf("Describe = %q", desc)
+	}
+	res, err := r.Execute("cd " + dir + " && echo remote")
+	if err != nil {
+		t.Fatalf("Execute: %v", err)
+	}
+	if res.Output != "remote" || res.ExitCode != 0 || res.Cwd != dir {
+		t.Errorf("result = %+v", res)
+	}
+	if res, _ := r.Execute("pwd; exit 4"); res.Output != dir || res.ExitCode != 4 {
+		t.Errorf("second command = %+v", res)
+	}
+}
+
+func TestRemoteHostKeyChecks(t *testing.T) {
+	identity, pub := clientKey(t)
+	srv := newServer(t, pub)
+
+	knownHosts := writeKnownHosts(t, srv.addr, nil)
+	_, err := remote.Dial(remote.Options{Target: srv.addr, Identities: []string{identity}, KnownHosts: knownHosts})
+	if err == nil || !strings.Contains(err.Error(), "is not in") {
+		t.Errorf("unknown host: %v", err)
+	}
+
+	_, otherKey := clientKey(t)
+	knownHosts = writeKnownHosts(t, srv.addr, otherKey)
+	_, err = remote.Dial(remote.Options{Target: srv.addr, Identities: []string{identity}, KnownHosts: knownHosts})
+	if err == nil || !strings.Contains(err.Error(), "does not match") {
+		t.Errorf("changed host key: %v", err)
+	}
+}
+
+func TestRemoteRejectedKey(t *testing.T) {
+	_, pub := clientKey(t)
+	srv := newServer(t, pub)
+	identity, _ := clientKey(t)
+	knownHosts := writeKnownHosts(t, srv.addr, srv.hostKey)
+	if _, err := remote.Dial(remote.Options{Target: srv.addr, Identities: []string{identity}, KnownHosts: knownHosts}); err == nil {
+		t.Error("Dial succeeded with an unknown key")
+	}
+}
@@ -0,0 +1,224 @@
+// Package sandbox runs commands in Linux namespaces, with the host filesystem
+// read-only, the project directory writable through an overlay whose changes
+// never reach the host, no network unless allowed, and resource limits.
+package sandbox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aki-colt/aiterm/ai"
+	"github.com/aki-colt/aiterm/internal/shell"
+)
+
+const (
+	BackendBwrap   = "bwrap"
+	BackendUnshare = "unshare"
+)
+
+// Options configures a sandbox, from the [sandbox] section
+type Options struct {
+	Backend string        // BackendBwrap, BackendUnshare, or empty for the first available
+	Dir     string        // project directory, writable through an overlay
+	Network bool          // share the host network
+	CPU     time.Duration // CPU time of a command, 0 for no limit
+	Memory  int64         // address space of a command in bytes, 0 for no limit
+	Timeout time.Duration // wall time of a command, 0 for no limit
+}
+
+// Sandbox is an executor running each command in a fresh sandbox. The
+// overlay and the working directory persist from one command to the next.
+type Sandbox struct {
+	opts  Options
+	base  string // holds the upper and work directories of the overlay
+	mutex sync.Mutex
+	cwd   string
+}
+
+// New checks that the backend can be used and prepares the overlay
+func New(opts Options) (*Sandbox, error) {
+	if opts.Dir == "" {
+		dir, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		opts.Dir = dir
+	}
+	dir, err := filepath.Abs(opts.Dir)
+	if err != nil {
+		return nil, err
+	}
+	opts.Dir = dir
+
+	switch opts.Backend {
+	case "":
+		for _, b := range []string{BackendBwrap, BackendUnshare} {
+			if _, err := exec.LookPath(b); err == nil {
+				opts.Backend = b
+				break
+			}
+		}
+		if opts.Backend == "" {
+			return nil, errors.New("neither bwrap nor unshare is installed")
+		}
+	case BackendBwrap, BackendUnshare:
+		if _, err := exec.LookPath(opts.Backend); err != nil {
+			return nil, fmt.Errorf("sandbox backend %s: %w", opts.Backend, err)
+		}
+	default:
+		return nil, fmt.Errorf("unknown sandbox backend %q, expected bwrap or unshare", opts.Backend)
+	}
+
+	base, err := os.MkdirTemp("", "aiterm-sandbox-")
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range []string{"upper", "work", "root"} {
+		if err := os.Mkdir(filepath.Join(base, d), 0o700); err != nil {
+			os.RemoveAll(base)
+			return nil, err
+		}
+	}
+	return &Sandbox{opts: opts, base: base, cwd: opts.Dir}, nil
+}
+
+// Backend returns the backend in use
+func (s *Sandbox) Backend() string {
+	return s.opts.Backend
+}
+
+// Upper returns the directory holding the files changed in the sandbox
+func (s *Sandbox) Upper() string {
+	return filepath.Join(s.base, "upper")
+}
+
+// Cwd returns the directory the next command runs in
+func (s *Sandbox) Cwd() (string, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.cwd, nil
+}
+
+// Close discards the changes made in the sandbox
+func (s *Sandbox) Close() error {
+	// The work directory of an overlay may hold entries only root can
+	// remove; make them removable first
+	filepath.Walk(s.base, func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.IsDir() {
+			os.Chmod(path, 0o700)
+		}
+		return nil
+	})
+	return os.RemoveAll(s.base)
+}
+
+func (s *Sandbox) Execute(command string) (ai.CommandResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	ctx := context.Background()
+	if s.opts.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.opts.Timeout)
+		defer cancel()
+	}
+	cmd := exec.CommandContext(ctx, s.opts.Backend, s.args(s.script(command))...)
+	cmd.WaitDelay = time.Second
+	var out bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &out, &out
+	err := cmd.Run()
+
+	output, code, cwd := shell.Parse(out.String())
+	res := ai.CommandResult{Output: output, ExitCode: code, Cwd: s.cwd}
+	if cwd != "" {
+		s.cwd, res.Cwd = cwd, cwd
+	}
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		res.Output += fmt.Sprintf("\naiterm: the command was killed after %s", s.opts.Timeout)
+		res.ExitCode = -1
+	case code < 0:
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return res, fmt.Errorf("failed to start the sandbox: %w", err)
+		}
+		// The command exited the shell, or the sandbox could not be set up
+		res.ExitCode = exitErr.ExitCode()
+	}
+	return res, nil
+}
+
+// script is the shell script run in the sandbox for command
+func (s *Sandbox) script(command string) string {
+	var limits strings.Builder
+	if s.opts.CPU > 0 {
+		fmt.Fprintf(&limits, "ulimit -t %d\n", max(int64(s.opts.CPU/time.Second), 1))
+	}
+	if s.opts.Memory > 0 {
+		fmt.Fprintf(&limits, "ulimit -v %d\n", max(s.opts.Memory/1024, 1))
+	}
+	return shell.Script(limits.String(), s.cwd, s.opts.Dir, command)
+}
+
+// args returns the arguments of the backend running script
+func (s *Sandbox) args(script string) []string {
+	upper, work := filepath.Join(s.base, "upper"), filepath.Join(s.base, "work")
+	if s.opts.Backend == BackendBwrap {
+		args := []string{
+			"--ro-bind", "/", "/",
+			"--dev", "/dev",
+			"--proc", "/proc",
+			"--tmpfs", "/tmp",
+			"--overlay-src", s.opts.Dir, "--overlay", upper, work, s.opts.Dir,
+			"--unshare-all",
+			"--die-with-parent",
+			"--new-session",
+		}
+		if s.opts.Network {
+			args = append(args, "--share-net")
+		}
+		return append(args, "sh", "-c", script)
+	}
+
+	args := []string{"--user", "--map-root-user", "--mount", "--pid", "--fork", "--kill-child"}
+	if !s.opts.Network {
+		args = append(args, "--net")
+	}
+	return append(args, "sh", "-c", unshareSetup, "sh", filepath.Join(s.base, "root"), s.opts.Dir, upper, work, script)
+}
+
+// unshareSetup builds a root like bwrap does: every top level directory of
+// the host bound read-only, fresh /proc and /tmp, and the overlay on the
+// project directory, then runs the script chrooted into it
+const unshareSetup = `set -e
+root=$1 dir=$2 upper=$3 work=$4
+mount -t tmpfs tmpfs "$root"
+for d in /*; do
+	name=${d#/}
+	case $name in proc|dev|sys|tmp) continue ;; esac
+	if [ -L "$d" ]; then
+		ln -s "$(readlink "$d")" "$root/$name"
+	elif [ -d "$d" ]; then
+		mkdir "$root/$name"
+		mount --rbind "$d" "$root/$name"
+		mount -o remount,bind,ro "$root/$name"
+	fi
+done
+mkdir "$root/proc" "$root/dev" "$root/sys" "$root/tmp"
+mount -t proc proc "$root/proc"
+mount --rbind /dev "$root/dev"
+mount --rbind /sys "$root/sys"
+mount -t tmpfs tmpfs "$root/tmp"
+mkdir -p "$root$dir"
+mount -t overlay overlay -o "lowerdir=$dir,upperdir=$upper,workdir=$work" "$root$dir"
+set +e
+exec chroot "$root" /bin/sh -c "$5"
+`
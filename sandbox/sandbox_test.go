@@ -0,0 +1,109 @@
+package sandbox_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aki-colt/aiterm/sandbox"
+)
+
+// newSandbox returns an unshare sandbox on a new project directory, or skips
+// the test when user namespaces are not available
+func newSandbox(t *testing.T, opts sandbox.Options) (*sandbox.Sandbox, string) {
+	t.Helper()
+	if err := exec.Command("unshare", "--user", "--map-root-user", "--mount", "true").Run(); err != nil {
+		t.Skipf("user namespaces are not available: %v", err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.txt"), []byte("host"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	opts.Backend = sandbox.BackendUnshare
+	opts.Dir = dir
+	s, err := sandbox.New(opts)
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s, dir
+}
+
+func TestSandboxOverlay(t *testing.T) {
+	s, dir := newSandbox(t, sandbox.Options{})
+
+	res, err := s.Execute("echo sandbox > a.txt && mkdir sub && cd sub && cat ../a.txt")
+	if err != nil {
+		t.Fatalf("Execute: %v", err)
+	}
+	if res.Output != "sandbox" || res.ExitCode != 0 || res.Cwd != filepath.Join(dir, "sub") {
+		t.Errorf("result = %+v", res)
+	}
+	// The host is untouched, the next command sees the change
+	if data, _ := os.ReadFile(filepath.Join(dir, "a.txt")); string(data) != "host" {
+		t.Errorf("host a.txt = %q", data)
+	}
+	res, _ = s.Execute("pwd; cat ../a.txt")
+	if res.Output != filepath.Join(dir, "sub")+"\nsandbox" {
+		t.Errorf("second command = %+v", res)
+	}
+	if _, err := os.Stat(filepath.Join(s.Upper(), "a.txt")); err != nil {
+		t.Errorf("upper directory: %v", err)
+	}
+}
+
+func TestSandboxIsolation(t *testing.T) {
+	s, _ := newSandbox(t, sandbox.Options{})
+	home, _ := os.UserHomeDir()
+	probe := filepath.Join(home, ".aiterm-sandbox-probe")
+
+	res, err := s.Execute("touch " + probe + " /etc/aiterm-probe")
+	if err != nil {
+		t.Fatalf("Execute: %v", err)
+	}
+	if res.ExitCode == 0 || !strings.Contains(res.Output, "Read-only") {
+		t.Errorf("writing outside the project: %+v", res)
+	}
+	if _, err := os.Stat(probe); err == nil {
+		os.Remove(probe)
+		t.Error("the sandbox wrote to the home directory")
+	}
+
+	// Only the loopback interface exists in a new network namespace
+	res, _ = s.Execute("tail -n +3 /proc/net/dev | grep -vc 'lo:'")
+	if res.Output != "0" {
+		t.Errorf("interfaces up without network: %+v", res)
+	}
+
+	res, _ = s.Execute("exit 3")
+	if res.ExitCode != 3 {
+		t.Errorf("exit code = %d, want 3", res.ExitCode)
+	}
+}
+
+func TestSandboxLimits(t *testing.T) {
+	s, _ := newSandbox(t, sandbox.Options{Timeout: 500 * time.Millisecond})
+	start := time.Now()
+	res, err := s.Execute("sleep 10")
+	if err != nil {
+		t.Fatalf("Execute: %v", err)
+	}
+	if time.Since(start) > 5*time.Second || !strings.Contains(res.Output, "killed after") {
+		t.Errorf("timeout: %+v after %s", res, time.Since(start))
+	}
+
+	s, _ = newSandbox(t, sandbox.Options{Memory: 64 << 20})
+	res, _ = s.Execute("ulimit -v")
+	if res.Output != "65536" {
+		t.Errorf("ulimit -v = %+v", res)
+	}
+}
+
+func TestSandboxUnknownBackend(t *testing.T) {
+	if _, err := sandbox.New(sandbox.Options{Backend: "chroot"}); err == nil || !strings.Contains(err.Error(), "unknown sandbox backend") {
+		t.Errorf("New = %v", err)
+	}
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/aki-colt/aiterm/ai"
+	"github.com/aki-colt/aiterm/cassette"
+	"github.com/aki-colt/aiterm/container"
+	"github.com/aki-colt/aiterm/remote"
+	"github.com/aki-colt/aiterm/sandbox"
+	"github.com/aki-colt/aiterm/snapshot"
+	"github.com/aki-colt/aiterm/terminal"
+	"github.com/openai/openai-go/option"
+)
+
+var (
+	record       = flag.String("record", "", "Record model responses and command outputs to this cassette file")
+	replay       = flag.String("replay", "", "Replay a cassette file instead of calling the model and running commands")
+	replayDelay  = flag.Duration("replay-delay", 0, "Pause between streamed chunks when replaying, e.g. 30ms for demos")
+	executorFlag = flag.String("executor", "", "Where commands run: tmux, sandbox, container or ssh, overriding [executor] type")
+	host         = flag.String("host", "", "Run commands on this host over SSH, as user@server[:port]")
+	paneFlag     = flag.String("pane", "", "Run commands in this existing tmux pane, e.g. %3, or pick one from a list with -pane pick")
+	split        = flag.String("split", "", "Split the window side by side (h) or top and bottom (v) for the pane")
+	paneSize     = flag.Int("size", 0, "Percent of the window given to the pane")
+	newWindow    = flag.Bool("window", false, "Open the pane in a new tmux window rather than splitting")
+	keepPane     = flag.Bool("keep-pane", false, "Leave the pane open on exit")
+	integration  = flag.Bool("shell-integration", false, "Mark the commands of the panes with OSC 133 to know their exit codes")
+	snapshots    = flag.Bool("snapshot", false, "Checkpoint the working directory before each command so that /undo can revert it")
+)
+
+// session is what a run of aiterm talks to: the executor for commands and the
+// options for the model client, wired for recording or replaying if asked
+type session struct {
+	executor ai.Executor
+	base     ai.Executor // the executor before recording or checkpointing
+	options  []option.RequestOption
+	recorder *cassette.Recorder
+	player   *cassette.Player
+	store    *snapshot.Store // nil unless -snapshot is set
+	stop     func()
+}
+
+// openSession loads the configuration and prepares the executor. A replayed
+// session needs neither configuration nor tmux.
+func openSession() (*session, Config) {
+	if *replay != "" {
+		c, err := cassette.Load(*replay)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading cassette: %s\n", err.Error())
+			os.Exit(1)
+		}
+		player := cassette.NewPlayer(c)
+		player.Delay = *replayDelay
+		// The rest of the configuration, such as keys, still applies
+		cfg, _ := readConfig()
+		cfg.AI = ai.AiConfig{URL: "http://replay.invalid", Token: "replay", Model: player.Model()}
+		return &session{
+			executor: player,
+			base:     player,
+			options:  []option.RequestOption{option.WithHTTPClient(&http.Client{Transport: player.Transport()})},
+			player:   player,
+			stop:     func() {},
+		}, cfg
+	}
+
+	cfg := checkAIConfig()
+	if *executorFlag != "" {
+		cfg.Executor = *executorFlag
+	}
+	if *host != "" {
+		cfg.Executor, cfg.SSH.Target = "ssh", *host
+	}
+	s := &session{}
+	switch cfg.Executor {
+	case "tmux":
+		opts, err := paneOptions(cfg.Tmux)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		cfg.Tmux = opts
+		tc, err := terminal.NewTerminalController(opts)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		s.base, s.stop = tc, tc.Stop
+	case "sandbox":
+		sb, err := sandbox.New(cfg.Sandbox)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating sandbox: %s\n", err.Error())
+			os.Exit(1)
+		}
+		s.base, s.stop = sb, func() { sb.Close() }
+	case "container":
+		c, err := container.New(cfg.Container)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error starting container: %s\n", err.Error())
+			os.Exit(1)
+		}
+		s.base, s.stop = c, func() { c.Close() }
+	case "ssh":
+		if cfg.SSH.Target == "" {
+			fmt.Fprintf(os.Stderr, "The ssh executor needs a host, from -host or [ssh] host\n")
+			os.Exit(1)
+		}
+		r, err := remote.Dial(cfg.SSH)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error connecting to %s: %s\n", cfg.SSH.Target, err.Error())
+			os.Exit(1)
+		}
+		s.base, s.stop = r, func() { r.Close() }
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown executor %q, expected tmux, sandbox, container or ssh\n", cfg.Executor)
+		os.Exit(1)
+	}
+	s.executor = s.base
+
+	if *record != "" {
+		recorder := cassette.NewRecorder(*record, cfg.AI.Model)
+		s.recorder = recorder
+		s.executor = recorder.Executor(s.executor)
+		s.options = []option.RequestOption{option.WithHTTPClient(&http.Client{Transport: recorder.Transport(nil)})}
+		stop := s.stop
+		s.stop = func() {
+			stop()
+			if err := recorder.Save(); err != nil {
+				fmt.Fprintf(os.Stderr, "Error saving cassette: %s\n", err.Error())
+			}
+		}
+	}
+	if *snapshots {
+		if cfg.Executor != "tmux" {
+			// Changes in a sandbox never reach the host files being checkpointed
+			fmt.Fprintf(os.Stderr, "-snapshot only works with the tmux executor\n")
+			os.Exit(1)
+		}
+		store, err := snapshot.NewStore()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error creating checkpoint store: %s\n", err.Error())
+			os.Exit(1)
+		}
+		s.store = store
+		s.executor = store.Executor(s.executor, s.cwd)
+		stop := s.stop
+		s.stop = func() {
+			stop()
+			store.Close()
+		}
+	}
+	return s, cfg
+}
+
+// paneOptions applies the pane flags to the [tmux] section, picking the pane
+// when asked
+func paneOptions(opts terminal.PaneOptions) (terminal.PaneOptions, error) {
+	if *paneFlag != "" {
+		opts.Pane = *paneFlag
+	}
+	switch *split {
+	case "":
+	case "h", "v":
+		opts.Vertical = *split == "v"
+	default:
+		return opts, fmt.Errorf("-split must be h or v, not %q", *split)
+	}
+	if *paneSize != 0 {
+		opts.Size = *paneSize
+	}
+	if opts.Size < 0 || opts.Size >= 100 {
+		return opts, fmt.Errorf("the pane size is a percent between 1 and 99, not %d", opts.Size)
+	}
+	opts.Window = opts.Window || *newWindow
+	opts.Keep = opts.Keep || *keepPane
+	opts.Integration = opts.Integration || *integration
+	if opts.Pane == "pick" {
+		pane, err := terminal.PickPane(os.Stdin, os.Stderr)
+		if err != nil {
+			return opts, err
+		}
+		opts.Pane = pane
+	}
+	return opts, nil
+}
+
+// canConnect tells whether the session can switch to a host over SSH
+func (s *session) canConnect() error {
+	switch {
+	case s.player != nil:
+		return fmt.Errorf("cannot connect while replaying")
+	case s.store != nil:
+		return fmt.Errorf("cannot connect with -snapshot, which checkpoints local files")
+	}
+	return nil
+}
+
+// connect switches the session to a host dialed over SSH. The previous
+// executor is kept open until the session is closed.
+func (s *session) connect(r *remote.Remote) {
+	s.base, s.executor = r, r
+	if s.recorder != nil {
+		s.executor = s.recorder.Executor(r)
+	}
+	stop := s.stop
+	s.stop = func() {
+		stop()
+		r.Close()
+	}
+}
+
+// input records a request typed by the user when recording
+func (s *session) input(text string) {
+	if s.recorder != nil {
+		s.recorder.Input(text)
+	}
+}
+
+// workdir is implemented by executors that know where commands run
+type workdir interface {
+	Cwd() (string, error)
+}
+
+// cwd returns the working directory commands run in
+func (s *session) cwd() (string, error) {
+	w, ok := s.base.(workdir)
+	if !ok {
+		return "", fmt.Errorf("the working directory is unknown when replaying")
+	}
+	return w.Cwd()
+}
+
+// attachments returns where the @references of a prompt are read from. Paths
+// are local, so they start at the working directory of commands only when it
+// is on this machine.
+func (s *session) attachments() terminal.AttachmentSources {
+	src := terminal.AttachmentSources{Clipboard: terminal.ReadClipboard}
+	if _, ok := s.base.(*remote.Remote); !ok {
+		if dir, err := s.cwd(); err == nil {
+			if info, err := os.Stat(dir); err == nil && info.IsDir() {
+				src.Dir = dir
+			}
+		}
+	}
+	if src.Dir == "" {
+		src.Dir, _ = os.Getwd()
+	}
+	if tc, ok := s.base.(*terminal.TerminalController); ok {
+		src.Pane = tc.Screen
+	}
+	return src
+}
+
+// close releases the executor and saves the recording, if any. It is safe to
+// call more than once.
+func (s *session) close() {
+	s.stop()
+	s.stop = func() {}
+}
@@ -0,0 +1,373 @@
+package snapshot
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// operators separating commands, after which a program name is expected
+var operators = map[string]bool{";": true, "&&": true, "||": true, "|": true, "&": true}
+
+// assignmentRe matches the variables set before a program
+var assignmentRe = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*=`)
+
+// wrappers run the program named after their options, with the letters of
+// their options that take a value
+var wrappers = map[string]string{
+	"sudo": "CDghpRrTtUu", "doas": "Cu", "env": "CSu", "nice": "n",
+	"nohup": "", "time": "", "command": "", "exec": "a",
+}
+
+// predictPaths returns the paths a command may change: the targets of its
+// redirections and those of the programs known to change files, with glob
+// patterns expanded. Relative paths are resolved against dir. Neither dir,
+// the store nor their ancestors are returned, nor paths in the store, as a
+// checkpoint copies and restores its paths whole.
+func predictPaths(dir, store, command string) []string {
+	seen := map[string]bool{}
+	var paths []string
+	add := func(p string) {
+		if p == "" || p == "/dev/null" {
+			return
+		}
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(dir, p)
+		}
+		p = filepath.Clean(p)
+		if seen[p] || covers(p, dir) || covers(p, store) || covers(store, p) {
+			return
+		}
+		seen[p] = true
+		paths = append(paths, p)
+	}
+	addArg := func(word string) {
+		if strings.ContainsAny(word, "*?[") {
+			matches, _ := filepath.Glob(filepath.Join(dir, word))
+			if filepath.IsAbs(word) {
+				matches, _ = filepath.Glob(word)
+			}
+			for _, m := range matches {
+				add(m)
+			}
+			return
+		}
+		// Only paths in existing directories can be created by the command
+		p := word
+		if !filepath.IsAbs(p) {
+			p = filepath.Join(dir, p)
+		}
+		if _, err := os.Stat(filepath.Dir(p)); err == nil {
+			add(word)
+		}
+	}
+
+	var words []string
+	for _, word := range append(splitWords(command), ";") {
+		if !operators[word] {
+			words = append(words, word)
+			continue
+		}
+		program, args := programArgs(redirects(words, add))
+		for _, arg := range targets(program, args) {
+			addArg(arg)
+		}
+		words = words[:0]
+	}
+	return paths
+}
+
+// covers reports whether dir is p or one of its ancestors
+func covers(dir, p string) bool {
+	return dir == p || strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// redirects passes the targets of the output redirections of a simple
+// command to add, and returns its other words
+func redirects(words []string, add func(string)) []string {
+	var rest []string
+	for i := 0; i < len(words); i++ {
+		op := strings.TrimLeft(words[i], "0123456789&")
+		switch {
+		case op == ">" || op == ">>" || op == ">|":
+			if i+1 < len(words) {
+				i++
+				add(words[i])
+			}
+		case op == "<":
+			i++
+		case strings.HasPrefix(op, ">"):
+			// >&2 duplicates a descriptor, it names no file
+			if target := strings.TrimLeft(op, ">|"); !strings.HasPrefix(target, "&") {
+				add(target)
+			}
+		case strings.HasPrefix(op, "<"):
+		default:
+			rest = append(rest, words[i])
+		}
+	}
+	return rest
+}
+
+// programArgs skips the variables set for a simple command and the wrappers
+// running it, such as sudo, and returns its program and arguments
+func programArgs(words []string) (string, []string) {
+	for len(words) > 0 {
+		word := words[0]
+		words = words[1:]
+		if assignmentRe.MatchString(word) {
+			continue
+		}
+		valued, ok := wrappers[filepath.Base(word)]
+		if !ok {
+			return filepath.Base(word), words
+		}
+		for len(words) > 0 && strings.HasPrefix(words[0], "-") {
+			option := words[0]
+			words = words[1:]
+			if option == "--" {
+				break
+			}
+			if len(option) == 2 && strings.ContainsRune(valued, rune(option[1])) && len(words) > 0 {
+				words = words[1:]
+			}
+		}
+	}
+	return "", nil
+}
+
+// targets returns the arguments naming the files a program changes, none for
+// programs not known to change files
+func targets(program string, args []string) []string {
+	var options, operands []string
+	for i, arg := range args {
+		if arg == "--" {
+			operands = append(operands, args[i+1:]...)
+			break
+		}
+		if strings.HasPrefix(arg, "-") && arg != "-" {
+			options = append(options, arg)
+		} else {
+			operands = append(operands, arg)
+		}
+	}
+	switch program {
+	case "rm", "rmdir", "mkdir", "touch", "truncate", "shred", "unlink", "tee", "mv":
+		return operands
+	case "cp", "ln", "install", "rsync":
+		if len(operands) > 1 {
+			return operands[len(operands)-1:]
+		}
+	case "chmod", "chown", "chgrp":
+		if len(operands) > 1 {
+			return operands[1:]
+		}
+	case "sed":
+		// Only sed -i changes files, the first operand is its script
+		for _, option := range options {
+			if (strings.HasPrefix(option, "-i") || strings.HasPrefix(option, "--in-place")) && len(operands) > 1 {
+				return operands[1:]
+			}
+		}
+	case "dd":
+		for _, operand := range operands {
+			if path, ok := strings.CutPrefix(operand, "of="); ok {
+				return []string{path}
+			}
+		}
+	}
+	return nil
+}
+
+// splitWords splits a command into shell words, honouring quotes and
+// backslashes and separating the operators in operators
+func splitWords(command string) []string {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	flush := func() {
+		if inWord {
+			words = append(words, word.String())
+			word.Reset()
+			inWord = false
+		}
+	}
+	for i := 0; i < len(command); i++ {
+		c := command[i]
+		switch {
+		case c == '\\' && i+1 < len(command):
+			i++
+			word.WriteByte(command[i])
+			inWord = true
+		case c == '\'' || c == '"':
+			end := strings.IndexByte(command[i+1:], c)
+			if end < 0 {
+				end = len(command) - i - 1
+			}
+			word.WriteString(command[i+1 : i+1+end])
+			i += end + 1
+			inWord = true
+		case c == ' ' || c == '\t' || c == '\n':
+			flush()
+		case c == ';' || c == '|' || c == '&':
+			flush()
+			op := string(c)
+			if i+1 < len(command) && command[i+1] == c && c != ';' {
+				op += string(c)
+				i++
+			}
+			words = append(words, op)
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	flush()
+	return words
+}
+
+func (cp *Checkpoint) takeFiles(maxCopy int64) error {
+	if err := os.MkdirAll(cp.backup, 0o700); err != nil {
+		return err
+	}
+	budget := maxCopy
+	for i, path := range predictPaths(cp.Dir, filepath.Dir(cp.backup), cp.Command) {
+		info, err := os.Lstat(path)
+		if os.IsNotExist(err) {
+			cp.Files = append(cp.Files, File{Path: path})
+			continue
+		}
+		// Paths that cannot be read, or are too large, do not stop the command
+		if err != nil {
+			cp.Skipped = append(cp.Skipped, path)
+			continue
+		}
+		size := treeSize(path, info)
+		if size > budget {
+			cp.Skipped = append(cp.Skipped, path)
+			continue
+		}
+		backup := filepath.Join(cp.backup, fmt.Sprint(i))
+		if err := copyTree(path, backup); err != nil {
+			os.RemoveAll(backup)
+			cp.Skipped = append(cp.Skipped, path)
+			continue
+		}
+		budget -= size
+		cp.Files = append(cp.Files, File{Path: path, Existed: true, backup: backup})
+	}
+	return nil
+}
+
+// restoreFiles puts back the copied paths and removes the ones that did not
+// exist. A directory ends up as it was, without the files the command added
+// to it.
+func (cp *Checkpoint) restoreFiles() ([]Change, error) {
+	var changes []Change
+	for _, f := range cp.Files {
+		if !f.Existed {
+			if _, err := os.Lstat(f.Path); err != nil {
+				continue
+			}
+			if err := os.RemoveAll(f.Path); err != nil {
+				return changes, err
+			}
+			changes = append(changes, Change{Path: f.Path, Action: "removed"})
+			continue
+		}
+		if err := restorePath(f.backup, f.Path); err != nil {
+			return changes, err
+		}
+		changes = append(changes, Change{Path: f.Path, Action: "restored"})
+	}
+	return changes, nil
+}
+
+// restorePath replaces path with a copy of backup. The copy is made next to
+// path and renamed over it, so that a failed copy leaves path alone.
+func restorePath(backup, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.MkdirTemp(filepath.Dir(path), ".aiterm-undo-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+	restored := filepath.Join(tmp, filepath.Base(path))
+	if err := copyTree(backup, restored); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	return os.Rename(restored, path)
+}
+
+// treeSize returns the size of the regular files under path
+func treeSize(path string, info fs.FileInfo) int64 {
+	if !info.IsDir() {
+		return info.Size()
+	}
+	var size int64
+	filepath.WalkDir(path, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && d.Type().IsRegular() {
+			if info, err := d.Info(); err == nil {
+				size += info.Size()
+			}
+		}
+		return nil
+	})
+	return size
+}
+
+// copyTree copies a file, symlink or directory with its modes
+func copyTree(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(src, path)
+		target := filepath.Join(dst, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return os.MkdirAll(target, info.Mode().Perm()|0o700)
+		}
+		switch {
+		case d.Type()&fs.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(link, target)
+		case d.Type().IsRegular():
+			return copyFile(path, target, info.Mode().Perm())
+		}
+		// Sockets, devices and the like are left out
+		return nil
+	})
+}
+
+func copyFile(src, dst string, perm fs.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,149 @@
+package snapshot
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// git runs a git command in dir with extra environment variables and returns
+// its trimmed output
+func git(dir string, env []string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+	cmd.Env = append(os.Environ(), env...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// gitRoot returns the top of the work tree containing dir
+func gitRoot(dir string) (string, bool) {
+	root, err := git(dir, nil, "rev-parse", "--show-toplevel")
+	return root, err == nil && root != ""
+}
+
+// tempIndex returns the environment for git commands using a private index,
+// seeded with the repository's so that unchanged files are not hashed again,
+// and a function removing it
+func tempIndex(root string) ([]string, func(), error) {
+	f, err := os.CreateTemp("", "aiterm-index-")
+	if err != nil {
+		return nil, nil, err
+	}
+	path := f.Name()
+	cleanup := func() { os.Remove(path) }
+	if index, err := git(root, nil, "rev-parse", "--git-path", "index"); err == nil {
+		if !filepath.IsAbs(index) {
+			index = filepath.Join(root, index)
+		}
+		if data, err := os.ReadFile(index); err == nil {
+			f.Write(data)
+		}
+	}
+	f.Close()
+	if info, _ := os.Stat(path); info.Size() == 0 {
+		// git refuses an empty file as an index
+		os.Remove(path)
+	}
+	return []string{"GIT_INDEX_FILE=" + path}, cleanup, nil
+}
+
+// writeTree returns the tree of the current work tree, untracked files
+// included
+func writeTree(root string) (string, error) {
+	env, cleanup, err := tempIndex(root)
+	if err != nil {
+		return "", err
+	}
+	defer cleanup()
+	if _, err := git(root, env, "add", "-A", "--", "."); err != nil {
+		return "", err
+	}
+	return git(root, env, "write-tree")
+}
+
+func (cp *Checkpoint) takeGit() error {
+	tree, err := writeTree(cp.Root)
+	if err != nil {
+		return err
+	}
+	env := []string{
+		"GIT_AUTHOR_NAME=aiterm", "GIT_AUTHOR_EMAIL=aiterm@localhost",
+		"GIT_COMMITTER_NAME=aiterm", "GIT_COMMITTER_EMAIL=aiterm@localhost",
+	}
+	commit, err := git(cp.Root, env, "commit-tree", tree, "-m", "aiterm checkpoint before: "+cp.Command)
+	if err != nil {
+		return err
+	}
+	// The ref keeps the commit from being garbage collected
+	if _, err := git(cp.Root, nil, "update-ref", cp.ref, commit); err != nil {
+		return err
+	}
+	cp.Commit = commit
+	return nil
+}
+
+// restoreGit puts back the files that differ from the checkpoint and removes
+// the ones created since. The index and HEAD are left alone.
+func (cp *Checkpoint) restoreGit() ([]Change, error) {
+	now, err := writeTree(cp.Root)
+	if err != nil {
+		return nil, err
+	}
+	out, err := git(cp.Root, nil, "diff-tree", "-r", "-z", "--no-renames", "--name-status", cp.Commit+"^{tree}", now)
+	if err != nil {
+		return nil, err
+	}
+	var restore []string
+	var changes []Change
+	fields := strings.Split(strings.TrimSuffix(out, "\x00"), "\x00")
+	for i := 0; i+1 < len(fields); i += 2 {
+		status, path := fields[i], fields[i+1]
+		if status == "A" {
+			if err := removeFile(cp.Root, path); err != nil {
+				return changes, err
+			}
+			changes = append(changes, Change{Path: path, Action: "removed"})
+			continue
+		}
+		restore = append(restore, path)
+		changes = append(changes, Change{Path: path, Action: "restored"})
+	}
+	if len(restore) == 0 {
+		return changes, nil
+	}
+
+	env, cleanup, err := tempIndex(cp.Root)
+	if err != nil {
+		return changes, err
+	}
+	defer cleanup()
+	if _, err := git(cp.Root, env, "read-tree", cp.Commit); err != nil {
+		return changes, err
+	}
+	if _, err := git(cp.Root, env, append([]string{"checkout-index", "-f", "--"}, restore...)...); err != nil {
+		return changes, err
+	}
+	return changes, nil
+}
+
+// removeFile removes a file created since the checkpoint, and the directories
+// that it leaves empty
+func removeFile(root, path string) error {
+	if err := os.Remove(filepath.Join(root, path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for dir := filepath.Dir(path); dir != "."; dir = filepath.Dir(dir) {
+		if os.Remove(filepath.Join(root, dir)) != nil {
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,182 @@
+// Package snapshot takes checkpoints of the working directory before commands
+// run so that their changes to files can be undone.
+package snapshot
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/aki-colt/aiterm/ai"
+)
+
+// ErrNothingToUndo is returned by Undo when there is no checkpoint left
+var ErrNothingToUndo = errors.New("no checkpoint to restore")
+
+// Kind is how a checkpoint was taken
+type Kind string
+
+const (
+	// KindGit checkpoints are commits of the whole work tree of a repository,
+	// untracked files included and ignored files excluded
+	KindGit Kind = "git"
+	// KindFiles checkpoints are copies of the files the command names
+	KindFiles Kind = "files"
+)
+
+// Checkpoint is the state of the files before a command
+type Checkpoint struct {
+	Command string
+	Dir     string // directory the command ran in
+	Kind    Kind
+	Root    string // root of the repository, for git checkpoints
+	Commit  string // snapshot commit, for git checkpoints
+	ref     string
+	Files   []File   // for file checkpoints
+	Skipped []string // paths too large or unreadable to copy
+	backup  string
+}
+
+// File is a path covered by a file checkpoint
+type File struct {
+	Path    string // absolute
+	Existed bool
+	backup  string
+}
+
+// Change is a file restored by Undo
+type Change struct {
+	Path   string
+	Action string // "restored" or "removed"
+}
+
+func (c Change) String() string {
+	return c.Action + " " + c.Path
+}
+
+// Store keeps the checkpoints of a session, most recent last
+type Store struct {
+	dir         string // backups of file checkpoints
+	id          string
+	mutex       sync.Mutex
+	checkpoints []*Checkpoint
+	// MaxCopy is the number of bytes a file checkpoint copies at most
+	MaxCopy int64
+}
+
+// NewStore creates a store keeping its backups in a new temporary directory
+func NewStore() (*Store, error) {
+	dir, err := os.MkdirTemp("", "aiterm-checkpoints-")
+	if err != nil {
+		return nil, err
+	}
+	return &Store{dir: dir, id: filepath.Base(dir), MaxCopy: 256 << 20}, nil
+}
+
+// Len returns the number of checkpoints that can be undone
+func (s *Store) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.checkpoints)
+}
+
+// Take records a checkpoint before command runs in dir. Inside a git
+// repository the whole work tree is saved, elsewhere only the paths the
+// command writes to, as far as they can be told from the command.
+func (s *Store) Take(dir, command string) (*Checkpoint, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n := len(s.checkpoints)
+	cp := &Checkpoint{Command: command, Dir: dir}
+	if root, ok := gitRoot(dir); ok {
+		cp.Kind = KindGit
+		cp.Root = root
+		cp.ref = fmt.Sprintf("refs/aiterm/%s/%d", s.id, n)
+		if err := cp.takeGit(); err != nil {
+			return nil, fmt.Errorf("failed to checkpoint %s: %w", root, err)
+		}
+	} else {
+		cp.Kind = KindFiles
+		cp.backup = filepath.Join(s.dir, fmt.Sprint(n))
+		if err := cp.takeFiles(s.MaxCopy); err != nil {
+			return nil, fmt.Errorf("failed to checkpoint: %w", err)
+		}
+	}
+	s.checkpoints = append(s.checkpoints, cp)
+	return cp, nil
+}
+
+// Undo restores the last checkpoint and forgets it. It returns the checkpoint
+// and the files it changed back.
+func (s *Store) Undo() (*Checkpoint, []Change, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if len(s.checkpoints) == 0 {
+		return nil, nil, ErrNothingToUndo
+	}
+	cp := s.checkpoints[len(s.checkpoints)-1]
+	var changes []Change
+	var err error
+	if cp.Kind == KindGit {
+		changes, err = cp.restoreGit()
+	} else {
+		changes, err = cp.restoreFiles()
+	}
+	if err != nil {
+		return cp, changes, err
+	}
+	s.checkpoints = s.checkpoints[:len(s.checkpoints)-1]
+	cp.discard()
+	return cp, changes, nil
+}
+
+// Close discards all checkpoints
+func (s *Store) Close() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for _, cp := range s.checkpoints {
+		cp.discard()
+	}
+	s.checkpoints = nil
+	return os.RemoveAll(s.dir)
+}
+
+func (cp *Checkpoint) discard() {
+	if cp.Kind == KindGit {
+		git(cp.Root, nil, "update-ref", "-d", cp.ref)
+	} else {
+		os.RemoveAll(cp.backup)
+	}
+}
+
+// Executor wraps an executor so that a checkpoint is taken before each
+// command, in the directory returned by cwd. A command is not run when its
+// checkpoint fails.
+func (s *Store) Executor(e ai.Executor, cwd func() (string, error)) ai.Executor {
+	return &snapshotExecutor{store: s, executor: e, cwd: cwd}
+}
+
+type snapshotExecutor struct {
+	store    *Store
+	executor ai.Executor
+	cwd      func() (string, error)
+}
+
+func (e *snapshotExecutor) Execute(command string) (ai.CommandResult, error) {
+	return e.ExecuteIn("", command)
+}
+
+// ExecuteIn checkpoints the directory of the main pane, which is the project
+// directory, whichever pane the command runs in
+func (e *snapshotExecutor) ExecuteIn(pane, command string) (ai.CommandResult, error) {
+	dir, err := e.cwd()
+	if err != nil {
+		return ai.CommandResult{ExitCode: -1}, fmt.Errorf("failed to checkpoint: %w", err)
+	}
+	if _, err := e.store.Take(dir, command); err != nil {
+		return ai.CommandResult{ExitCode: -1}, err
+	}
+	return ai.ExecuteIn(e.executor, pane, command)
+}
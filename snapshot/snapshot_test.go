@@ -0,0 +1,242 @@
+package snapshot_test
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/aki-colt/aiterm/ai"
+	"github.com/aki-colt/aiterm/snapshot"
+)
+
+func write(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func read(t *testing.T, path string) string {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func run(t *testing.T, dir string, args ...string) {
+	t.Helper()
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v: %v\n%s", args, err, out)
+	}
+}
+
+func newStore(t *testing.T) *snapshot.Store {
+	t.Helper()
+	s, err := snapshot.NewStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func changes(cs []snapshot.Change) []string {
+	var res []string
+	for _, c := range cs {
+		res = append(res, c.String())
+	}
+	sort.Strings(res)
+	return res
+}
+
+func TestGitCheckpoint(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not installed")
+	}
+	dir := t.TempDir()
+	run(t, dir, "git", "init", "-q")
+	write(t, filepath.Join(dir, "tracked.txt"), "v1")
+	write(t, filepath.Join(dir, "gone.txt"), "keep me")
+	run(t, dir, "git", "add", ".")
+	run(t, dir, "git", "-c", "user.name=t", "-c", "user.email=t@t", "commit", "-qm", "init")
+	write(t, filepath.Join(dir, "untracked.txt"), "draft")
+
+	s := newStore(t)
+	cp, err := s.Take(filepath.Join(dir), "sh script")
+	if err != nil {
+		t.Fatalf("Take: %v", err)
+	}
+	if cp.Kind != snapshot.KindGit {
+		t.Fatalf("Kind = %s", cp.Kind)
+	}
+
+	// What the command does
+	write(t, filepath.Join(dir, "tracked.txt"), "v2")
+	write(t, filepath.Join(dir, "untracked.txt"), "overwritten")
+	os.Remove(filepath.Join(dir, "gone.txt"))
+	write(t, filepath.Join(dir, "new", "file.txt"), "new")
+
+	_, got, err := s.Undo()
+	if err != nil {
+		t.Fatalf("Undo: %v", err)
+	}
+	want := []string{"removed new/file.txt", "restored gone.txt", "restored tracked.txt", "restored untracked.txt"}
+	if !reflect.DeepEqual(changes(got), want) {
+		t.Errorf("changes = %v, want %v", changes(got), want)
+	}
+	for name, content := range map[string]string{"tracked.txt": "v1", "untracked.txt": "draft", "gone.txt": "keep me"} {
+		if got := read(t, filepath.Join(dir, name)); got != content {
+			t.Errorf("%s = %q, want %q", name, got, content)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "new")); !os.IsNotExist(err) {
+		t.Errorf("new/ still exists: %v", err)
+	}
+
+	// The index was not touched: untracked.txt is still untracked
+	out, _ := exec.Command("git", "-C", dir, "status", "--porcelain").Output()
+	if string(out) != "?? untracked.txt\n" {
+		t.Errorf("git status = %q", out)
+	}
+	if _, _, err := s.Undo(); !errors.Is(err, snapshot.ErrNothingToUndo) {
+		t.Errorf("second Undo = %v", err)
+	}
+}
+
+func TestFilesCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	write(t, filepath.Join(dir, "a.log"), "a")
+	write(t, filepath.Join(dir, "b.log"), "b")
+	write(t, filepath.Join(dir, "data", "x.txt"), "x")
+
+	s := newStore(t)
+	exec := &fakeExecutor{run: func(string) {
+		os.Remove(filepath.Join(dir, "a.log"))
+		os.Remove(filepath.Join(dir, "b.log"))
+		os.RemoveAll(filepath.Join(dir, "data"))
+		write(t, filepath.Join(dir, "out.txt"), "out")
+	}}
+	e := s.Executor(exec, func() (string, error) { return dir, nil })
+	if _, err := e.Execute(`rm -rf *.log "data" && echo done > out.txt`); err != nil {
+		t.Fatalf("Execute: %v", err)
+	}
+	if s.Len() != 1 {
+		t.Fatalf("Len = %d", s.Len())
+	}
+
+	cp, got, err := s.Undo()
+	if err != nil {
+		t.Fatalf("Undo: %v", err)
+	}
+	if cp.Kind != snapshot.KindFiles {
+		t.Errorf("Kind = %s", cp.Kind)
+	}
+	want := []string{
+		"removed " + filepath.Join(dir, "out.txt"),
+		"restored " + filepath.Join(dir, "a.log"),
+		"restored " + filepath.Join(dir, "b.log"),
+		"restored " + filepath.Join(dir, "data"),
+	}
+	if !reflect.DeepEqual(changes(got), want) {
+		t.Errorf("changes = %v, want %v", changes(got), want)
+	}
+	if read(t, filepath.Join(dir, "data", "x.txt")) != "x" || read(t, filepath.Join(dir, "a.log")) != "a" {
+		t.Error("files were not restored")
+	}
+}
+
+func TestFilesCheckpointPaths(t *testing.T) {
+	dir := t.TempDir()
+	write(t, filepath.Join(dir, "f"), "f")
+	write(t, filepath.Join(dir, "data", "x.txt"), "x")
+	s := newStore(t)
+
+	tests := []struct {
+		command string
+		want    []string
+	}{
+		{"ls .", nil},
+		{"cd /tmp", nil},
+		{"ls /etc", nil},
+		{"touch . ..", nil},
+		{"rm -rf " + os.TempDir(), nil},
+		{"sudo rm f", []string{"f"}},
+		{"sudo -u root env A=1 rm -- f", []string{"f"}},
+		{"cat f > out.txt 2>&1", []string{"out.txt"}},
+		{"cp f data && sed -i s/a/b/ f", []string{"data", "f"}},
+	}
+	for _, tt := range tests {
+		cp, err := s.Take(dir, tt.command)
+		if err != nil {
+			t.Fatalf("Take(%q): %v", tt.command, err)
+		}
+		var got []string
+		for _, f := range cp.Files {
+			rel, _ := filepath.Rel(dir, f.Path)
+			got = append(got, rel)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Take(%q) covers %q, want %q", tt.command, got, tt.want)
+		}
+	}
+}
+
+func TestFilesUndoRestoresDirectories(t *testing.T) {
+	dir := t.TempDir()
+	write(t, filepath.Join(dir, "data", "x.txt"), "x")
+	s := newStore(t)
+	if _, err := s.Take(dir, "chmod -R u+w data"); err != nil {
+		t.Fatal(err)
+	}
+	write(t, filepath.Join(dir, "data", "x.txt"), "changed")
+	write(t, filepath.Join(dir, "data", "new.txt"), "new")
+	if _, _, err := s.Undo(); err != nil {
+		t.Fatalf("Undo: %v", err)
+	}
+	if got := read(t, filepath.Join(dir, "data", "x.txt")); got != "x" {
+		t.Errorf("x.txt = %q", got)
+	}
+	// The file the command created in the directory is gone
+	if _, err := os.Stat(filepath.Join(dir, "data", "new.txt")); !os.IsNotExist(err) {
+		t.Errorf("new.txt still exists: %v", err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 {
+		t.Errorf("entries = %v", entries)
+	}
+}
+
+func TestCheckpointFailureSkipsCommand(t *testing.T) {
+	s := newStore(t)
+	exec := &fakeExecutor{}
+	e := s.Executor(exec, func() (string, error) { return "", errors.New("no pane") })
+	if _, err := e.Execute("rm -rf x"); err == nil {
+		t.Fatal("Execute succeeded without a checkpoint")
+	}
+	if exec.calls != 0 {
+		t.Error("the command ran")
+	}
+}
+
+type fakeExecutor struct {
+	run   func(command string)
+	calls int
+}
+
+func (e *fakeExecutor) Execute(command string) (ai.CommandResult, error) {
+	e.calls++
+	if e.run != nil {
+		e.run(command)
+	}
+	return ai.CommandResult{ExitCode: 0}, nil
+}
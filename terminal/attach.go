@@ -0,0 +1,243 @@
+package terminal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	maxAttachment  = 64 << 10  // bytes attached from one file or source
+	maxAttachments = 256 << 10 // bytes attached to one prompt
+	maxListing     = 200       // entries listed for a directory
+)
+
+// refRe finds @references: an @ at the start of a word
+var refRe = regexp.MustCompile(`(^|\s)@(\S+)`)
+
+// AttachmentSources reads what @references point to
+type AttachmentSources struct {
+	Dir       string // where relative paths start
+	Clipboard func() (string, error)
+	// Pane returns the screen of a pane, the main one when name is empty;
+	// nil when commands do not run in panes
+	Pane func(name string) (string, error)
+}
+
+// Attachment is an @reference of a prompt
+type Attachment struct {
+	Ref       string // as typed, without the @
+	Size      int    // bytes attached
+	Truncated bool
+	Err       error // why nothing was attached
+}
+
+func (a Attachment) String() string {
+	switch {
+	case a.Err != nil:
+		return fmt.Sprintf("@%s (not attached: %s)", a.Ref, a.Err.Error())
+	case a.Truncated:
+		return fmt.Sprintf("@%s (%s, truncated)", a.Ref, formatSize(a.Size))
+	}
+	return fmt.Sprintf("@%s (%s)", a.Ref, formatSize(a.Size))
+}
+
+func formatSize(n int) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	return fmt.Sprintf("%.1f KB", float64(n)/1024)
+}
+
+// ReadAttachments reads the @references of input: files, directories,
+// @clipboard, and @pane or @pane:name for the screen of a pane. It returns
+// their content as a message for the model, empty when nothing was attached.
+func ReadAttachments(input string, src AttachmentSources) (string, []Attachment) {
+	var sb strings.Builder
+	var attachments []Attachment
+	seen := map[string]bool{}
+	budget := maxAttachments
+	for _, m := range refRe.FindAllStringSubmatch(input, -1) {
+		ref := m[2]
+		if seen[ref] {
+			continue
+		}
+		seen[ref] = true
+		if budget <= 0 {
+			attachments = append(attachments, Attachment{Ref: ref, Err: fmt.Errorf("over the %s limit of a prompt", formatSize(maxAttachments))})
+			continue
+		}
+		content, a := src.read(ref, min(budget, maxAttachment))
+		if a.Err == nil {
+			budget -= a.Size
+			fmt.Fprintf(&sb, "<attachment source=%q>\n%s\n</attachment>\n", "@"+a.Ref, strings.TrimRight(content, "\n"))
+		}
+		attachments = append(attachments, a)
+	}
+	if sb.Len() == 0 {
+		return "", attachments
+	}
+	return "I attached these for my next request:\n\n" + sb.String(), attachments
+}
+
+// read returns the content of a reference, at most limit bytes
+func (src AttachmentSources) read(ref string, limit int) (string, Attachment) {
+	var content string
+	var err error
+	switch {
+	case ref == "clipboard":
+		if src.Clipboard == nil {
+			err = fmt.Errorf("no clipboard")
+		} else {
+			content, err = src.Clipboard()
+		}
+	case ref == "pane" || strings.HasPrefix(ref, "pane:"):
+		if src.Pane == nil {
+			err = fmt.Errorf("commands do not run in a pane")
+		} else {
+			content, err = src.Pane(strings.TrimPrefix(strings.TrimPrefix(ref, "pane"), ":"))
+		}
+	default:
+		path := ref
+		if _, statErr := os.Stat(src.path(path)); statErr != nil {
+			// Allow punctuation after a reference, as in "look at @main.go."
+			path = strings.TrimRight(path, ".,;:!?)'\"")
+		}
+		ref = path
+		content, err = readPath(src.path(path), limit)
+	}
+	a := Attachment{Ref: ref, Err: err}
+	if err != nil {
+		return "", a
+	}
+	if len(content) > limit {
+		content, a.Truncated = content[:limit]+"\n[truncated]", true
+	}
+	a.Size = len(content)
+	return content, a
+}
+
+func (src AttachmentSources) path(ref string) string {
+	if rest, ok := strings.CutPrefix(ref, "~/"); ok {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, rest)
+		}
+	}
+	if filepath.IsAbs(ref) || src.Dir == "" {
+		return ref
+	}
+	return filepath.Join(src.Dir, ref)
+}
+
+// readPath reads a text file, or lists a directory with the content of its
+// text files, up to limit bytes
+func readPath(path string, limit int) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", fmt.Errorf("no such file")
+	}
+	if !info.IsDir() {
+		return readText(path, limit)
+	}
+
+	var files []string
+	err = filepath.WalkDir(path, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || p == path {
+			return nil
+		}
+		if strings.HasPrefix(d.Name(), ".") || d.Name() == "node_modules" {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if len(files) == maxListing {
+			return filepath.SkipAll
+		}
+		rel, _ := filepath.Rel(path, p)
+		if d.IsDir() {
+			rel += "/"
+		}
+		files = append(files, rel)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	sort.Strings(files)
+	var sb strings.Builder
+	sb.WriteString(strings.Join(files, "\n") + "\n")
+	if len(files) == maxListing {
+		sb.WriteString("[more files not listed]\n")
+	}
+	for _, f := range files {
+		if strings.HasSuffix(f, "/") || sb.Len() >= limit {
+			continue
+		}
+		text, err := readText(filepath.Join(path, f), limit-sb.Len())
+		if err != nil || sb.Len()+len(text) > limit {
+			continue
+		}
+		fmt.Fprintf(&sb, "\n--- %s\n%s\n", f, strings.TrimRight(text, "\n"))
+	}
+	return sb.String(), nil
+}
+
+// readText reads up to limit bytes of a file, and one more to tell that it
+// was longer. Binary files are refused.
+func readText(path string, limit int) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, int64(limit)+1))
+	if err != nil {
+		return "", err
+	}
+	if bytes.IndexByte(data[:min(len(data), 8000)], 0) >= 0 {
+		return "", fmt.Errorf("binary file")
+	}
+	return string(data), nil
+}
+
+// CompleteAttachment completes the @reference at the end of text with the
+// files of dir and the other sources
+func CompleteAttachment(text, dir string) []string {
+	i := strings.LastIndexAny(text, " \t\n") + 1
+	word := text[i:]
+	if !strings.HasPrefix(word, "@") {
+		return nil
+	}
+	prefix := word[1:]
+	var candidates []string
+	for _, name := range []string{"clipboard", "pane"} {
+		if strings.HasPrefix(name, prefix) && prefix != name {
+			candidates = append(candidates, name)
+		}
+	}
+
+	parent, base := filepath.Split(prefix)
+	src := AttachmentSources{Dir: dir}
+	entries, _ := os.ReadDir(src.path(parent + "."))
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasPrefix(name, base) || strings.HasPrefix(name, ".") && !strings.HasPrefix(base, ".") {
+			continue
+		}
+		if e.IsDir() {
+			name += "/"
+		}
+		candidates = append(candidates, parent+name)
+	}
+	for j, c := range candidates {
+		candidates[j] = text[:i] + "@" + c
+	}
+	return candidates
+}
@@ -0,0 +1,122 @@
+package terminal_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aki-colt/aiterm/terminal"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadAttachments(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "main.go"), "package main\n")
+	writeFile(t, filepath.Join(dir, "src", "a.txt"), "alpha\n")
+	writeFile(t, filepath.Join(dir, "src", ".git", "HEAD"), "ref\n")
+	writeFile(t, filepath.Join(dir, "bin"), "\x00\x01")
+	src := terminal.AttachmentSources{
+		Dir:       dir,
+		Clipboard: func() (string, error) { return "copied", nil },
+		Pane: func(name string) (string, error) {
+			if name != "" {
+				return "", errors.New("no pane named " + name)
+			}
+			return "$ ls", nil
+		},
+	}
+
+	text, attachments := terminal.ReadAttachments("explain @main.go, @src and @clipboard @pane @pane:build @bin @missing mail@example.com", src)
+	var got []string
+	for _, a := range attachments {
+		got = append(got, a.String())
+	}
+	want := []string{
+		"@main.go (13 B)",
+		"@src (",
+		"@clipboard (6 B)",
+		"@pane (4 B)",
+		"@pane:build (not attached: no pane named build)",
+		"@bin (not attached: binary file)",
+		"@missing (not attached: no such file)",
+	}
+	if len(got) != len(want) {
+		t.Fatalf("attachments = %q", got)
+	}
+	for i := range want {
+		if !strings.HasPrefix(got[i], want[i]) {
+			t.Errorf("attachment %d = %q, want %q", i, got[i], want[i])
+		}
+	}
+	for _, s := range []string{`<attachment source="@main.go">` + "\npackage main\n</attachment>", "--- a.txt\nalpha", "copied", "$ ls"} {
+		if !strings.Contains(text, s) {
+			t.Errorf("attached text lacks %q:\n%s", s, text)
+		}
+	}
+	if strings.Contains(text, "HEAD") {
+		t.Errorf("hidden directories attached:\n%s", text)
+	}
+}
+
+func TestReadAttachmentsLimits(t *testing.T) {
+	dir := t.TempDir()
+	big := strings.Repeat("x", 100<<10)
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		writeFile(t, filepath.Join(dir, name), big)
+	}
+	text, attachments := terminal.ReadAttachments("@a @b @c @d @e", terminal.AttachmentSources{Dir: dir})
+	for _, a := range attachments[:4] {
+		if a.Err != nil || !a.Truncated {
+			t.Errorf("%s, want truncated", a)
+		}
+	}
+	if attachments[4].Err == nil {
+		t.Errorf("%s, want over the limit", attachments[4])
+	}
+	if len(text) > 260<<10 {
+		t.Errorf("attached %d bytes", len(text))
+	}
+}
+
+func TestReadAttachmentsNone(t *testing.T) {
+	text, attachments := terminal.ReadAttachments("no references, mail@example.com", terminal.AttachmentSources{Dir: t.TempDir()})
+	if text != "" || len(attachments) != 0 {
+		t.Errorf("got %q, %v", text, attachments)
+	}
+}
+
+func TestCompleteAttachment(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "src", "main.go"), "")
+	writeFile(t, filepath.Join(dir, "src", "main_test.go"), "")
+	writeFile(t, filepath.Join(dir, "scripts"), "")
+	writeFile(t, filepath.Join(dir, ".env"), "")
+
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"look at @s", []string{"look at @scripts", "look at @src/"}},
+		{"@src/ma", []string{"@src/main.go", "@src/main_test.go"}},
+		{"@cl", []string{"@clipboard"}},
+		{"@.e", []string{"@.env"}},
+		{"no reference", nil},
+	}
+	for _, tt := range tests {
+		got := terminal.CompleteAttachment(tt.text, dir)
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("CompleteAttachment(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
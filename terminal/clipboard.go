@@ -0,0 +1,57 @@
+package terminal
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// CopyToClipboard puts text on the system clipboard with an OSC 52 escape
+// sequence. Inside tmux the text goes through `tmux load-buffer -w`, which
+// also forwards it to the outer terminal.
+func CopyToClipboard(text string) error {
+	if os.Getenv("TMUX") != "" {
+		cmd := exec.Command("tmux", "load-buffer", "-w", "-")
+		cmd.Stdin = strings.NewReader(text)
+		if err := cmd.Run(); err == nil {
+			return nil
+		}
+		// tmux before 3.2 has no -w, keep the text in its buffer at least
+		cmd = exec.Command("tmux", "load-buffer", "-")
+		cmd.Stdin = strings.NewReader(text)
+		return cmd.Run()
+	}
+	tty, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer tty.Close()
+	_, err = fmt.Fprintf(tty, "\x1b]52;c;%s\x07", base64.StdEncoding.EncodeToString([]byte(text)))
+	return err
+}
+
+// ReadClipboard returns the text of the system clipboard, read with the first
+// of wl-paste, xclip, xsel and pbpaste that works, or the tmux buffer
+func ReadClipboard() (string, error) {
+	for _, args := range [][]string{
+		{"wl-paste", "--no-newline"},
+		{"xclip", "-o", "-selection", "clipboard"},
+		{"xsel", "--clipboard", "--output"},
+		{"pbpaste"},
+	} {
+		if _, err := exec.LookPath(args[0]); err != nil {
+			continue
+		}
+		if out, err := exec.Command(args[0], args[1:]...).Output(); err == nil {
+			return string(out), nil
+		}
+	}
+	if os.Getenv("TMUX") != "" {
+		if out, err := exec.Command("tmux", "show-buffer").Output(); err == nil {
+			return string(out), nil
+		}
+	}
+	return "", fmt.Errorf("cannot read the clipboard, install wl-paste, xclip or xsel")
+}
@@ -1,54 +1,222 @@
 package terminal
 
 import (
+	"context"
 	"fmt"
 	"os"
 	"os/exec"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/aki-colt/aiterm/ai"
 )
 
-// TerminalController manages the tmux right pane
+// MainPane is the name of the pane opened or attached to at start
+const MainPane = "main"
+
+// maxPanes is the number of panes the model can have open, the main one
+// included
+const maxPanes = 6
+
+var paneNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,15}$`)
+
+// tmuxPane is a pane of the pool. Its mutex makes commands in the same pane
+// run one at a time, while other panes stay usable.
+type tmuxPane struct {
+	id    string
+	keep  bool // leave the pane open on Stop
+	shell int  // pid of the program the pane started with, its shell
+	idle  int  // the process group in the foreground when it waits for commands
+	mutex sync.Mutex
+	// timeline holds the commands of the pane when it has shell integration
+	timeline *timeline
+	// integrationErr tells why integrating the pane failed
+	integrationErr error
+}
+
+// TerminalController manages the tmux panes commands run in: the main one,
+// the right pane by default, and the panes the model opens by name
 type TerminalController struct {
 	session    string // tmux session name
-	pane       string // right pane ID
+	self       string // the pane aiterm runs in
 	outputChan chan string
-	mutex      sync.Mutex
-	running    bool
+	keepNew    bool // leave the panes opened later open on Stop
+	// integration marks the commands of the panes with OSC 133, from files
+	// in integrationDir
+	integration    bool
+	integrationDir string
+	// HandOff is called when a full-screen program is given to the user
+	HandOff func(pane, program string)
+	// AskPassword asks the user for the password a prompt in a pane wants.
+	// The password is typed into the pane and never reaches the model. It
+	// declines once ctx is done.
+	AskPassword func(ctx context.Context, pane, prompt string) (string, bool)
+
+	mutex   sync.Mutex // guards panes, names, running and asking
+	panes   map[string]*tmuxPane
+	names   []string // in the order the panes were opened
+	running bool
+	// asking is done when the questions open to the user are to be closed,
+	// on Interrupt and Stop
+	asking         context.Context
+	closeQuestions context.CancelFunc
 }
 
-func NewTerminalController() *TerminalController {
+// NewTerminalController opens or attaches to the pane chosen by opts
+func NewTerminalController(opts PaneOptions) (*TerminalController, error) {
 	tc := &TerminalController{
-		outputChan: make(chan string, 100),
-		running:    true,
+		outputChan:  make(chan string, 100),
+		self:        os.Getenv("TMUX_PANE"),
+		keepNew:     opts.Keep,
+		integration: opts.Integration,
+		panes:       map[string]*tmuxPane{},
+		running:     true,
 	}
+	tc.asking, tc.closeQuestions = context.WithCancel(context.Background())
 
 	// Get the current tmux session
 	session, err := getCurrentTmuxSession()
 	if err != nil {
-		fmt.Printf("error: %s", err.Error())
-		os.Exit(1)
+		return nil, err
 	}
 	tc.session = session
 
 	// Initialize tmux pane
-	tc.setupTmux()
+	if err := tc.setupTmux(opts); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
 
-	return tc
+func (tc *TerminalController) setupTmux(opts PaneOptions) error {
+	var main *tmuxPane
+	if opts.Pane != "" {
+		// Panes we did not open are never closed
+		id, err := paneID(opts.Pane)
+		if err != nil {
+			return err
+		}
+		// Commands would be typed into aiterm itself
+		if id == tc.self {
+			return fmt.Errorf("pane %s is the one aiterm runs in, choose another pane", opts.Pane)
+		}
+		if main, err = newTmuxPane(id, true, true); err != nil {
+			return err
+		}
+	} else {
+		cmd := exec.Command("tmux", opts.newPaneArgs()...)
+		output, err := cmd.Output()
+		if err != nil {
+			return fmt.Errorf("error opening tmux pane: %w", err)
+		}
+		id := strings.TrimSpace(string(output))
+		if main, err = newTmuxPane(id, opts.Keep, false); err != nil {
+			tc.tmuxCommand("kill-pane", "-t", id)
+			return err
+		}
+	}
+	tc.panes[MainPane] = main
+	tc.names = []string{MainPane}
+	if tc.integration {
+		// Without integration commands still run, only their exit codes
+		// are unknown; IntegrationError tells the user why
+		main.integrationErr = tc.integrate(main)
+	}
+	return nil
 }
 
-func (tc *TerminalController) setupTmux() {
-	// Split the current window into left and right panes
-	cmd := exec.Command("tmux", "split-window", "-h", "-d", "-P", "-F", "#{pane_id}")
+// Pane returns the ID of the main pane
+func (tc *TerminalController) Pane() string {
+	return tc.panes[MainPane].id
+}
+
+// pane returns the pane with the name, the main one when name is empty
+func (tc *TerminalController) pane(name string) (*tmuxPane, error) {
+	if name == "" {
+		name = MainPane
+	}
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	if !tc.running {
+		return nil, os.ErrClosed
+	}
+	p, ok := tc.panes[name]
+	if !ok {
+		return nil, fmt.Errorf("no pane named %s, the panes are %s", name, strings.Join(tc.names, ", "))
+	}
+	return p, nil
+}
+
+// OpenPane splits the main pane to open a pane with the name
+func (tc *TerminalController) OpenPane(name string) error {
+	if !paneNameRe.MatchString(name) {
+		return fmt.Errorf("invalid pane name %q, use up to 16 lowercase letters, digits, - and _", name)
+	}
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	if !tc.running {
+		return os.ErrClosed
+	}
+	if _, ok := tc.panes[name]; ok {
+		return fmt.Errorf("pane %s is already open", name)
+	}
+	if len(tc.panes) >= maxPanes {
+		return fmt.Errorf("too many panes, close one of %s first", strings.Join(tc.names, ", "))
+	}
+
+	cmd := exec.Command("tmux", "split-window", "-v", "-d", "-t", tc.panes[MainPane].id, "-P", "-F", "#{pane_id}")
 	output, err := cmd.Output()
 	if err != nil {
-		fmt.Println("Error splitting tmux window:", err)
-		os.Exit(1)
+		return fmt.Errorf("error opening tmux pane: %w", err)
 	}
+	id := strings.TrimSpace(string(output))
+	p, err := newTmuxPane(id, tc.keepNew, false)
+	if err != nil {
+		tc.tmuxCommand("kill-pane", "-t", id)
+		return err
+	}
+	// Show the name in the pane border, where tmux is set to display titles
+	tc.tmuxCommand("select-pane", "-t", id, "-T", name)
+	if tc.integration {
+		p.integrationErr = tc.integrate(p)
+	}
+	tc.panes[name] = p
+	tc.names = append(tc.names, name)
+	return nil
+}
 
-	// Get the right pane ID
-	tc.pane = strings.TrimSpace(string(output))
+// ClosePane closes a pane opened with OpenPane
+func (tc *TerminalController) ClosePane(name string) error {
+	if name == MainPane {
+		return fmt.Errorf("the main pane cannot be closed")
+	}
+	tc.mutex.Lock()
+	p, ok := tc.panes[name]
+	if ok {
+		delete(tc.panes, name)
+		for i, n := range tc.names {
+			if n == name {
+				tc.names = append(tc.names[:i], tc.names[i+1:]...)
+				break
+			}
+		}
+	}
+	tc.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("no pane named %s", name)
+	}
+	tc.unintegrate(p)
+	return tc.tmuxCommand("kill-pane", "-t", p.id)
+}
+
+// PaneNames returns the names of the open panes, the main one first
+func (tc *TerminalController) PaneNames() []string {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	return append([]string(nil), tc.names...)
 }
 
 // getCurrentTmuxSession gets the current tmux session name
@@ -77,23 +245,25 @@ func (tc *TerminalController) tmuxCommand(args ...string) error {
 	return cmd.Run()
 }
 
-// WriteCommand writes a command to the right pane
+// WriteCommand writes a command to the main pane
 func (tc *TerminalController) WriteCommand(command string) error {
-	tc.mutex.Lock()
-	defer tc.mutex.Unlock()
-	if !tc.running {
-		return os.ErrClosed
+	p, err := tc.pane(MainPane)
+	if err != nil {
+		return err
 	}
-	err := tc.tmuxCommand("send-keys", "-t", tc.pane, command, "Enter")
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	err = tc.tmuxCommand("send-keys", "-t", p.id, command, "Enter")
 	if err != nil {
 		fmt.Println("WriteCommand error:", err)
 	}
 	return err
 }
 
-// capturePane captures the output of the right pane
-func (tc *TerminalController) capturePane() (string, error) {
-	cmd := exec.Command("tmux", "capture-pane", "-t", tc.pane, "-p")
+// capturePane captures the screen of a pane with up to lines of its history,
+// wrapped lines joined
+func capturePane(id string, lines int) (string, error) {
+	cmd := exec.Command("tmux", "capture-pane", "-t", id, "-p", "-J", "-S", strconv.Itoa(-lines))
 	output, err := cmd.Output()
 	if err != nil {
 		return "", err
@@ -101,29 +271,133 @@ func (tc *TerminalController) capturePane() (string, error) {
 	return strings.TrimSpace(string(output)), nil
 }
 
-// ReadOutput reads output from the right pane
+// Scrollback returns the screen of the named pane, the main one when name is
+// empty, with up to lines of its history. Unlike the output of Execute, it
+// holds what the user typed and ran there themselves.
+func (tc *TerminalController) Scrollback(name string, lines int) (string, error) {
+	p, err := tc.pane(name)
+	if err != nil {
+		return "", err
+	}
+	return capturePane(p.id, lines)
+}
+
+// Screen returns the visible screen of the named pane, the main one when
+// name is empty
+func (tc *TerminalController) Screen(name string) (string, error) {
+	p, err := tc.pane(name)
+	if err != nil {
+		return "", err
+	}
+	return p.capture()
+}
+
+// ReadOutput reads output from the main pane
 func (tc *TerminalController) ReadOutput() <-chan string {
 	return tc.outputChan
 }
 
+// Interrupt declines the questions open to the user, such as a password
+// prompt, so that the command waiting for the answer is stopped and its pane
+// is free again. It is called when the user cancels a run.
+func (tc *TerminalController) Interrupt() {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	tc.closeQuestions()
+	if tc.running {
+		tc.asking, tc.closeQuestions = context.WithCancel(context.Background())
+	}
+}
+
+// questions returns the context the questions to the user are asked in
+func (tc *TerminalController) questions() context.Context {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	return tc.asking
+}
+
 // Stop cleans up tmux configuration
 func (tc *TerminalController) Stop() {
 	tc.mutex.Lock()
 	tc.running = false
+	tc.closeQuestions()
+	panes := tc.panes
 	tc.mutex.Unlock()
-	tc.tmuxCommand("kill-pane", "-t", tc.pane) // Close the right pane
+	for _, p := range panes {
+		tc.unintegrate(p)
+		if !p.keep {
+			tc.tmuxCommand("kill-pane", "-t", p.id)
+		}
+	}
+	if tc.integrationDir != "" {
+		os.RemoveAll(tc.integrationDir)
+	}
+}
+
+// Execute runs a command in the main pane and reports its output and the
+// pane's working directory. The exit code is only known for panes with shell
+// integration.
+func (tc *TerminalController) Execute(command string) (ai.CommandResult, error) {
+	return tc.ExecuteIn(MainPane, command)
 }
 
-// ExecuteAndGetResult clears the screen, executes a command, and immediately gets the result
+// ExecuteIn runs a command in the named pane. Commands in different panes
+// can run at the same time.
+func (tc *TerminalController) ExecuteIn(pane, command string) (ai.CommandResult, error) {
+	p, err := tc.pane(pane)
+	if err != nil {
+		return ai.CommandResult{}, err
+	}
+	start := time.Now()
+	output, err := tc.run(pane, p, command)
+	if err != nil {
+		return ai.CommandResult{}, err
+	}
+	cwd, _ := p.cwd()
+	return ai.CommandResult{Output: output, ExitCode: p.exitCode(command, start), Cwd: cwd}, nil
+}
+
+// Cwd returns the current working directory of the main pane
+func (tc *TerminalController) Cwd() (string, error) {
+	p, err := tc.pane(MainPane)
+	if err != nil {
+		return "", err
+	}
+	return p.cwd()
+}
+
+func (p *tmuxPane) cwd() (string, error) {
+	cmd := exec.Command("tmux", "display-message", "-p", "-t", p.id, "#{pane_current_path}")
+	output, err := cmd.Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// ExecuteAndGetResult clears the main pane, executes a command, and immediately gets the result
 func (tc *TerminalController) ExecuteAndGetResult(command string) (string, error) {
-	tc.mutex.Lock()
-	defer tc.mutex.Unlock()
-	if !tc.running {
-		return "", os.ErrClosed
+	p, err := tc.pane(MainPane)
+	if err != nil {
+		return "", err
+	}
+	return tc.run(MainPane, p, command)
+}
+
+// run clears the screen, executes a command, and gets the result once the
+// command finishes or is found to be still running
+func (tc *TerminalController) run(name string, p *tmuxPane, command string) (string, error) {
+	if name == "" {
+		name = MainPane
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if err := p.busy(name); err != nil {
+		return "", err
 	}
 
 	// Clear the screen
-	err := tc.tmuxCommand("send-keys", "-t", tc.pane, "clear", "Enter")
+	err := tc.tmuxCommand("send-keys", "-t", p.id, "clear", "Enter")
 	if err != nil {
 		return "", fmt.Errorf("failed to clear screen: %v", err)
 	}
@@ -132,21 +406,9 @@ func (tc *TerminalController) ExecuteAndGetResult(command string) (string, error
 	time.Sleep(100 * time.Millisecond)
 
 	// Execute the command
-	err = tc.tmuxCommand("send-keys", "-t", tc.pane, command, "Enter")
+	err = tc.tmuxCommand("send-keys", "-t", p.id, command, "Enter")
 	if err != nil {
 		return "", fmt.Errorf("failed to execute command: %v", err)
 	}
-
-	// Wait for the command to execute
-	time.Sleep(100 * time.Millisecond)
-
-	// Capture the output
-	cmd := exec.Command("tmux", "capture-pane", "-t", tc.pane, "-p")
-	output, err := cmd.Output()
-	if err != nil {
-		return "", fmt.Errorf("failed to capture output: %v", err)
-	}
-
-	// Return the cleaned output
-	return strings.TrimSpace(string(output)), nil
+	return tc.settle(name, p)
 }
@@ -1,16 +1,318 @@
 package terminal
 
 import (
+	"context"
+	"sync"
+
+	"github.com/aki-colt/aiterm/ai"
+	"github.com/gdamore/tcell/v2"
 	"github.com/rivo/tview"
 )
 
-func NewDialogComponents() (*tview.TextView, *tview.InputField) {
-	dialogView := tview.NewTextView().
-		SetText("AI Chat Terminal").
-		SetDynamicColors(true).
-		SetScrollable(true)
-	dialogInput := tview.NewInputField().
-		SetLabel("You: ")
+func NewDialogComponents(app *tview.Application, history *PromptHistory) (*TranscriptView, *PromptEditor) {
+	dialogView := NewTranscriptView()
+	dialogView.Transcript().AddInfo("AI Chat Terminal")
+	dialogInput := NewPromptEditor(app, history)
 
 	return dialogView, dialogInput
 }
+
+// TranscriptView shows a Transcript. When focused, j/k (or n/p) select the
+// next/previous message, Enter or Space collapses or expands a tool call, y
+// copies the selected message or command, Y the output of a tool call, g/G
+// jump to the top/bottom, and the focus-input keys give the focus back.
+type TranscriptView struct {
+	*tview.TextView
+	transcript *Transcript
+	keys       KeyMap
+	selected   int  // selected block, -1 when none is
+	follow     bool // keep the end of the conversation in view
+	done       func(key tcell.Key)
+}
+
+func NewTranscriptView() *TranscriptView {
+	v := &TranscriptView{
+		TextView: tview.NewTextView().
+			SetDynamicColors(true).
+			SetRegions(true).
+			SetScrollable(true),
+		transcript: NewTranscript(),
+		keys:       DefaultKeyMap(),
+		selected:   -1,
+		follow:     true,
+	}
+	return v
+}
+
+// SetKeyMap sets the key bindings of the view
+func (v *TranscriptView) SetKeyMap(keys KeyMap) *TranscriptView {
+	v.keys = keys
+	return v
+}
+
+// Transcript returns the transcript shown by the view
+func (v *TranscriptView) Transcript() *Transcript {
+	return v.transcript
+}
+
+// SetDoneFunc sets the function called when the user leaves the view
+func (v *TranscriptView) SetDoneFunc(done func(key tcell.Key)) *TranscriptView {
+	v.done = done
+	return v
+}
+
+// Refresh redraws the transcript; it must be called on the UI goroutine
+// after the transcript changed
+func (v *TranscriptView) Refresh() {
+	v.SetText(v.transcript.Render())
+	if v.selected >= len(v.transcript.Blocks()) {
+		v.selected = -1
+		v.follow = true
+		v.Highlight()
+	}
+	if v.follow {
+		v.ScrollToEnd()
+	}
+}
+
+// Select highlights the i-th block and scrolls to it, -1 follows the end
+func (v *TranscriptView) Select(i int) {
+	if i >= len(v.transcript.Blocks()) {
+		i = -1
+	}
+	v.selected = i
+	v.follow = i < 0
+	if i < 0 {
+		v.Highlight()
+		v.ScrollToEnd()
+		return
+	}
+	v.Highlight(RegionID(i))
+	v.ScrollToHighlight()
+}
+
+// ScrollPage scrolls by n pages, up when n is negative. The view stops
+// following the conversation until it is scrolled back to the end.
+func (v *TranscriptView) ScrollPage(n int) {
+	row, _ := v.GetScrollOffset()
+	_, _, _, height := v.GetInnerRect()
+	row = max(row+n*height, 0)
+	if row+height >= v.GetWrappedLineCount() {
+		v.follow = true
+		v.ScrollToEnd()
+		return
+	}
+	v.follow = false
+	v.ScrollTo(row, 0)
+}
+
+func (v *TranscriptView) InputHandler() func(event *tcell.EventKey, setFocus func(p tview.Primitive)) {
+	return v.WrapInputHandler(func(event *tcell.EventKey, setFocus func(p tview.Primitive)) {
+		n := len(v.transcript.Blocks())
+		if v.keys.Matches(ActionFocusInput, event) {
+			v.Select(-1)
+			if v.done != nil {
+				v.done(event.Key())
+			}
+			return
+		}
+		switch event.Key() {
+		case tcell.KeyEnter:
+			if v.transcript.Toggle(v.selected) {
+				v.Refresh()
+				v.Select(v.selected)
+			} else if v.done != nil {
+				v.Select(-1)
+				v.done(event.Key())
+			}
+			return
+		case tcell.KeyRune:
+			switch event.Rune() {
+			case 'k', 'p':
+				if v.selected < 0 {
+					v.Select(n - 1)
+				} else if v.selected > 0 {
+					v.Select(v.selected - 1)
+				}
+				return
+			case 'j', 'n':
+				if v.selected >= 0 {
+					v.Select(v.selected + 1)
+				}
+				return
+			case ' ':
+				if v.transcript.Toggle(v.selected) {
+					v.Refresh()
+					v.Select(v.selected)
+				}
+				return
+			case 'y':
+				if text := v.transcript.Yank(v.selected); text != "" {
+					CopyToClipboard(text)
+				}
+				return
+			case 'Y':
+				if v.selected >= 0 && v.transcript.Blocks()[v.selected].Role == RoleTool {
+					CopyToClipboard(v.transcript.Blocks()[v.selected].Output)
+				}
+				return
+			}
+		}
+		v.TextView.InputHandler()(event, setFocus)
+	})
+}
+
+// DialogHandler renders agent events into the transcript view, and the status
+// bar when set. Events are applied in batches, one redraw per batch.
+type DialogHandler struct {
+	app     *tview.Application
+	view    *TranscriptView
+	Status  *StatusBar
+	mutex   sync.Mutex
+	pending []ai.Event
+}
+
+func NewDialogHandler(app *tview.Application, view *TranscriptView) *DialogHandler {
+	return &DialogHandler{app: app, view: view}
+}
+
+func (h *DialogHandler) HandleEvent(e ai.Event) {
+	h.mutex.Lock()
+	h.pending = append(h.pending, e)
+	first := len(h.pending) == 1
+	h.mutex.Unlock()
+	if first {
+		h.app.QueueUpdateDraw(h.apply)
+	}
+}
+
+func (h *DialogHandler) apply() {
+	h.mutex.Lock()
+	events := h.pending
+	h.pending = nil
+	h.mutex.Unlock()
+	for _, e := range events {
+		h.view.Transcript().Handle(e)
+		if h.Status != nil {
+			h.Status.Handle(e)
+		}
+	}
+	h.view.Refresh()
+	if h.Status != nil {
+		h.Status.Refresh()
+	}
+}
+
+// ApprovePage is the name of the page showing the command approval modal
+const ApprovePage = "approve"
+
+// NewApprover returns a function that asks the user, in a modal shown over
+// pages, whether a command may run. Besides the buttons, the approve and reject
+// keys answer. It blocks until the user answers or ctx is done, so it must not
+// be called from the UI goroutine.
+func NewApprover(app *tview.Application, pages *tview.Pages, keys KeyMap) func(ctx context.Context, command string) bool {
+	return func(ctx context.Context, command string) bool {
+		answer := make(chan bool, 1)
+		reply := func(ok bool) {
+			// Only the first answer counts
+			select {
+			case answer <- ok:
+			default:
+			}
+		}
+		var prev tview.Primitive
+		app.QueueUpdateDraw(func() {
+			prev = app.GetFocus()
+			modal := tview.NewModal().
+				SetText("Run this command?\n\n" + tview.Escape(command)).
+				AddButtons([]string{"Run", "Skip"}).
+				SetDoneFunc(func(_ int, label string) {
+					reply(label == "Run")
+				})
+			modal.SetInputCapture(func(event *tcell.EventKey) *tcell.EventKey {
+				switch {
+				case keys.Matches(ActionApprove, event):
+					reply(true)
+				case keys.Matches(ActionReject, event):
+					reply(false)
+				default:
+					return event
+				}
+				return nil
+			})
+			pages.AddPage(ApprovePage, modal, true, true)
+			app.SetFocus(modal)
+		})
+
+		ok := false
+		select {
+		case ok = <-answer:
+		case <-ctx.Done():
+		}
+		app.QueueUpdateDraw(func() {
+			pages.RemovePage(ApprovePage)
+			if prev != nil {
+				app.SetFocus(prev)
+			}
+		})
+		return ok
+	}
+}
+
+// PasswordPage is the name of the page asking for a password
+const PasswordPage = "password"
+
+// NewPasswordAsker returns a function that asks the user, in a form shown over
+// pages, for the password a prompt in a pane wants. The input is masked and
+// Escape declines, as does the end of ctx. It blocks until then, so it must
+// not be called from the UI goroutine.
+func NewPasswordAsker(app *tview.Application, pages *tview.Pages) func(ctx context.Context, pane, prompt string) (string, bool) {
+	return func(ctx context.Context, pane, prompt string) (string, bool) {
+		type reply struct {
+			password string
+			ok       bool
+		}
+		answer := make(chan reply, 1)
+		send := func(r reply) {
+			// Only the first answer counts
+			select {
+			case answer <- r:
+			default:
+			}
+		}
+		var prev tview.Primitive
+		app.QueueUpdateDraw(func() {
+			prev = app.GetFocus()
+			form := tview.NewForm()
+			form.AddPasswordField("Password", "", 40, '*', nil).
+				AddButton("Send", func() {
+					send(reply{form.GetFormItem(0).(*tview.InputField).GetText(), true})
+				}).
+				AddButton("Cancel", func() { send(reply{}) }).
+				SetCancelFunc(func() { send(reply{}) })
+			form.SetBorder(true).SetTitle(" Pane " + tview.Escape(pane) + ": " + tview.Escape(prompt) + " ")
+			// Enter in the field sends, as it does in a terminal
+			form.GetFormItem(0).(*tview.InputField).SetDoneFunc(func(key tcell.Key) {
+				if key == tcell.KeyEnter {
+					send(reply{form.GetFormItem(0).(*tview.InputField).GetText(), true})
+				}
+			})
+			centered := tview.NewGrid().SetColumns(0, 60, 0).SetRows(0, 7, 0).AddItem(form, 1, 1, 1, 1, 0, 0, true)
+			pages.AddPage(PasswordPage, centered, true, true)
+			app.SetFocus(form)
+		})
+
+		var r reply
+		select {
+		case r = <-answer:
+		case <-ctx.Done():
+		}
+		app.QueueUpdateDraw(func() {
+			pages.RemovePage(PasswordPage)
+			if prev != nil {
+				app.SetFocus(prev)
+			}
+		})
+		return r.password, r.ok
+	}
+}
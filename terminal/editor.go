@@ -0,0 +1,373 @@
+package terminal
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// maxEditorHeight is the number of rows the prompt editor grows to
+const maxEditorHeight = 10
+
+// PromptEditor is the multi-line input of the dialog. Enter sends the prompt,
+// Alt+Enter, Shift+Enter or Ctrl+J insert a newline, Up/Down on the first/last
+// line browse the prompt history, Ctrl+R searches it, Tab completes slash
+// commands and @references, listing the candidates above the editor,
+// Ctrl+X Ctrl+E opens the prompt in $EDITOR and the focus-chat keys call the
+// done function.
+type PromptEditor struct {
+	*tview.TextArea
+	app     *tview.Application
+	history *PromptHistory
+	keys    KeyMap
+	label   string
+
+	submit   func(text string)
+	complete func(text string) []string
+	done     func(key tcell.Key)
+	resize   func(height int)
+
+	histIndex int    // history entry shown, len(entries) when showing the draft
+	draft     string // text typed before browsing the history
+
+	completions []string // candidates cycled through by Tab
+	completion  int
+
+	searching   bool
+	query       string
+	match       int
+	searchDraft string
+
+	ctrlX bool // Ctrl+X was pressed, waiting for Ctrl+E
+}
+
+func NewPromptEditor(app *tview.Application, history *PromptHistory) *PromptEditor {
+	e := &PromptEditor{
+		TextArea:  tview.NewTextArea(),
+		app:       app,
+		history:   history,
+		keys:      DefaultKeyMap(),
+		label:     "You: ",
+		histIndex: len(history.Entries()),
+	}
+	e.TextArea.SetLabel(e.label)
+	e.TextArea.SetChangedFunc(e.changed)
+	return e
+}
+
+// SetSubmitFunc sets the function called with the prompt when Enter is pressed
+func (e *PromptEditor) SetSubmitFunc(submit func(text string)) *PromptEditor {
+	e.submit = submit
+	return e
+}
+
+// SetCompleteFunc sets the function returning the completions for Tab
+func (e *PromptEditor) SetCompleteFunc(complete func(text string) []string) *PromptEditor {
+	e.complete = complete
+	return e
+}
+
+// SetKeyMap sets the key bindings of the editor
+func (e *PromptEditor) SetKeyMap(keys KeyMap) *PromptEditor {
+	e.keys = keys
+	return e
+}
+
+// SetDoneFunc sets the function called when a focus-chat key is pressed
+// outside a search
+func (e *PromptEditor) SetDoneFunc(done func(key tcell.Key)) *PromptEditor {
+	e.done = done
+	return e
+}
+
+// SetResizeFunc sets the function told the height the editor wants whenever
+// the number of lines changes
+func (e *PromptEditor) SetResizeFunc(resize func(height int)) *PromptEditor {
+	e.resize = resize
+	return e
+}
+
+// SetText replaces the text and moves the cursor to its end
+func (e *PromptEditor) SetText(text string) *PromptEditor {
+	e.TextArea.SetText(text, true)
+	e.changed()
+	return e
+}
+
+// Height returns the number of rows needed to show the text
+func (e *PromptEditor) Height() int {
+	return min(strings.Count(e.GetText(), "\n")+1, maxEditorHeight)
+}
+
+func (e *PromptEditor) changed() {
+	if e.resize != nil {
+		e.resize(e.Height())
+	}
+}
+
+// cursorLine reports whether the cursor is on the first and on the last line
+func (e *PromptEditor) cursorLine() (first, last bool) {
+	text := e.GetText()
+	_, start, _ := e.GetSelection()
+	return !strings.Contains(text[:start], "\n"), !strings.Contains(text[start:], "\n")
+}
+
+func (e *PromptEditor) InputHandler() func(event *tcell.EventKey, setFocus func(p tview.Primitive)) {
+	return e.WrapInputHandler(func(event *tcell.EventKey, setFocus func(p tview.Primitive)) {
+		if e.GetDisabled() {
+			return
+		}
+		if e.searching {
+			if e.handleSearch(event) {
+				return
+			}
+		}
+		if event.Key() != tcell.KeyTab {
+			e.completions = nil
+		}
+		if e.ctrlX {
+			e.ctrlX = false
+			if event.Key() == tcell.KeyCtrlE {
+				e.openEditor()
+				return
+			}
+		}
+		if e.keys.Matches(ActionFocusChat, event) {
+			if e.done != nil {
+				e.done(event.Key())
+			}
+			return
+		}
+
+		switch event.Key() {
+		case tcell.KeyEnter:
+			if event.Modifiers()&(tcell.ModAlt|tcell.ModShift) != 0 {
+				e.TextArea.InputHandler()(tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone), setFocus)
+				return
+			}
+			text := e.GetText()
+			e.history.Add(text)
+			e.histIndex = len(e.history.Entries())
+			e.draft = ""
+			if e.submit != nil {
+				e.submit(text)
+			}
+			return
+		case tcell.KeyCtrlJ:
+			e.TextArea.InputHandler()(tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone), setFocus)
+			return
+		case tcell.KeyUp:
+			if first, _ := e.cursorLine(); first && e.histIndex > 0 {
+				if e.histIndex == len(e.history.Entries()) {
+					e.draft = e.GetText()
+				}
+				e.histIndex--
+				e.SetText(e.history.Entries()[e.histIndex])
+				return
+			}
+		case tcell.KeyDown:
+			if _, last := e.cursorLine(); last && e.histIndex < len(e.history.Entries()) {
+				e.histIndex++
+				if e.histIndex == len(e.history.Entries()) {
+					e.SetText(e.draft)
+				} else {
+					e.SetText(e.history.Entries()[e.histIndex])
+				}
+				return
+			}
+		case tcell.KeyTab:
+			if e.completeText() {
+				return
+			}
+		case tcell.KeyCtrlR:
+			e.searching = true
+			e.query = ""
+			e.match = len(e.history.Entries())
+			e.searchDraft = e.GetText()
+			e.showSearch()
+			return
+		case tcell.KeyCtrlX:
+			e.ctrlX = true
+			return
+		}
+		e.TextArea.InputHandler()(event, setFocus)
+	})
+}
+
+// completeText completes the text with Tab: to the only candidate, to the
+// longest common prefix, or by cycling through the candidates
+func (e *PromptEditor) completeText() bool {
+	if e.completions != nil {
+		e.completion = (e.completion + 1) % len(e.completions)
+		e.SetText(e.completions[e.completion])
+		return true
+	}
+	if e.complete == nil {
+		return false
+	}
+	text := e.GetText()
+	candidates := e.complete(text)
+	switch len(candidates) {
+	case 0:
+		return false
+	case 1:
+		e.SetText(candidates[0])
+		return true
+	}
+	if prefix := commonPrefix(candidates); prefix != text {
+		e.SetText(prefix)
+		return true
+	}
+	e.completions = candidates
+	e.completion = 0
+	e.SetText(candidates[0])
+	return true
+}
+
+// maxShownCompletions is the number of candidates listed above the editor
+const maxShownCompletions = 8
+
+// Draw draws the editor, and the candidates Tab cycles through above it
+func (e *PromptEditor) Draw(screen tcell.Screen) {
+	e.TextArea.Draw(screen)
+	if len(e.completions) < 2 {
+		return
+	}
+	x, y, width, _ := e.GetRect()
+	first := max(0, min(e.completion-maxShownCompletions/2, len(e.completions)-maxShownCompletions))
+	shown := e.completions[first:min(first+maxShownCompletions, len(e.completions))]
+	w := 0
+	for _, c := range shown {
+		w = max(w, len([]rune(completedWord(c)))+2)
+	}
+	x += len(e.label)
+	w = min(w, width-len(e.label))
+	for i, c := range shown {
+		row := y - len(shown) + i
+		if row < 0 {
+			continue
+		}
+		style := tcell.StyleDefault.Background(tcell.ColorDarkSlateGray).Foreground(tcell.ColorWhite)
+		if first+i == e.completion {
+			style = style.Reverse(true)
+		}
+		text := []rune(" " + completedWord(c))
+		for col := 0; col < w; col++ {
+			r := ' '
+			if col < len(text) {
+				r = text[col]
+			}
+			screen.SetContent(x+col, row, r, nil, style)
+		}
+	}
+}
+
+// completedWord returns the last word of a candidate, the only one that
+// differs between candidates
+func completedWord(candidate string) string {
+	return candidate[strings.LastIndexAny(candidate, " \t\n")+1:]
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(w, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// handleSearch processes a key during a reverse history search and reports
+// whether it was consumed. Keys that are not part of the search accept the
+// match and are then handled as usual.
+func (e *PromptEditor) handleSearch(event *tcell.EventKey) bool {
+	switch event.Key() {
+	case tcell.KeyCtrlR:
+		if i := e.history.Search(e.query, e.match); i >= 0 {
+			e.match = i
+		}
+		e.showSearch()
+		return true
+	case tcell.KeyRune:
+		e.query += string(event.Rune())
+		e.match = len(e.history.Entries())
+		e.showSearch()
+		return true
+	case tcell.KeyBackspace, tcell.KeyBackspace2:
+		if e.query != "" {
+			e.query = e.query[:len(e.query)-1]
+		}
+		e.match = len(e.history.Entries())
+		e.showSearch()
+		return true
+	case tcell.KeyEscape, tcell.KeyCtrlG:
+		e.endSearch()
+		e.SetText(e.searchDraft)
+		return true
+	case tcell.KeyEnter:
+		e.endSearch()
+		return true
+	}
+	e.endSearch()
+	return false
+}
+
+// showSearch shows the most recent match of the query at or before e.match
+func (e *PromptEditor) showSearch() {
+	entries := e.history.Entries()
+	i := e.match
+	if i >= len(entries) || !strings.Contains(entries[i], e.query) {
+		i = e.history.Search(e.query, e.match)
+	}
+	label := "(reverse-i-search)`" + e.query + "': "
+	if i < 0 {
+		label = "(failed reverse-i-search)`" + e.query + "': "
+	} else {
+		e.match = i
+		e.SetText(entries[i])
+	}
+	e.TextArea.SetLabel(label)
+}
+
+func (e *PromptEditor) endSearch() {
+	e.searching = false
+	e.TextArea.SetLabel(e.label)
+	e.histIndex = len(e.history.Entries())
+}
+
+// openEditor suspends the UI and lets the user compose the prompt in $VISUAL
+// or $EDITOR
+func (e *PromptEditor) openEditor() {
+	f, err := os.CreateTemp("", "aiterm-prompt-*.md")
+	if err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(e.GetText())
+	f.Close()
+
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	e.app.Suspend(func() {
+		cmd := exec.Command("sh", "-c", editor+` "$1"`, "sh", f.Name())
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", editor, err.Error())
+		}
+	})
+	data, err := os.ReadFile(f.Name())
+	if err != nil {
+		return
+	}
+	e.SetText(strings.TrimRight(string(data), "\n"))
+}
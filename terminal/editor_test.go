@@ -0,0 +1,127 @@
+package terminal_test
+
+import (
+	"testing"
+
+	"github.com/aki-colt/aiterm/terminal"
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+func newEditor(t *testing.T, prompts ...string) (*terminal.PromptEditor, *[]string) {
+	t.Helper()
+	history := terminal.LoadPromptHistory("")
+	for _, p := range prompts {
+		history.Add(p)
+	}
+	var sent []string
+	e := terminal.NewPromptEditor(tview.NewApplication(), history)
+	e.SetSubmitFunc(func(text string) {
+		sent = append(sent, text)
+		e.SetText("")
+	})
+	return e, &sent
+}
+
+func press(e *terminal.PromptEditor, keys ...*tcell.EventKey) {
+	for _, k := range keys {
+		e.InputHandler()(k, func(tview.Primitive) {})
+	}
+}
+
+func key(k tcell.Key) *tcell.EventKey {
+	return tcell.NewEventKey(k, 0, tcell.ModNone)
+}
+
+func typed(text string) []*tcell.EventKey {
+	var keys []*tcell.EventKey
+	for _, r := range text {
+		keys = append(keys, tcell.NewEventKey(tcell.KeyRune, r, tcell.ModNone))
+	}
+	return keys
+}
+
+func TestEditorMultiLine(t *testing.T) {
+	e, sent := newEditor(t)
+	press(e, typed("first")...)
+	press(e, tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModAlt))
+	press(e, typed("second")...)
+	if e.Height() != 2 {
+		t.Errorf("Height = %d, want 2", e.Height())
+	}
+	press(e, key(tcell.KeyEnter))
+	if len(*sent) != 1 || (*sent)[0] != "first\nsecond" {
+		t.Errorf("sent = %q", *sent)
+	}
+}
+
+func TestEditorHistory(t *testing.T) {
+	e, _ := newEditor(t, "old one", "old two")
+	press(e, typed("draft")...)
+	press(e, key(tcell.KeyUp))
+	if got := e.GetText(); got != "old two" {
+		t.Errorf("after Up = %q", got)
+	}
+	press(e, key(tcell.KeyUp), key(tcell.KeyUp))
+	if got := e.GetText(); got != "old one" {
+		t.Errorf("after Up Up Up = %q", got)
+	}
+	press(e, key(tcell.KeyDown), key(tcell.KeyDown))
+	if got := e.GetText(); got != "draft" {
+		t.Errorf("after Down Down = %q, want the draft back", got)
+	}
+}
+
+func TestEditorReverseSearch(t *testing.T) {
+	e, sent := newEditor(t, "git status", "ls -la", "git log")
+	press(e, key(tcell.KeyCtrlR))
+	press(e, typed("git")...)
+	if got := e.GetText(); got != "git log" {
+		t.Errorf("search = %q", got)
+	}
+	press(e, key(tcell.KeyCtrlR))
+	if got := e.GetText(); got != "git status" {
+		t.Errorf("search again = %q", got)
+	}
+	press(e, key(tcell.KeyEnter), key(tcell.KeyEnter))
+	if len(*sent) != 1 || (*sent)[0] != "git status" {
+		t.Errorf("sent = %q", *sent)
+	}
+
+	press(e, typed("draft")...)
+	press(e, key(tcell.KeyCtrlR))
+	press(e, typed("ls")...)
+	press(e, key(tcell.KeyEscape))
+	if got := e.GetText(); got != "draft" {
+		t.Errorf("after cancel = %q", got)
+	}
+}
+
+func TestEditorComplete(t *testing.T) {
+	e, _ := newEditor(t)
+	e.SetCompleteFunc(func(text string) []string {
+		all := []string{"/help", "/history", "/model"}
+		var res []string
+		for _, c := range all {
+			if len(c) >= len(text) && c[:len(text)] == text {
+				res = append(res, c)
+			}
+		}
+		return res
+	})
+	press(e, typed("/m")...)
+	press(e, key(tcell.KeyTab))
+	if got := e.GetText(); got != "/model" {
+		t.Errorf("complete /m = %q", got)
+	}
+	e.SetText("")
+	press(e, typed("/")...)
+	press(e, key(tcell.KeyTab))
+	if got := e.GetText(); got != "/help" {
+		t.Errorf("complete / = %q", got)
+	}
+	press(e, key(tcell.KeyTab))
+	if got := e.GetText(); got != "/history" {
+		t.Errorf("cycle = %q", got)
+	}
+}
@@ -0,0 +1,105 @@
+package terminal
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxPromptHistory is the number of prompts kept in memory
+const maxPromptHistory = 1000
+
+// PromptHistory keeps the prompts sent in this and previous sessions. Each
+// prompt is stored as a JSON string on its own line so multi-line prompts
+// survive the round trip.
+type PromptHistory struct {
+	path    string
+	entries []string
+}
+
+// LoadPromptHistory reads the history file; a missing file is an empty
+// history. An empty path keeps the history in memory only.
+func LoadPromptHistory(path string) *PromptHistory {
+	h := &PromptHistory{path: path}
+	if path == "" {
+		return h
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return h
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var entry string
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil && entry != "" {
+			h.entries = append(h.entries, entry)
+		}
+	}
+	h.trim()
+	return h
+}
+
+// DefaultPromptHistoryPath is ~/.aiterm/prompt_history
+func DefaultPromptHistoryPath() string {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(homeDir, ".aiterm", "prompt_history")
+}
+
+func (h *PromptHistory) trim() {
+	if len(h.entries) > maxPromptHistory {
+		h.entries = h.entries[len(h.entries)-maxPromptHistory:]
+	}
+}
+
+// Entries returns the prompts, oldest first
+func (h *PromptHistory) Entries() []string {
+	return h.entries
+}
+
+// Add records a prompt, skipping blanks and repeats of the last prompt
+func (h *PromptHistory) Add(prompt string) error {
+	if strings.TrimSpace(prompt) == "" {
+		return nil
+	}
+	if n := len(h.entries); n > 0 && h.entries[n-1] == prompt {
+		return nil
+	}
+	h.entries = append(h.entries, prompt)
+	h.trim()
+	if h.path == "" {
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(h.path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	data, _ := json.Marshal(prompt)
+	_, err = f.Write(append(data, '\n'))
+	return err
+}
+
+// Search returns the index of the most recent prompt before index `before`
+// that contains query, or -1
+func (h *PromptHistory) Search(query string, before int) int {
+	if before > len(h.entries) {
+		before = len(h.entries)
+	}
+	for i := before - 1; i >= 0; i-- {
+		if strings.Contains(h.entries[i], query) {
+			return i
+		}
+	}
+	return -1
+}
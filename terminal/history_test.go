@@ -0,0 +1,36 @@
+package terminal_test
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/aki-colt/aiterm/terminal"
+)
+
+func TestPromptHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	h := terminal.LoadPromptHistory(path)
+	for _, p := range []string{"list files", "list files", "  ", "show the\nstack trace", "git status"} {
+		if err := h.Add(p); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	// A new session sees the prompts of the previous one
+	h = terminal.LoadPromptHistory(path)
+	want := []string{"list files", "show the\nstack trace", "git status"}
+	if got := h.Entries(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("Entries = %q, want %q", got, want)
+	}
+
+	if got := h.Search("st", 3); got != 2 {
+		t.Errorf("Search(st, 3) = %d, want 2", got)
+	}
+	if got := h.Search("st", 2); got != 1 {
+		t.Errorf("Search(st, 2) = %d, want 1", got)
+	}
+	if got := h.Search("nope", 3); got != -1 {
+		t.Errorf("Search(nope) = %d, want -1", got)
+	}
+}
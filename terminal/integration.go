@@ -0,0 +1,384 @@
+package terminal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aki-colt/aiterm/internal/shell"
+)
+
+// Shell integration marks the prompts and commands of a pane with OSC 133
+// sequences: A when a prompt is shown, C;<command> when a command starts and
+// D;<exit code>;<cwd> when it ends. The output of the pane is piped to a file
+// and parsed into a timeline of the commands run there, typed by the user or
+// not.
+
+const (
+	maxRecords      = 100      // commands kept in the timeline of a pane
+	maxRecordOutput = 64 << 10 // bytes of output kept for each command
+	maxLogSize      = 1 << 20  // bytes piped to a file before the next one
+	pollInterval    = 200 * time.Millisecond
+)
+
+// integrationScripts are sourced by each shell. They keep $? for the rest of
+// the prompt, and drop BEL and ESC from commands so that they cannot end the
+// sequence early.
+var integrationScripts = map[string]string{
+	"bash": `if [ -z "$__aiterm_integrated" ]; then
+__aiterm_integrated=1
+__aiterm_precmd() {
+	local s=$?
+	printf '\033]133;D;%s;%s\007\033]133;A\007' "$s" "$PWD"
+	return $s
+}
+__aiterm_preexec() {
+	local c
+	c=$(HISTTIMEFORMAT= builtin history 1)
+	c=${c#*[0-9]  }
+	c=${c//$'\a'/}
+	printf '\033]133;C;%s\007' "${c//$'\e'/}"
+}
+PROMPT_COMMAND="__aiterm_precmd${PROMPT_COMMAND:+;$PROMPT_COMMAND}"
+PS0='$(__aiterm_preexec)'"$PS0"
+fi
+`,
+	"zsh": `if [[ -z $__aiterm_integrated ]]; then
+__aiterm_integrated=1
+__aiterm_precmd() {
+	local s=$?
+	printf '\033]133;D;%s;%s\007\033]133;A\007' "$s" "$PWD"
+	return $s
+}
+__aiterm_preexec() {
+	local c=${1//$'\a'/}
+	printf '\033]133;C;%s\007' "${c//$'\e'/}"
+}
+autoload -Uz add-zsh-hook
+add-zsh-hook precmd __aiterm_precmd
+add-zsh-hook preexec __aiterm_preexec
+fi
+`,
+	"fish": `if not set -q __aiterm_integrated
+set -g __aiterm_integrated 1
+function __aiterm_preexec --on-event fish_preexec
+	printf '\e]133;C;%s\a' (string replace -a \a '' -- $argv[1] | string replace -a \e '' | string collect)
+end
+function __aiterm_postexec --on-event fish_postexec
+	printf '\e]133;D;%s;%s\a' $status $PWD
+end
+function __aiterm_prompt --on-event fish_prompt
+	printf '\e]133;A\a'
+end
+end
+`,
+}
+
+// CommandRecord is a command of the timeline of a pane
+type CommandRecord struct {
+	Command  string
+	Output   string // without escape sequences
+	ExitCode int
+	Cwd      string
+	Start    time.Time
+	End      time.Time
+}
+
+// timeline parses the piped output of a pane into command records. The
+// output is piped to a new file each maxLogSize bytes, and the parsed files
+// are removed.
+type timeline struct {
+	base string // path of the files without their number
+	stop chan struct{}
+	// pipe pipes the output of the pane to the file at path, in place of
+	// the previous one
+	pipe func(path string) error
+
+	mutex     sync.Mutex // guards the fields below
+	files     int        // files piped to so far
+	path      string
+	offset    int64
+	old       string // the previous file, until its last output is parsed
+	oldOffset int64
+	rotated   time.Time
+	partial   []byte // an unfinished sequence at the end of the last read
+	current   *CommandRecord
+	output    bytes.Buffer
+	records   []CommandRecord
+}
+
+// oscRe matches the OSC 133 sequences, ended by BEL or ST
+var oscRe = regexp.MustCompile(`\x1b\]133;([^\a\x1b]*)(?:\a|\x1b\\)`)
+
+// feed parses a chunk of output
+func (t *timeline) feed(data []byte, now time.Time) {
+	data = append(t.partial, data...)
+	t.partial = nil
+	for len(data) > 0 {
+		loc := oscRe.FindSubmatchIndex(data)
+		if loc == nil {
+			// Keep what may be the start of a sequence for the next chunk
+			if i := pendingMark(data); i >= 0 {
+				t.partial = append([]byte(nil), data[i:]...)
+				data = data[:i]
+			}
+			t.write(data)
+			return
+		}
+		t.write(data[:loc[0]])
+		t.mark(string(data[loc[2]:loc[3]]), now)
+		data = data[loc[1]:]
+	}
+}
+
+var markStart = []byte("\x1b]133;")
+
+// pendingMark returns where an unfinished sequence starts at the end of data,
+// or -1
+func pendingMark(data []byte) int {
+	if i := bytes.LastIndex(data, markStart); i >= 0 && len(data)-i < 4096 {
+		return i
+	}
+	if i := bytes.LastIndexByte(data, 0x1b); i >= 0 && bytes.HasPrefix(markStart, data[i:]) {
+		return i
+	}
+	return -1
+}
+
+// write adds output to the running command, if any
+func (t *timeline) write(data []byte) {
+	if t.current != nil && t.output.Len() < maxRecordOutput {
+		t.output.Write(data[:min(len(data), maxRecordOutput-t.output.Len())])
+	}
+}
+
+// mark handles the parameters of an OSC 133 sequence
+func (t *timeline) mark(params string, now time.Time) {
+	kind, rest, _ := strings.Cut(params, ";")
+	switch kind {
+	case "C":
+		// The clear aiterm types before each command is not one of them
+		if strings.TrimSpace(rest) == "clear" {
+			return
+		}
+		t.current = &CommandRecord{Command: strings.TrimSpace(rest), ExitCode: -1, Start: now}
+		t.output.Reset()
+	case "D":
+		// D also follows prompts where no command ran, which have no C
+		if t.current == nil {
+			return
+		}
+		code, cwd, _ := strings.Cut(rest, ";")
+		r := *t.current
+		r.ExitCode, _ = strconv.Atoi(code)
+		r.Cwd, r.End = cwd, now
+		r.Output = cleanOutput(t.output.String())
+		t.current = nil
+		t.output.Reset()
+		t.records = append(t.records, r)
+		if len(t.records) > maxRecords {
+			t.records = t.records[len(t.records)-maxRecords:]
+		}
+	}
+}
+
+// escapeRe matches the escape sequences of terminal output: CSI, OSC and
+// the two-byte ones
+var escapeRe = regexp.MustCompile(`\x1b\[[0-?]*[ -/]*[@-~]|\x1b\][^\a\x1b]*(?:\a|\x1b\\)|\x1b[()][0-9A-Za-z]|\x1b[@-Z\\-_=>]`)
+
+// cleanOutput removes escape sequences from output, and keeps what was last
+// written over carriage returns, as progress bars do
+func cleanOutput(output string) string {
+	output = escapeRe.ReplaceAllString(output, "")
+	output = strings.ReplaceAll(output, "\r\n", "\n")
+	lines := strings.Split(output, "\n")
+	for i, line := range lines {
+		if j := strings.LastIndexByte(strings.TrimRight(line, "\r"), '\r'); j >= 0 {
+			line = line[j+1:]
+		}
+		lines[i] = strings.TrimRight(line, "\r")
+	}
+	return strings.TrimSpace(strings.Join(lines, "\n"))
+}
+
+// poll parses what the pane wrote since the last poll, and moves to a new
+// file once the current one is large
+func (t *timeline) poll() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	// The previous file comes first: it may still get what was on its way
+	// when it was replaced
+	if t.old != "" {
+		t.read(t.old, &t.oldOffset)
+		if time.Since(t.rotated) > time.Second {
+			os.Remove(t.old)
+			t.old = ""
+		}
+	}
+	t.read(t.path, &t.offset)
+	if t.offset >= maxLogSize && t.old == "" {
+		t.rotate()
+	}
+}
+
+// read parses what was written to path after offset
+func (t *timeline) read(path string, offset *int64) {
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(*offset, io.SeekStart); err != nil {
+		return
+	}
+	data, err := io.ReadAll(f)
+	if err != nil || len(data) == 0 {
+		return
+	}
+	*offset += int64(len(data))
+	t.feed(data, time.Now())
+}
+
+// rotate pipes the pane to the next file
+func (t *timeline) rotate() error {
+	path := fmt.Sprintf("%s.%d.log", t.base, t.files)
+	if err := t.pipe(path); err != nil {
+		return err
+	}
+	t.files++
+	t.old, t.oldOffset = t.path, t.offset
+	t.path, t.offset = path, 0
+	t.rotated = time.Now()
+	return nil
+}
+
+// run polls the file until stop is closed
+func (t *timeline) run() {
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-t.stop:
+			return
+		case <-ticker.C:
+			t.poll()
+		}
+	}
+}
+
+// snapshot returns the records of the timeline
+func (t *timeline) snapshot() []CommandRecord {
+	t.poll()
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return append([]CommandRecord(nil), t.records...)
+}
+
+// integrate pipes the output of a pane to a file and sources the
+// integration script of its shell. Panes running other programs are left as
+// they are.
+func (tc *TerminalController) integrate(p *tmuxPane) error {
+	_, command, err := p.status()
+	if err != nil {
+		return err
+	}
+	script, ok := integrationScripts[command]
+	if !ok {
+		return fmt.Errorf("shell integration supports bash, zsh and fish, not %s", command)
+	}
+	if tc.integrationDir == "" {
+		if tc.integrationDir, err = os.MkdirTemp("", "aiterm-"); err != nil {
+			return err
+		}
+	}
+	scriptPath := filepath.Join(tc.integrationDir, "integration."+command)
+	if err := os.WriteFile(scriptPath, []byte(script), 0o600); err != nil {
+		return err
+	}
+	t := &timeline{
+		base: filepath.Join(tc.integrationDir, strings.TrimPrefix(p.id, "%")),
+		stop: make(chan struct{}),
+		pipe: func(path string) error {
+			return tc.tmuxCommand("pipe-pane", "-t", p.id, "cat >> "+shell.Quote(path))
+		},
+	}
+	if err := t.rotate(); err != nil {
+		return fmt.Errorf("failed to pipe the pane output: %v", err)
+	}
+	// The leading space keeps the line out of the history of most shells
+	if err := tc.tmuxCommand("send-keys", "-t", p.id, " . "+shell.Quote(scriptPath), "Enter"); err != nil {
+		tc.tmuxCommand("pipe-pane", "-t", p.id)
+		return fmt.Errorf("failed to source the integration script: %v", err)
+	}
+	p.timeline = t
+	go t.run()
+	return nil
+}
+
+// unintegrate stops parsing the output of a pane
+func (tc *TerminalController) unintegrate(p *tmuxPane) {
+	if p.timeline == nil {
+		return
+	}
+	close(p.timeline.stop)
+	tc.tmuxCommand("pipe-pane", "-t", p.id)
+}
+
+// Integrated reports whether the main pane has shell integration
+func (tc *TerminalController) Integrated() bool {
+	p, err := tc.pane(MainPane)
+	return err == nil && p.timeline != nil
+}
+
+// IntegrationError returns why the main pane has no shell integration, nil
+// when it has or it was not asked for
+func (tc *TerminalController) IntegrationError() error {
+	p, err := tc.pane(MainPane)
+	if err != nil {
+		return err
+	}
+	return p.integrationErr
+}
+
+// Timeline returns the commands that ran in the named pane, the main one
+// when name is empty, oldest first. It fails when the pane has no shell
+// integration.
+func (tc *TerminalController) Timeline(name string) ([]CommandRecord, error) {
+	p, err := tc.pane(name)
+	if err != nil {
+		return nil, err
+	}
+	if p.integrationErr != nil {
+		return nil, fmt.Errorf("the pane has no shell integration: %v", p.integrationErr)
+	}
+	if p.timeline == nil {
+		return nil, fmt.Errorf("the pane has no shell integration, start aiterm with -shell-integration")
+	}
+	return p.timeline.snapshot(), nil
+}
+
+// exitCode returns the exit code of the last run of command in the pane since
+// start, or -1 when it is unknown. The end of a command reaches the piped
+// file a little after the prompt is back on screen, so it is waited for.
+func (p *tmuxPane) exitCode(command string, start time.Time) int {
+	if p.timeline == nil {
+		return -1
+	}
+	for tries := 0; tries < 10; tries++ {
+		records := p.timeline.snapshot()
+		for i := len(records) - 1; i >= 0 && !records[i].Start.Before(start); i-- {
+			if records[i].Command == strings.TrimSpace(command) {
+				return records[i].ExitCode
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return -1
+}
@@ -0,0 +1,310 @@
+package terminal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// paneState is what a pane is doing after a command or keys were sent to it
+type paneState int
+
+const (
+	stateIdle       paneState = iota // back at the shell prompt
+	stateRunning                     // the command is still running
+	stateWaiting                     // the command seems to wait for an answer
+	statePassword                    // the command asks for a password
+	stateFullScreen                  // a full-screen program took over the pane
+)
+
+// maxPasswordTries is how many times the user is asked for the password of
+// a prompt that keeps coming back
+const maxPasswordTries = 3
+
+// settleTime is how long a command is given to finish before its screen is
+// reported with the command still running
+const settleTime = 2 * time.Second
+
+var (
+	// questionRe matches a last line asking for an answer, even to a shell
+	// builtin such as read
+	questionRe = regexp.MustCompile(`(?i)(\[y/n\]|\(y/n\)|\[yes/no\]|\(yes/no[^)]*\)|continue\?|press (any key|enter|return))\s*$`)
+	// passwordRe matches a password prompt, such as those of sudo, su and ssh
+	passwordRe = regexp.MustCompile(`(?i)(password|passphrase|passcode)[^:\n]{0,60}:\s*$`)
+	// promptRe matches a last line looking like a prompt, which only means
+	// waiting when a program other than the shell runs
+	promptRe = regexp.MustCompile(`([:?>]|>>>|\$|#)\s*$`)
+)
+
+// status returns the foreground program of the pane and whether it uses the
+// alternate screen, as full-screen programs do
+func (p *tmuxPane) status() (alternate bool, command string, err error) {
+	output, err := exec.Command("tmux", "display-message", "-p", "-t", p.id, "#{alternate_on}\t#{pane_current_command}").Output()
+	if err != nil {
+		return false, "", err
+	}
+	alt, command, _ := strings.Cut(strings.TrimSpace(string(output)), "\t")
+	return alt == "1", command, nil
+}
+
+// newTmuxPane returns the pane with the id. A new pane waits for commands
+// when its shell is in the foreground, an attached one when the program in
+// the foreground now is, which may be ssh to another host.
+func newTmuxPane(id string, keep, attached bool) (*tmuxPane, error) {
+	output, err := exec.Command("tmux", "display-message", "-p", "-t", id, "#{pane_pid}").Output()
+	if err != nil {
+		return nil, fmt.Errorf("no tmux pane %s", id)
+	}
+	p := &tmuxPane{id: id, keep: keep}
+	if p.shell, err = strconv.Atoi(strings.TrimSpace(string(output))); err != nil {
+		return nil, fmt.Errorf("no process in tmux pane %s", id)
+	}
+	p.idle = p.shell
+	if attached {
+		if p.idle, err = p.foreground(); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// foreground returns the process group in the foreground of the terminal of
+// the pane
+func (p *tmuxPane) foreground() (int, error) {
+	if stat, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", p.shell)); err == nil {
+		// The fields after the program name, which may hold spaces, start
+		// with state, ppid, pgrp, session, tty_nr and tpgid
+		fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+		if len(fields) > 5 {
+			return strconv.Atoi(fields[5])
+		}
+	}
+	output, err := exec.Command("ps", "-o", "tpgid=", "-p", strconv.Itoa(p.shell)).Output()
+	if err != nil {
+		return 0, fmt.Errorf("failed to find the foreground program of pane %s: %v", p.id, err)
+	}
+	return strconv.Atoi(strings.TrimSpace(string(output)))
+}
+
+// isIdle reports whether the pane waits for commands. The shell puts each
+// command it runs in a process group of its own, so the pane is busy as long
+// as another group is in the foreground, whatever its program is called, as
+// with bash build.sh.
+func (p *tmuxPane) isIdle() (bool, error) {
+	pgid, err := p.foreground()
+	return err == nil && pgid == p.idle, err
+}
+
+// lastLine returns the last non-blank line of a screen
+func lastLine(screen string) string {
+	lines := strings.Split(strings.TrimRight(screen, " \n"), "\n")
+	return lines[len(lines)-1]
+}
+
+// classify tells what a pane showing screen is doing
+func (p *tmuxPane) classify(screen string) (paneState, string, error) {
+	alternate, command, err := p.status()
+	if err != nil {
+		return stateIdle, "", err
+	}
+	idle, err := p.isIdle()
+	if err != nil {
+		return stateIdle, "", err
+	}
+	line := lastLine(screen)
+	switch {
+	case alternate:
+		return stateFullScreen, command, nil
+	case passwordRe.MatchString(line):
+		return statePassword, command, nil
+	case questionRe.MatchString(line):
+		return stateWaiting, command, nil
+	case idle:
+		return stateIdle, command, nil
+	case promptRe.MatchString(line):
+		return stateWaiting, command, nil
+	}
+	return stateRunning, command, nil
+}
+
+// capture returns the visible screen of the pane
+func (p *tmuxPane) capture() (string, error) {
+	output, err := exec.Command("tmux", "capture-pane", "-t", p.id, "-p").Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to capture output: %v", err)
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// wait waits up to settleTime for the pane to be idle and returns its screen
+// and what it is doing
+func (p *tmuxPane) wait() (screen string, state paneState, command string, err error) {
+	deadline := time.Now().Add(settleTime)
+	for {
+		time.Sleep(100 * time.Millisecond)
+		if screen, err = p.capture(); err != nil {
+			return "", 0, "", err
+		}
+		if state, command, err = p.classify(screen); err != nil {
+			return "", 0, "", err
+		}
+		if state != stateRunning || time.Now().After(deadline) {
+			return screen, state, command, nil
+		}
+	}
+}
+
+// settle waits for the pane to be idle, then captures it and notes what is
+// still running. Passwords are asked to the user and full-screen programs
+// are handed to them.
+func (tc *TerminalController) settle(name string, p *tmuxPane) (string, error) {
+	screen, state, command, err := p.wait()
+	if err != nil {
+		return "", err
+	}
+
+	var notes []string
+	for tries := 0; state == statePassword && tc.AskPassword != nil && tries < maxPasswordTries; tries++ {
+		prompt := strings.TrimSpace(lastLine(screen))
+		password, ok := tc.AskPassword(tc.questions(), name, prompt)
+		if !ok {
+			tc.tmuxCommand("send-keys", "-t", p.id, "C-c")
+			notes = append(notes, fmt.Sprintf("[The user declined to type the password asked by %q, so %s was stopped with C-c.]", prompt, command))
+		} else {
+			if err := tc.typeSecret(p, password); err != nil {
+				return "", err
+			}
+			notes = append(notes, fmt.Sprintf("[The user typed the password asked by %q.]", prompt))
+		}
+		if screen, state, command, err = p.wait(); err != nil {
+			return "", err
+		}
+	}
+
+	switch state {
+	case stateFullScreen:
+		if err := tc.handOff(name, p, command); err != nil {
+			return "", err
+		}
+		if screen, err = p.capture(); err != nil {
+			return "", err
+		}
+		notes = append(notes, fmt.Sprintf("[%s took over the screen, so the user was given the pane and has quit it. Its screen was not captured.]", command))
+	case statePassword:
+		notes = append(notes, fmt.Sprintf("[%s asks for a password, which only the user can type. Stop it with C-c and let the user run it themselves.]", command))
+	case stateWaiting:
+		notes = append(notes, fmt.Sprintf("[%s is still running and seems to wait for input. Answer it with sendKeys, or send C-c to stop it.]", command))
+	case stateRunning:
+		notes = append(notes, fmt.Sprintf("[%s is still running. Call sendKeys without keys to see its screen later, or send C-c to stop it.]", command))
+	}
+	if len(notes) == 0 {
+		return screen, nil
+	}
+	return screen + "\n" + strings.Join(notes, "\n"), nil
+}
+
+// typeSecret types a password and Enter into the pane. It goes through a
+// tmux buffer rather than the arguments of a command, which other users can
+// see.
+func (tc *TerminalController) typeSecret(p *tmuxPane, secret string) error {
+	load := exec.Command("tmux", "load-buffer", "-b", "aiterm-secret", "-")
+	load.Stdin = strings.NewReader(secret)
+	if err := load.Run(); err != nil {
+		return fmt.Errorf("failed to type the password: %v", err)
+	}
+	if err := tc.tmuxCommand("paste-buffer", "-d", "-b", "aiterm-secret", "-t", p.id); err != nil {
+		tc.tmuxCommand("delete-buffer", "-b", "aiterm-secret")
+		return fmt.Errorf("failed to type the password: %v", err)
+	}
+	return tc.tmuxCommand("send-keys", "-t", p.id, "Enter")
+}
+
+// handOff focuses the pane so that the user can drive a full-screen program,
+// and waits until the program leaves the alternate screen
+func (tc *TerminalController) handOff(name string, p *tmuxPane, command string) error {
+	if tc.HandOff != nil {
+		tc.HandOff(name, command)
+	}
+	tc.tmuxCommand("select-pane", "-t", p.id)
+	for {
+		time.Sleep(200 * time.Millisecond)
+		tc.mutex.Lock()
+		running := tc.running
+		tc.mutex.Unlock()
+		if !running {
+			return fmt.Errorf("aiterm stopped while the user had %s", command)
+		}
+		alternate, _, err := p.status()
+		if err != nil {
+			return err
+		}
+		if !alternate {
+			break
+		}
+	}
+	if tc.self != "" {
+		tc.tmuxCommand("select-pane", "-t", tc.self)
+	}
+	return nil
+}
+
+// busy returns an error when the pane is not at its prompt, so that a new
+// command is not typed into a running program
+func (p *tmuxPane) busy(name string) error {
+	alternate, command, err := p.status()
+	if err != nil {
+		return err
+	}
+	idle, err := p.isIdle()
+	if err != nil {
+		return err
+	}
+	if alternate || !idle {
+		return fmt.Errorf("pane %s is busy with %s, answer it or stop it with sendKeys, or use another pane", name, command)
+	}
+	return nil
+}
+
+// atPrompt reports whether the pane waits for a command. A shell builtin such
+// as read asking a question keeps the shell in the foreground, so the screen
+// tells it apart.
+func (p *tmuxPane) atPrompt() bool {
+	screen, err := p.capture()
+	if err != nil {
+		return false
+	}
+	state, _, err := p.classify(screen)
+	return err == nil && state == stateIdle
+}
+
+// SendKeys types keys into the named pane and returns its screen once it
+// settles. Each key is a tmux key name such as Enter, C-c, Escape or Up, or
+// text typed as is. Without keys the screen is only captured. Keys only go
+// to a running program: at the prompt they would run a command unseen by
+// Execute.
+func (tc *TerminalController) SendKeys(pane string, keys []string) (string, error) {
+	if pane == "" {
+		pane = MainPane
+	}
+	p, err := tc.pane(pane)
+	if err != nil {
+		return "", err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if len(keys) > 0 {
+		if p.atPrompt() {
+			return "", fmt.Errorf("pane %s is at its prompt, nothing runs there to type into, run commands with executeCommand", pane)
+		}
+		args := append([]string{"send-keys", "-t", p.id}, keys...)
+		if err := tc.tmuxCommand(args...); err != nil {
+			return "", fmt.Errorf("failed to send keys: %v", err)
+		}
+	}
+	return tc.settle(pane, p)
+}
@@ -0,0 +1,272 @@
+package terminal_test
+
+import (
+	"context"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aki-colt/aiterm/terminal"
+)
+
+func newController(t *testing.T) *terminal.TerminalController {
+	t.Helper()
+	startTmux(t)
+	tc, err := terminal.NewTerminalController(terminal.PaneOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(tc.Stop)
+	// Wait for the shell of the new pane
+	if _, err := tc.SendKeys("", nil); err != nil {
+		t.Fatal(err)
+	}
+	return tc
+}
+
+func TestExecuteWaitsForCommand(t *testing.T) {
+	tc := newController(t)
+	res, err := tc.Execute("sleep 0.5; echo done")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(res.Output, "\ndone\n") || strings.Contains(res.Output, "still running") {
+		t.Errorf("output = %q", res.Output)
+	}
+}
+
+func TestExecuteStillRunning(t *testing.T) {
+	tc := newController(t)
+	res, err := tc.Execute("sleep 30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(res.Output, "[sleep is still running.") {
+		t.Errorf("output = %q", res.Output)
+	}
+	if _, err := tc.Execute("ls"); err == nil || !strings.Contains(err.Error(), "busy with sleep") {
+		t.Errorf("Execute in a busy pane: %v", err)
+	}
+	screen, err := tc.SendKeys("", []string{"C-c"})
+	if err != nil || strings.Contains(screen, "still running") {
+		t.Errorf("SendKeys = %q, %v", screen, err)
+	}
+}
+
+func TestExecuteScriptRunning(t *testing.T) {
+	tc := newController(t)
+	// The running program is a shell too, it must not pass for the prompt
+	res, err := tc.Execute("sh -c 'sleep 30; true'")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(res.Output, "[sh is still running.") {
+		t.Errorf("output = %q", res.Output)
+	}
+	if _, err := tc.Execute("ls"); err == nil || !strings.Contains(err.Error(), "busy with sh") {
+		t.Errorf("Execute in a busy pane: %v", err)
+	}
+	tc.SendKeys("", []string{"C-c"})
+}
+
+func TestSendKeysAtPrompt(t *testing.T) {
+	tc := newController(t)
+	if _, err := tc.SendKeys("", []string{"touch typed", "Enter"}); err == nil || !strings.Contains(err.Error(), "at its prompt") {
+		t.Errorf("SendKeys at the prompt: %v", err)
+	}
+	if _, err := tc.SendKeys("", nil); err != nil {
+		t.Errorf("capture at the prompt: %v", err)
+	}
+}
+
+func TestExecuteWaitingForInput(t *testing.T) {
+	tc := newController(t)
+	res, err := tc.Execute(`printf 'Continue? [y/N] '; read x; echo "got $x"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(res.Output, "seems to wait for input") {
+		t.Errorf("output = %q", res.Output)
+	}
+	screen, err := tc.SendKeys("", []string{"y", "Enter"})
+	if err != nil || !strings.Contains(screen, "got y") || strings.Contains(screen, "wait for input") {
+		t.Errorf("SendKeys = %q, %v", screen, err)
+	}
+}
+
+func TestExecuteFullScreen(t *testing.T) {
+	tc := newController(t)
+	var handed string
+	tc.HandOff = func(pane, program string) {
+		handed = pane + " " + program
+		// The user quits the program
+		exec.Command("tmux", "send-keys", "-t", tc.Pane(), "q").Run()
+	}
+	res, err := tc.Execute("less /etc/passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handed != "main less" {
+		t.Errorf("handed off %q", handed)
+	}
+	if !strings.Contains(res.Output, "less took over the screen") {
+		t.Errorf("output = %q", res.Output)
+	}
+}
+
+// passwordCommand asks for a password without echo and prints its length
+const passwordCommand = `printf '[sudo] password for me: '; stty -echo; read pw; stty echo; echo; printf '%s' "$pw" | wc -c`
+
+func TestExecutePassword(t *testing.T) {
+	tc := newController(t)
+	var asked string
+	tc.AskPassword = func(_ context.Context, pane, prompt string) (string, bool) {
+		asked = pane + " " + prompt
+		return "hunter2", true
+	}
+	res, err := tc.Execute(passwordCommand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if asked != "main [sudo] password for me:" {
+		t.Errorf("asked %q", asked)
+	}
+	if !strings.Contains(res.Output, "\n7\n") || !strings.Contains(res.Output, "The user typed the password") {
+		t.Errorf("output = %q", res.Output)
+	}
+	if strings.Contains(res.Output, "hunter2") {
+		t.Errorf("password in output %q", res.Output)
+	}
+}
+
+func TestExecutePasswordDeclined(t *testing.T) {
+	tc := newController(t)
+	tc.AskPassword = func(context.Context, string, string) (string, bool) { return "", false }
+	res, err := tc.Execute(passwordCommand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(res.Output, "declined") {
+		t.Errorf("output = %q", res.Output)
+	}
+	if _, err := tc.Execute("true"); err != nil {
+		t.Errorf("pane still busy: %v", err)
+	}
+
+	// Without a way to ask, the model is told to leave it to the user
+	tc.AskPassword = nil
+	if res, _ = tc.Execute(passwordCommand); !strings.Contains(res.Output, "only the user can type") {
+		t.Errorf("output = %q", res.Output)
+	}
+}
+
+func TestExecutePasswordInterrupted(t *testing.T) {
+	tc := newController(t)
+	tc.AskPassword = func(ctx context.Context, pane, prompt string) (string, bool) {
+		// The user cancels the run while the prompt is open
+		go tc.Interrupt()
+		<-ctx.Done()
+		return "", false
+	}
+	res, err := tc.Execute(passwordCommand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(res.Output, "declined") {
+		t.Errorf("output = %q", res.Output)
+	}
+	// Later questions are asked again
+	tc.AskPassword = func(ctx context.Context, pane, prompt string) (string, bool) {
+		return "hunter2", ctx.Err() == nil
+	}
+	if res, err = tc.Execute(passwordCommand); err != nil || !strings.Contains(res.Output, "The user typed the password") {
+		t.Errorf("Execute after Interrupt = %q, %v", res.Output, err)
+	}
+}
+
+func TestScrollback(t *testing.T) {
+	tc := newController(t)
+	// Typed by the user rather than run with Execute, and longer than the screen
+	if err := exec.Command("tmux", "send-keys", "-t", tc.Pane(), "seq -f line%g 1 80", "Enter").Run(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(300 * time.Millisecond)
+	screen, err := tc.Screen("")
+	if err != nil || strings.Contains(screen, "seq -f") {
+		t.Fatalf("Screen = %q, %v", screen, err)
+	}
+	scrollback, err := tc.Scrollback("", 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"seq -f line%g 1 80", "\nline1\n", "\nline80\n"} {
+		if !strings.Contains(scrollback, s) {
+			t.Errorf("scrollback lacks %q:\n%s", s, scrollback)
+		}
+	}
+	if _, err := tc.Scrollback("build", 200); err == nil {
+		t.Error("Scrollback of a missing pane succeeded")
+	}
+}
+
+func TestShellIntegration(t *testing.T) {
+	startTmux(t)
+	if _, err := exec.LookPath("bash"); err != nil {
+		t.Skip("bash is not installed")
+	}
+	out, err := exec.Command("tmux", "split-window", "-d", "-P", "-F", "#{pane_id}", "bash --norc --noprofile").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc, err := terminal.NewTerminalController(terminal.PaneOptions{Pane: strings.TrimSpace(string(out)), Integration: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(tc.Stop)
+	if !tc.Integrated() {
+		t.Fatal("the bash pane is not integrated")
+	}
+
+	for command, want := range map[string]int{"true": 0, "false": 1, "sh -c 'exit 3'": 3} {
+		res, err := tc.Execute(command)
+		if err != nil || res.ExitCode != want {
+			t.Errorf("Execute(%q) = %d, %v, want exit code %d", command, res.ExitCode, err, want)
+		}
+	}
+
+	// Typed by the user, with colors
+	if err := exec.Command("tmux", "send-keys", "-t", tc.Pane(), `printf 'a\033[31mb\033[0m\nc\n'; (exit 2)`, "Enter").Run(); err != nil {
+		t.Fatal(err)
+	}
+	var records []terminal.CommandRecord
+	for tries := 0; tries < 20; tries++ {
+		if records, err = tc.Timeline(""); err != nil {
+			t.Fatal(err)
+		}
+		if len(records) == 4 {
+			break
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	if len(records) != 4 {
+		t.Fatalf("timeline = %+v", records)
+	}
+	last := records[3]
+	if last.Command != `printf 'a\033[31mb\033[0m\nc\n'; (exit 2)` || last.Output != "ab\nc" || last.ExitCode != 2 || last.Cwd == "" {
+		t.Errorf("last record = %+v", last)
+	}
+
+	// Past a megabyte of output the pane is piped to a new file, and the
+	// commands after it are still parsed
+	if err := exec.Command("tmux", "send-keys", "-t", tc.Pane(), "yes 0123456789012345678901234567890123456789 | head -n 40000", "Enter").Run(); err != nil {
+		t.Fatal(err)
+	}
+	for tries := 0; tries < 100 && len(records) < 5; tries++ {
+		time.Sleep(100 * time.Millisecond)
+		records, _ = tc.Timeline("")
+	}
+	if res, err := tc.Execute("false"); err != nil || res.ExitCode != 1 {
+		t.Errorf("Execute after a large output = %d, %v", res.ExitCode, err)
+	}
+}
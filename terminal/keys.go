@@ -0,0 +1,206 @@
+package terminal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// Action is something the user can bind keys to in the [keys] section
+type Action string
+
+const (
+	ActionCancel     Action = "cancel"      // stop the model while it is working
+	ActionQuit       Action = "quit"        // exit aiterm
+	ActionFocusChat  Action = "focus-chat"  // move from the input to the transcript
+	ActionFocusInput Action = "focus-input" // move from the transcript to the input
+	ActionScrollUp   Action = "scroll-up"   // scroll the transcript a page up
+	ActionScrollDown Action = "scroll-down" // scroll the transcript a page down
+	ActionApprove    Action = "approve"     // run the command being approved
+	ActionReject     Action = "reject"      // skip the command being approved
+	ActionExplain    Action = "explain"     // explain the last command of the main pane
+)
+
+var defaultKeys = map[Action]string{
+	ActionCancel:     "ctrl+c",
+	ActionQuit:       "ctrl+q, ctrl+c",
+	ActionFocusChat:  "esc",
+	ActionFocusInput: "esc, tab, backtab",
+	ActionScrollUp:   "pgup",
+	ActionScrollDown: "pgdn",
+	ActionApprove:    "y",
+	ActionReject:     "n",
+	ActionExplain:    "alt+e",
+}
+
+// Chord is a key with its modifiers, such as ctrl+c or alt+enter
+type Chord struct {
+	Key  tcell.Key
+	Rune rune          // when Key is tcell.KeyRune
+	Mod  tcell.ModMask // modifiers besides the Ctrl folded into Ctrl+letter keys
+}
+
+// keyNames maps lower case key names to keys, from the names tcell uses
+var keyNames = func() map[string]tcell.Key {
+	names := map[string]tcell.Key{
+		"escape":   tcell.KeyEscape,
+		"return":   tcell.KeyEnter,
+		"pageup":   tcell.KeyPgUp,
+		"pagedown": tcell.KeyPgDn,
+		"del":      tcell.KeyDelete,
+	}
+	for key, name := range tcell.KeyNames {
+		if !strings.HasPrefix(name, "Ctrl-") {
+			names[strings.ToLower(name)] = key
+		}
+	}
+	return names
+}()
+
+// ParseChord parses a chord such as "ctrl+c", "alt+enter", "pgup" or "q"
+func ParseChord(s string) (Chord, error) {
+	parts := strings.Split(strings.TrimSpace(s), "+")
+	// "+" itself or a chord ending with it, like "ctrl++"
+	if n := len(parts); n > 1 && parts[n-1] == "" && parts[n-2] == "" {
+		parts = append(parts[:n-2], "+")
+	}
+	name := parts[len(parts)-1]
+	var c Chord
+	ctrl := false
+	for _, m := range parts[:len(parts)-1] {
+		switch strings.ToLower(m) {
+		case "ctrl", "control":
+			ctrl = true
+		case "alt", "meta":
+			c.Mod |= tcell.ModAlt
+		case "shift":
+			c.Mod |= tcell.ModShift
+		default:
+			return Chord{}, fmt.Errorf("unknown modifier %q in %q", m, s)
+		}
+	}
+
+	runes := []rune(name)
+	if len(runes) > 1 {
+		name = strings.ToLower(name)
+	}
+	switch {
+	case name == "":
+		return Chord{}, fmt.Errorf("missing key in %q", s)
+	case name == "space":
+		c.Key, c.Rune = tcell.KeyRune, ' '
+	case len(runes) == 1:
+		r := runes[0]
+		if ctrl {
+			r = unicode.ToLower(r)
+			if r < 'a' || r > 'z' {
+				return Chord{}, fmt.Errorf("ctrl only combines with letters and named keys, not %q", s)
+			}
+			return Chord{Key: tcell.KeyCtrlA + tcell.Key(r-'a'), Mod: c.Mod}, nil
+		}
+		c.Key, c.Rune = tcell.KeyRune, r
+	default:
+		key, ok := keyNames[name]
+		if !ok {
+			return Chord{}, fmt.Errorf("unknown key %q in %q", name, s)
+		}
+		c.Key = key
+	}
+	if ctrl {
+		c.Mod |= tcell.ModCtrl
+	}
+	return c, nil
+}
+
+// Matches reports whether the key event is the chord
+func (c Chord) Matches(event *tcell.EventKey) bool {
+	if event.Key() != c.Key {
+		return false
+	}
+	if c.Key == tcell.KeyRune {
+		// Shift is already in the case of the rune
+		return event.Rune() == c.Rune && event.Modifiers()&tcell.ModAlt == c.Mod&tcell.ModAlt
+	}
+	mask := tcell.ModAlt | tcell.ModShift | tcell.ModCtrl
+	if c.Key >= tcell.KeyCtrlA && c.Key <= tcell.KeyCtrlZ {
+		// Terminals differ in whether they report Ctrl with these
+		mask &^= tcell.ModCtrl
+	}
+	return event.Modifiers()&mask == c.Mod&mask
+}
+
+// KeyMap binds actions to chords
+type KeyMap map[Action][]Chord
+
+// DefaultKeyMap returns the bindings used when the configuration sets none
+func DefaultKeyMap() KeyMap {
+	km, err := ParseKeyMap(nil)
+	if err != nil {
+		panic(err)
+	}
+	return km
+}
+
+// ParseKeyMap builds a key map from the [keys] section, where each action is
+// given a comma separated list of chords. Actions not listed keep their
+// default keys.
+func ParseKeyMap(keys map[string]string) (KeyMap, error) {
+	km := KeyMap{}
+	for action, chords := range defaultKeys {
+		if err := km.bind(action, chords); err != nil {
+			return nil, err
+		}
+	}
+	names := make([]string, 0, len(keys))
+	for name := range keys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		action := Action(name)
+		if _, ok := defaultKeys[action]; !ok {
+			return nil, fmt.Errorf("unknown action %q, expected one of %s", name, strings.Join(actionNames(), ", "))
+		}
+		if err := km.bind(action, keys[name]); err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return km, nil
+}
+
+func (km KeyMap) bind(action Action, chords string) error {
+	km[action] = nil
+	for _, s := range strings.Split(chords, ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		c, err := ParseChord(s)
+		if err != nil {
+			return err
+		}
+		km[action] = append(km[action], c)
+	}
+	return nil
+}
+
+// Matches reports whether the key event is bound to the action
+func (km KeyMap) Matches(action Action, event *tcell.EventKey) bool {
+	for _, c := range km[action] {
+		if c.Matches(event) {
+			return true
+		}
+	}
+	return false
+}
+
+func actionNames() []string {
+	var names []string
+	for action := range defaultKeys {
+		names = append(names, string(action))
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,96 @@
+package terminal_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aki-colt/aiterm/terminal"
+	"github.com/gdamore/tcell/v2"
+)
+
+func TestParseChord(t *testing.T) {
+	tests := []struct {
+		chord string
+		event *tcell.EventKey
+		match bool
+	}{
+		{"ctrl+c", tcell.NewEventKey(tcell.KeyCtrlC, 0, tcell.ModCtrl), true},
+		{"Ctrl+C", tcell.NewEventKey(tcell.KeyCtrlC, 0, tcell.ModNone), true},
+		{"ctrl+c", tcell.NewEventKey(tcell.KeyCtrlD, 0, tcell.ModCtrl), false},
+		{"esc", tcell.NewEventKey(tcell.KeyEscape, 0, tcell.ModNone), true},
+		{"alt+enter", tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModAlt), true},
+		{"alt+enter", tcell.NewEventKey(tcell.KeyEnter, 0, tcell.ModNone), false},
+		{"pgup", tcell.NewEventKey(tcell.KeyPgUp, 0, tcell.ModNone), true},
+		{"F2", tcell.NewEventKey(tcell.KeyF2, 0, tcell.ModNone), true},
+		{"y", tcell.NewEventKey(tcell.KeyRune, 'y', tcell.ModNone), true},
+		{"Y", tcell.NewEventKey(tcell.KeyRune, 'y', tcell.ModNone), false},
+		{"alt+x", tcell.NewEventKey(tcell.KeyRune, 'x', tcell.ModAlt), true},
+		{"space", tcell.NewEventKey(tcell.KeyRune, ' ', tcell.ModNone), true},
+		{"+", tcell.NewEventKey(tcell.KeyRune, '+', tcell.ModNone), true},
+	}
+	for _, tt := range tests {
+		c, err := terminal.ParseChord(tt.chord)
+		if err != nil {
+			t.Errorf("ParseChord(%q): %v", tt.chord, err)
+			continue
+		}
+		if got := c.Matches(tt.event); got != tt.match {
+			t.Errorf("%q matches %v = %v, want %v", tt.chord, tt.event.Name(), got, tt.match)
+		}
+	}
+
+	for _, bad := range []string{"", "ctrl+", "hyper+a", "ctrl+1", "bogus"} {
+		if _, err := terminal.ParseChord(bad); err == nil {
+			t.Errorf("ParseChord(%q) accepted", bad)
+		}
+	}
+}
+
+func TestParseKeyMap(t *testing.T) {
+	km, err := terminal.ParseKeyMap(map[string]string{"quit": "ctrl+x, f10", "cancel": "esc"})
+	if err != nil {
+		t.Fatalf("ParseKeyMap: %v", err)
+	}
+	if !km.Matches(terminal.ActionQuit, tcell.NewEventKey(tcell.KeyF10, 0, tcell.ModNone)) {
+		t.Error("quit is not bound to f10")
+	}
+	if km.Matches(terminal.ActionQuit, tcell.NewEventKey(tcell.KeyCtrlQ, 0, tcell.ModCtrl)) {
+		t.Error("quit kept its default key")
+	}
+	if !km.Matches(terminal.ActionApprove, tcell.NewEventKey(tcell.KeyRune, 'y', tcell.ModNone)) {
+		t.Error("approve lost its default key")
+	}
+
+	for keys, want := range map[string]map[string]string{
+		`unknown action "launch"`: {"launch": "x"},
+		`cancel: unknown key`:     {"cancel": "ctrl+c, hyperdrive"},
+	} {
+		if _, err := terminal.ParseKeyMap(want); err == nil || !strings.Contains(err.Error(), keys) {
+			t.Errorf("ParseKeyMap(%v) = %v, want %q", want, err, keys)
+		}
+	}
+}
+
+func TestParseTheme(t *testing.T) {
+	theme, err := terminal.ParseTheme(map[string]string{"user": "#ff8700", "tool": "default"})
+	if err != nil {
+		t.Fatalf("ParseTheme: %v", err)
+	}
+	if theme[terminal.RoleUser] != "#ff8700" || theme[terminal.RoleTool] != "" || theme[terminal.RoleError] != "red" {
+		t.Errorf("theme = %v", theme)
+	}
+
+	tr := terminal.NewTranscript()
+	tr.SetTheme(theme)
+	tr.AddUser("hi")
+	if got := tr.Render(); !strings.Contains(got, "[#ff8700]You: hi[-]") {
+		t.Errorf("Render = %q", got)
+	}
+
+	if _, err := terminal.ParseTheme(map[string]string{"user": "blurple"}); err == nil || !strings.Contains(err.Error(), `unknown color "blurple"`) {
+		t.Errorf("bad color: %v", err)
+	}
+	if _, err := terminal.ParseTheme(map[string]string{"system": "red"}); err == nil {
+		t.Error("unknown role accepted")
+	}
+}
@@ -0,0 +1,190 @@
+package terminal
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/alecthomas/chroma/v2"
+	"github.com/alecthomas/chroma/v2/lexers"
+	"github.com/alecthomas/chroma/v2/styles"
+	"github.com/rivo/tview"
+)
+
+var (
+	fenceRe   = regexp.MustCompile("^\\s*(```+|~~~+)\\s*([\\w+#.-]*)")
+	headingRe = regexp.MustCompile(`^#{1,6}\s+(.*)$`)
+	bulletRe  = regexp.MustCompile(`^(\s*)[-*+]\s+(.*)$`)
+	quoteRe   = regexp.MustCompile(`^>\s?(.*)$`)
+	ruleRe    = regexp.MustCompile(`^\s*(-\s*){3,}$|^\s*(\*\s*){3,}$|^\s*(_\s*){3,}$`)
+)
+
+// codeStyle is the chroma style used to highlight code blocks
+var codeStyle = styles.Get("monokai")
+
+// MarkdownRenderer turns streamed Markdown into tview-tagged text. Text is
+// rendered a line at a time, so formatting never breaks where a delta was
+// split, and everything from the model is escaped so stray brackets are not
+// taken for color tags.
+type MarkdownRenderer struct {
+	pending string // text after the last newline
+	fence   string // the opening fence while inside a code block
+	lexer   chroma.Lexer
+	code    strings.Builder
+	blocks  []string // finished code blocks, for copying
+	first   int      // number of the first code block
+}
+
+func NewMarkdownRenderer() *MarkdownRenderer {
+	return &MarkdownRenderer{first: 1}
+}
+
+// NumberFrom makes code blocks numbered from n, so that numbers stay unique
+// across the replies of a session
+func (r *MarkdownRenderer) NumberFrom(n int) *MarkdownRenderer {
+	r.first = n
+	return r
+}
+
+// Write adds a delta and returns the rendering of the lines it completed
+func (r *MarkdownRenderer) Write(delta string) string {
+	r.pending += delta
+	i := strings.LastIndexByte(r.pending, '\n')
+	if i < 0 {
+		return ""
+	}
+	lines := strings.Split(r.pending[:i], "\n")
+	r.pending = r.pending[i+1:]
+
+	var sb strings.Builder
+	for _, line := range lines {
+		sb.WriteString(r.renderLine(line))
+		sb.WriteString("\n")
+	}
+	return sb.String()
+}
+
+// Flush renders the incomplete last line, if any. It is called when the
+// model stops writing, and leaves an open code block open.
+func (r *MarkdownRenderer) Flush() string {
+	if r.pending == "" {
+		return ""
+	}
+	line := r.pending
+	r.pending = ""
+	return r.renderLine(line)
+}
+
+// CodeBlocks returns the content of the code blocks rendered so far
+func (r *MarkdownRenderer) CodeBlocks() []string {
+	return r.blocks
+}
+
+func (r *MarkdownRenderer) renderLine(line string) string {
+	if m := fenceRe.FindStringSubmatch(line); m != nil {
+		if r.fence == "" {
+			r.fence = m[1]
+			r.lexer = lexers.Get(m[2])
+			if r.lexer == nil {
+				r.lexer = lexers.Fallback
+			}
+			r.lexer = chroma.Coalesce(r.lexer)
+			r.code.Reset()
+			label := m[2]
+			if label == "" {
+				label = "code"
+			}
+			return fmt.Sprintf("[gray]┌─ %s #%d[-]", tview.Escape(label), r.first+len(r.blocks))
+		}
+		if strings.HasPrefix(strings.TrimSpace(line), r.fence) && m[2] == "" {
+			r.fence = ""
+			r.blocks = append(r.blocks, strings.TrimSuffix(r.code.String(), "\n"))
+			return "[gray]└─[-]"
+		}
+	}
+	if r.fence != "" {
+		r.code.WriteString(line + "\n")
+		return "[gray]│[-] " + highlight(r.lexer, line)
+	}
+
+	switch {
+	case ruleRe.MatchString(line):
+		return "[gray]" + strings.Repeat("─", 40) + "[-]"
+	case headingRe.MatchString(line):
+		return "[::b]" + renderInline(headingRe.FindStringSubmatch(line)[1]) + "[::-]"
+	case bulletRe.MatchString(line):
+		m := bulletRe.FindStringSubmatch(line)
+		return m[1] + "• " + renderInline(m[2])
+	case quoteRe.MatchString(line):
+		return "[gray]│ " + renderInline(quoteRe.FindStringSubmatch(line)[1]) + "[-]"
+	}
+	return renderInline(line)
+}
+
+// highlight colors a line of code with the chroma lexer
+func highlight(lexer chroma.Lexer, line string) string {
+	it, err := lexer.Tokenise(nil, line)
+	if err != nil {
+		return tview.Escape(line)
+	}
+	var sb strings.Builder
+	for _, token := range it.Tokens() {
+		text := tview.Escape(strings.TrimSuffix(token.Value, "\n"))
+		entry := codeStyle.Get(token.Type)
+		if entry.Colour.IsSet() && text != "" {
+			fmt.Fprintf(&sb, "[%s]%s[-]", entry.Colour.String(), text)
+		} else {
+			sb.WriteString(text)
+		}
+	}
+	return sb.String()
+}
+
+// renderInline renders code spans, bold, italics and links
+func renderInline(s string) string {
+	var sb, plain strings.Builder
+	flush := func() {
+		sb.WriteString(tview.Escape(plain.String()))
+		plain.Reset()
+	}
+	for i := 0; i < len(s); {
+		rest := s[i:]
+		switch {
+		case rest[0] == '`':
+			if j := strings.IndexByte(rest[1:], '`'); j >= 0 {
+				flush()
+				sb.WriteString("[yellow]" + tview.Escape(rest[1:j+1]) + "[-]")
+				i += j + 2
+				continue
+			}
+		case strings.HasPrefix(rest, "**"), strings.HasPrefix(rest, "__"):
+			if j := strings.Index(rest[2:], rest[:2]); j > 0 {
+				flush()
+				sb.WriteString("[::b]" + renderInline(rest[2:j+2]) + "[::-]")
+				i += j + 4
+				continue
+			}
+		case rest[0] == '*' && len(rest) > 1 && rest[1] != ' ' && rest[1] != '*':
+			if j := strings.IndexByte(rest[1:], '*'); j > 0 {
+				flush()
+				sb.WriteString("[::i]" + renderInline(rest[1:j+1]) + "[::-]")
+				i += j + 2
+				continue
+			}
+		case rest[0] == '[':
+			if end := strings.Index(rest, "]("); end > 0 {
+				if close := strings.IndexByte(rest[end:], ')'); close > 0 {
+					flush()
+					text, url := rest[1:end], rest[end+2:end+close]
+					sb.WriteString(renderInline(text) + " [blue::u]" + tview.Escape(url) + "[-::-]")
+					i += end + close + 1
+					continue
+				}
+			}
+		}
+		plain.WriteByte(s[i])
+		i++
+	}
+	flush()
+	return sb.String()
+}
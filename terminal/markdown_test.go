@@ -0,0 +1,60 @@
+package terminal_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/aki-colt/aiterm/terminal"
+	"github.com/rivo/tview"
+)
+
+// plain strips the tview tags from rendered text
+func plain(t *testing.T, rendered string) string {
+	t.Helper()
+	tv := tview.NewTextView().SetDynamicColors(true)
+	tv.SetText(rendered)
+	return tv.GetText(true)
+}
+
+func TestMarkdownInline(t *testing.T) {
+	r := terminal.NewMarkdownRenderer()
+	got := r.Write("Use **bold**, *it*, `ls [red]` and [docs](http://x) for [red]tags[-]\n")
+	want := "Use [::b]bold[::-], [::i]it[::-], [yellow]ls [red[][-] and docs [blue::u]http://x[-::-] for [red[]tags[-[]\n"
+	if got != want {
+		t.Errorf("Write =\n%q\nwant\n%q", got, want)
+	}
+	if p := plain(t, got); p != "Use bold, it, ls [red] and docs http://x for [red]tags[-]\n" {
+		t.Errorf("plain = %q", p)
+	}
+}
+
+func TestMarkdownStreaming(t *testing.T) {
+	whole := "# Title\n- one **two**\n> quoted\n"
+	want := terminal.NewMarkdownRenderer().Write(whole)
+
+	// Splitting the text anywhere gives the same rendering
+	for split := 1; split < len(whole); split++ {
+		r := terminal.NewMarkdownRenderer()
+		got := r.Write(whole[:split]) + r.Write(whole[split:]) + r.Flush()
+		if got != want {
+			t.Fatalf("split at %d: %q, want %q", split, got, want)
+		}
+	}
+}
+
+func TestMarkdownCodeBlocks(t *testing.T) {
+	r := terminal.NewMarkdownRenderer()
+	out := r.Write("Run:\n```bash\necho \"[red]hi\"\nls -la\n```\nthen\n```\nplain\n")
+	out += r.Flush()
+
+	text := plain(t, out)
+	for _, want := range []string{"┌─ bash #1", "│ echo \"[red]hi\"", "└─", "┌─ code #2", "│ plain"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("rendering lacks %q:\n%s", want, text)
+		}
+	}
+	blocks := r.CodeBlocks()
+	if len(blocks) != 1 || blocks[0] != "echo \"[red]hi\"\nls -la" {
+		t.Errorf("CodeBlocks = %q", blocks)
+	}
+}
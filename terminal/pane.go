@@ -0,0 +1,104 @@
+package terminal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// PaneOptions chooses the tmux pane commands run in, from the -pane, -split,
+// -size, -window, -keep-pane and -shell-integration flags and the [tmux]
+// section
+type PaneOptions struct {
+	Pane        string // an existing pane to run commands in, e.g. %3
+	Vertical    bool   // split top and bottom rather than side by side
+	Size        int    // percent of the window given to a new pane, half when 0
+	Window      bool   // open a new window rather than splitting
+	Keep        bool   // leave a new pane open on exit
+	Integration bool   // mark the commands of the panes with OSC 133
+}
+
+// newPaneArgs returns the tmux command opening a pane and printing its ID
+func (opts PaneOptions) newPaneArgs() []string {
+	if opts.Window {
+		return []string{"new-window", "-d", "-P", "-F", "#{pane_id}"}
+	}
+	args := []string{"split-window", "-h", "-d", "-P", "-F", "#{pane_id}"}
+	if opts.Vertical {
+		args[1] = "-v"
+	}
+	if opts.Size > 0 {
+		args = append(args, "-l", strconv.Itoa(opts.Size)+"%")
+	}
+	return args
+}
+
+// Pane is a tmux pane as listed by ListPanes
+type Pane struct {
+	ID       string // e.g. %3
+	Location string // session:window.pane
+	Command  string // the program running in the pane
+	Path     string // its working directory
+}
+
+func (p Pane) String() string {
+	return fmt.Sprintf("%s %s %s %s", p.ID, p.Location, p.Command, p.Path)
+}
+
+// ListPanes returns the panes of the tmux server, except the one aiterm runs in
+func ListPanes() ([]Pane, error) {
+	cmd := exec.Command("tmux", "list-panes", "-a", "-F",
+		"#{pane_id}\t#{session_name}:#{window_index}.#{pane_index}\t#{pane_current_command}\t#{pane_current_path}")
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("error listing tmux panes: %w", err)
+	}
+	var panes []Pane
+	for _, line := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		f := strings.SplitN(line, "\t", 4)
+		if len(f) < 4 || f[0] == os.Getenv("TMUX_PANE") {
+			continue
+		}
+		panes = append(panes, Pane{ID: f[0], Location: f[1], Command: f[2], Path: f[3]})
+	}
+	return panes, nil
+}
+
+// PickPane lists the panes on out and reads the number of one from in
+func PickPane(in io.Reader, out io.Writer) (string, error) {
+	panes, err := ListPanes()
+	if err != nil {
+		return "", err
+	}
+	if len(panes) == 0 {
+		return "", fmt.Errorf("no other tmux pane to run commands in")
+	}
+	for i, p := range panes {
+		fmt.Fprintf(out, "%d) %s\n", i+1, p)
+	}
+	fmt.Fprint(out, "Run commands in pane: ")
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line))
+	if err != nil || n < 1 || n > len(panes) {
+		return "", fmt.Errorf("no pane %q", strings.TrimSpace(line))
+	}
+	return panes[n-1].ID, nil
+}
+
+// paneID checks that target names a pane and returns its ID
+func paneID(target string) (string, error) {
+	// tmux prints nothing rather than failing for some missing targets
+	output, err := exec.Command("tmux", "display-message", "-p", "-t", target, "#{pane_id}").Output()
+	id := strings.TrimSpace(string(output))
+	if err != nil || id == "" {
+		return "", fmt.Errorf("no tmux pane %s", target)
+	}
+	return id, nil
+}
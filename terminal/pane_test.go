@@ -0,0 +1,181 @@
+package terminal_test
+
+import (
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aki-colt/aiterm/terminal"
+)
+
+// startTmux starts a private tmux server with one pane and points $TMUX at it
+func startTmux(t *testing.T) {
+	t.Helper()
+	if _, err := exec.LookPath("tmux"); err != nil {
+		t.Skip("tmux is not installed")
+	}
+	sock := filepath.Join(t.TempDir(), "tmux.sock")
+	if err := exec.Command("tmux", "-S", sock, "new-session", "-d", "-s", "test", "-x", "160", "-y", "50", "sh").Run(); err != nil {
+		t.Fatalf("starting tmux: %v", err)
+	}
+	t.Cleanup(func() { exec.Command("tmux", "-S", sock, "kill-server").Run() })
+	// New panes start quickly without the user's shell and its startup files
+	exec.Command("tmux", "-S", sock, "set-option", "-g", "default-shell", "/bin/sh").Run()
+	pid, err := exec.Command("tmux", "-S", sock, "display-message", "-p", "-t", "test", "#{pid}").Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("TMUX", sock+","+strings.TrimSpace(string(pid))+",0")
+	t.Setenv("TMUX_PANE", "")
+}
+
+func paneIDs(t *testing.T) []string {
+	t.Helper()
+	panes, err := terminal.ListPanes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, p := range panes {
+		ids = append(ids, p.ID)
+	}
+	return ids
+}
+
+func hasPane(t *testing.T, id string) bool {
+	for _, p := range paneIDs(t) {
+		if p == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestNewPane(t *testing.T) {
+	startTmux(t)
+	for _, opts := range []terminal.PaneOptions{
+		{},
+		{Vertical: true, Size: 30},
+		{Window: true},
+	} {
+		tc, err := terminal.NewTerminalController(opts)
+		if err != nil {
+			t.Fatalf("%+v: %v", opts, err)
+		}
+		if !hasPane(t, tc.Pane()) {
+			t.Errorf("%+v: pane %s not opened", opts, tc.Pane())
+		}
+		tc.Stop()
+		if hasPane(t, tc.Pane()) {
+			t.Errorf("%+v: pane %s left open", opts, tc.Pane())
+		}
+	}
+
+	tc, err := terminal.NewTerminalController(terminal.PaneOptions{Keep: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.Stop()
+	if !hasPane(t, tc.Pane()) {
+		t.Errorf("kept pane %s was closed", tc.Pane())
+	}
+}
+
+func TestAttachPane(t *testing.T) {
+	startTmux(t)
+	ids := paneIDs(t)
+	if len(ids) != 1 {
+		t.Fatalf("panes = %v", ids)
+	}
+
+	tc, err := terminal.NewTerminalController(terminal.PaneOptions{Pane: ids[0], Size: 30})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tc.Pane() != ids[0] || len(paneIDs(t)) != 1 {
+		t.Errorf("attached to %s, panes %v", tc.Pane(), paneIDs(t))
+	}
+	tc.Stop()
+	if !hasPane(t, ids[0]) {
+		t.Error("attached pane was closed")
+	}
+
+	if _, err := terminal.NewTerminalController(terminal.PaneOptions{Pane: "%99"}); err == nil {
+		t.Error("attached to a missing pane")
+	}
+	t.Setenv("TMUX_PANE", ids[0])
+	if _, err := terminal.NewTerminalController(terminal.PaneOptions{Pane: "test:0.0"}); err == nil {
+		t.Error("attached to the pane of aiterm")
+	}
+}
+
+func TestPickPane(t *testing.T) {
+	startTmux(t)
+	ids := paneIDs(t)
+	var out strings.Builder
+	id, err := terminal.PickPane(strings.NewReader("1\n"), &out)
+	if err != nil || id != ids[0] {
+		t.Errorf("PickPane = %q, %v", id, err)
+	}
+	if !strings.Contains(out.String(), "1) "+ids[0]+" test:0.0") {
+		t.Errorf("list = %q", out.String())
+	}
+	if _, err := terminal.PickPane(strings.NewReader("7\n"), &out); err == nil {
+		t.Error("picked a missing pane")
+	}
+}
+
+func TestPanePool(t *testing.T) {
+	startTmux(t)
+	tc, err := terminal.NewTerminalController(terminal.PaneOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tc.Stop()
+
+	if err := tc.OpenPane("server"); err != nil {
+		t.Fatalf("OpenPane: %v", err)
+	}
+	for _, name := range []string{"server", "Bad Name"} {
+		if err := tc.OpenPane(name); err == nil {
+			t.Errorf("OpenPane(%q) succeeded", name)
+		}
+	}
+	if names := tc.PaneNames(); strings.Join(names, ",") != "main,server" {
+		t.Errorf("PaneNames = %v", names)
+	}
+	dir := t.TempDir()
+	if _, err := tc.ExecuteIn("server", "cd "+dir); err != nil {
+		t.Fatalf("ExecuteIn: %v", err)
+	}
+	// The keys wait in the pane until its shell has started
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		res, err := tc.ExecuteIn("server", "pwd")
+		if err == nil && res.Cwd == dir {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server pane is in %s, want %s", res.Cwd, dir)
+		}
+	}
+	if cwd, _ := tc.Cwd(); cwd == dir {
+		t.Error("the main pane moved with the server pane")
+	}
+	if _, err := tc.ExecuteIn("tests", "ls"); err == nil {
+		t.Error("ran in a missing pane")
+	}
+
+	if err := tc.ClosePane(terminal.MainPane); err == nil {
+		t.Error("closed the main pane")
+	}
+	before := len(paneIDs(t))
+	if err := tc.ClosePane("server"); err != nil {
+		t.Fatalf("ClosePane: %v", err)
+	}
+	if after := len(paneIDs(t)); after != before-1 {
+		t.Errorf("%d panes after closing, %d before", after, before)
+	}
+}
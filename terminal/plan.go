@@ -0,0 +1,209 @@
+package terminal
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/aki-colt/aiterm/ai"
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+// PlanPage is the name of the page where a proposed plan is reviewed
+const PlanPage = "plan"
+
+// planHelp lists the keys of the plan editor
+const planHelp = "[gray]Enter approve  Esc reject  e edit  a add  d delete  J/K move down/up[-]"
+
+// PlanEditor is a checklist of the steps of a proposed plan. Up/Down select a
+// step, e edits it, a adds one after it, d deletes it, J/K or Alt+Down/Up move
+// it, Enter approves the plan and Esc rejects it.
+type PlanEditor struct {
+	*tview.Flex
+	app   *tview.Application
+	list  *tview.List
+	input *tview.InputField
+	steps []string
+	// edited is the step being edited, -1 when none; added tells whether it
+	// was just added, and is dropped if the edit is canceled
+	edited int
+	added  bool
+	done   func(steps []string, ok bool)
+}
+
+func NewPlanEditor(app *tview.Application, steps []string) *PlanEditor {
+	e := &PlanEditor{
+		Flex:   tview.NewFlex().SetDirection(tview.FlexRow),
+		app:    app,
+		list:   tview.NewList().ShowSecondaryText(false).SetHighlightFullLine(true),
+		input:  tview.NewInputField().SetLabel("Step: "),
+		steps:  slices.Clone(steps),
+		edited: -1,
+	}
+	e.list.SetInputCapture(e.listKey)
+	e.input.SetDoneFunc(e.endEdit)
+	e.AddItem(e.list, 0, 1, true).
+		AddItem(e.input, 0, 0, false).
+		AddItem(tview.NewTextView().SetDynamicColors(true).SetText(planHelp), 1, 0, false)
+	e.SetBorder(true).SetTitle(" Proposed plan ")
+	e.refresh(0)
+	return e
+}
+
+// SetDoneFunc sets the function called with the steps when the plan is
+// approved, or with ok false when it is rejected
+func (e *PlanEditor) SetDoneFunc(done func(steps []string, ok bool)) *PlanEditor {
+	e.done = done
+	return e
+}
+
+// Steps returns the steps as edited
+func (e *PlanEditor) Steps() []string {
+	return slices.Clone(e.steps)
+}
+
+// refresh shows the steps and selects the i-th
+func (e *PlanEditor) refresh(i int) {
+	e.list.Clear()
+	for n, s := range e.steps {
+		e.list.AddItem(fmt.Sprintf("%d. %s", n+1, tview.Escape(s)), "", 0, nil)
+	}
+	if len(e.steps) > 0 {
+		e.list.SetCurrentItem(max(0, min(i, len(e.steps)-1)))
+	}
+}
+
+func (e *PlanEditor) listKey(event *tcell.EventKey) *tcell.EventKey {
+	i := e.list.GetCurrentItem()
+	switch {
+	case event.Key() == tcell.KeyEnter:
+		if e.done != nil {
+			e.done(e.Steps(), len(e.steps) > 0)
+		}
+	case event.Key() == tcell.KeyEscape:
+		if e.done != nil {
+			e.done(nil, false)
+		}
+	case event.Rune() == 'e' && len(e.steps) > 0:
+		e.edit(i, false)
+	case event.Rune() == 'a':
+		if len(e.steps) > 0 {
+			i++
+		}
+		e.steps = slices.Insert(e.steps, i, "")
+		e.refresh(i)
+		e.edit(i, true)
+	case (event.Rune() == 'd' || event.Key() == tcell.KeyDelete) && len(e.steps) > 0:
+		e.steps = slices.Delete(e.steps, i, i+1)
+		e.refresh(i)
+	case event.Rune() == 'J' || event.Key() == tcell.KeyDown && event.Modifiers()&tcell.ModAlt != 0:
+		e.move(i, i+1)
+	case event.Rune() == 'K' || event.Key() == tcell.KeyUp && event.Modifiers()&tcell.ModAlt != 0:
+		e.move(i, i-1)
+	case event.Rune() == 'j':
+		return tcell.NewEventKey(tcell.KeyDown, 0, tcell.ModNone)
+	case event.Rune() == 'k':
+		return tcell.NewEventKey(tcell.KeyUp, 0, tcell.ModNone)
+	default:
+		return event
+	}
+	return nil
+}
+
+// move swaps the step at i with the one at j
+func (e *PlanEditor) move(i, j int) {
+	if i < 0 || j < 0 || i >= len(e.steps) || j >= len(e.steps) {
+		return
+	}
+	e.steps[i], e.steps[j] = e.steps[j], e.steps[i]
+	e.refresh(j)
+}
+
+// edit shows the input field to change the i-th step
+func (e *PlanEditor) edit(i int, added bool) {
+	e.edited, e.added = i, added
+	e.input.SetText(e.steps[i])
+	e.ResizeItem(e.input, 1, 0)
+	e.app.SetFocus(e.input)
+}
+
+// endEdit keeps the edited step on Enter, unless it is empty
+func (e *PlanEditor) endEdit(key tcell.Key) {
+	i := e.edited
+	text := strings.TrimSpace(e.input.GetText())
+	switch {
+	case key == tcell.KeyEnter && text != "":
+		e.steps[i] = text
+	case key == tcell.KeyEnter || e.added:
+		e.steps = slices.Delete(e.steps, i, i+1)
+	}
+	e.edited = -1
+	e.ResizeItem(e.input, 0, 0)
+	e.refresh(i)
+	e.app.SetFocus(e.list)
+}
+
+// NewPlanReviewer returns a function that shows the steps of a proposed plan
+// in a PlanEditor over pages, and returns them once the user approved them.
+// It blocks until the user answers or ctx is done, so it must not be called
+// from the UI goroutine.
+func NewPlanReviewer(app *tview.Application, pages *tview.Pages) func(ctx context.Context, steps []string) ([]string, bool) {
+	return func(ctx context.Context, steps []string) ([]string, bool) {
+		type reply struct {
+			steps []string
+			ok    bool
+		}
+		answer := make(chan reply, 1)
+		var prev tview.Primitive
+		app.QueueUpdateDraw(func() {
+			prev = app.GetFocus()
+			editor := NewPlanEditor(app, steps).SetDoneFunc(func(steps []string, ok bool) {
+				// Only the first answer counts
+				select {
+				case answer <- reply{steps, ok}:
+				default:
+				}
+			})
+			height := min(len(steps)+8, 24)
+			centered := tview.NewGrid().SetColumns(0, 90, 0).SetRows(0, height, 0).AddItem(editor, 1, 1, 1, 1, 0, 0, true)
+			pages.AddPage(PlanPage, centered, true, true)
+			app.SetFocus(editor)
+		})
+
+		var r reply
+		select {
+		case r = <-answer:
+		case <-ctx.Done():
+		}
+		app.QueueUpdateDraw(func() {
+			pages.RemovePage(PlanPage)
+			if prev != nil {
+				app.SetFocus(prev)
+			}
+		})
+		return r.steps, r.ok
+	}
+}
+
+// stepMarks are the marks of the step statuses in the transcript
+var stepMarks = map[ai.StepStatus]string{
+	ai.StepPending: "[gray]○[-]",
+	ai.StepRunning: "[yellow]◐[-]",
+	ai.StepDone:    "[green]✓[-]",
+	ai.StepFailed:  "[red]✗[-]",
+}
+
+// planChecklist renders a plan with the status of its steps
+func planChecklist(p *ai.Plan) string {
+	var sb strings.Builder
+	sb.WriteString("Plan:")
+	for i, s := range p.Steps {
+		fmt.Fprintf(&sb, "\n %s %d. %s", stepMarks[s.Status], i+1, tview.Escape(s.Text))
+		if s.Note != "" {
+			fmt.Fprintf(&sb, " [gray]%s[-]", tview.Escape(s.Note))
+		}
+	}
+	return sb.String()
+}
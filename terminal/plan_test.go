@@ -0,0 +1,54 @@
+package terminal_test
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/aki-colt/aiterm/terminal"
+	"github.com/gdamore/tcell/v2"
+	"github.com/rivo/tview"
+)
+
+func TestPlanEditor(t *testing.T) {
+	app := tview.NewApplication()
+	e := terminal.NewPlanEditor(app, []string{"install", "migrate", "deploy"})
+	var approved []string
+	var ok bool
+	e.SetDoneFunc(func(steps []string, accepted bool) {
+		approved, ok = steps, accepted
+	})
+	app.SetFocus(e)
+	press := func(keys ...*tcell.EventKey) {
+		for _, k := range keys {
+			e.InputHandler()(k, func(p tview.Primitive) { app.SetFocus(p) })
+		}
+	}
+
+	// Move deploy up, delete migrate, edit install and add a step after it
+	press(key(tcell.KeyDown), key(tcell.KeyDown), typed("K")[0])
+	if got := e.Steps(); !slices.Equal(got, []string{"install", "deploy", "migrate"}) {
+		t.Fatalf("after moving, steps = %q", got)
+	}
+	press(key(tcell.KeyDown), typed("d")[0])
+	press(key(tcell.KeyUp), typed("e")[0])
+	press(typed(" deps")...)
+	press(key(tcell.KeyEnter))
+	press(typed("a")...)
+	press(typed("test")...)
+	press(key(tcell.KeyEnter))
+	// An added step left empty is dropped
+	press(typed("a")...)
+	press(key(tcell.KeyEscape))
+	if got := e.Steps(); !slices.Equal(got, []string{"install deps", "test", "deploy"}) {
+		t.Fatalf("after editing, steps = %q", got)
+	}
+
+	press(key(tcell.KeyEnter))
+	if !ok || !slices.Equal(approved, []string{"install deps", "test", "deploy"}) {
+		t.Errorf("approved %q, %v", approved, ok)
+	}
+	press(key(tcell.KeyEscape))
+	if ok {
+		t.Error("Escape approved the plan")
+	}
+}
@@ -0,0 +1,98 @@
+package terminal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SlashCommand is a command typed in the dialog input, such as "/help"
+type SlashCommand struct {
+	Name string // without the leading slash
+	Args string // argument synopsis shown by /help, e.g. "[file]"
+	Help string
+	// Complete returns candidates for the argument being typed, optional
+	Complete func(arg string) []string
+	// Run executes the command on the UI goroutine
+	Run func(args string) error
+}
+
+// Registry holds the slash commands known to the dialog
+type Registry struct {
+	commands map[string]SlashCommand
+}
+
+func NewRegistry() *Registry {
+	return &Registry{commands: make(map[string]SlashCommand)}
+}
+
+// Register adds a command, replacing any command with the same name
+func (r *Registry) Register(cmd SlashCommand) {
+	r.commands[cmd.Name] = cmd
+}
+
+// Commands returns the registered commands sorted by name
+func (r *Registry) Commands() []SlashCommand {
+	cmds := make([]SlashCommand, 0, len(r.commands))
+	for _, cmd := range r.commands {
+		cmds = append(cmds, cmd)
+	}
+	sort.Slice(cmds, func(i, j int) bool { return cmds[i].Name < cmds[j].Name })
+	return cmds
+}
+
+// IsCommand reports whether the input should be dispatched rather than sent
+// to the model
+func IsCommand(input string) bool {
+	return strings.HasPrefix(input, "/")
+}
+
+// Dispatch runs the command named in the input
+func (r *Registry) Dispatch(input string) error {
+	name, args, _ := strings.Cut(strings.TrimPrefix(strings.TrimSpace(input), "/"), " ")
+	cmd, ok := r.commands[name]
+	if !ok {
+		return fmt.Errorf("unknown command /%s, type /help for the list of commands", name)
+	}
+	return cmd.Run(strings.TrimSpace(args))
+}
+
+// Complete returns the completions of a partially typed command line: command
+// names first, then the arguments of the named command
+func (r *Registry) Complete(text string) []string {
+	if !IsCommand(text) {
+		return nil
+	}
+	name, arg, hasArg := strings.Cut(text[1:], " ")
+	var entries []string
+	if !hasArg {
+		for _, cmd := range r.Commands() {
+			if strings.HasPrefix(cmd.Name, name) {
+				entries = append(entries, "/"+cmd.Name)
+			}
+		}
+		return entries
+	}
+	cmd, ok := r.commands[name]
+	if !ok || cmd.Complete == nil {
+		return nil
+	}
+	for _, candidate := range cmd.Complete(arg) {
+		entries = append(entries, "/"+name+" "+candidate)
+	}
+	return entries
+}
+
+// Help lists the commands with their synopsis
+func (r *Registry) Help() string {
+	var sb strings.Builder
+	sb.WriteString("Commands:")
+	for _, cmd := range r.Commands() {
+		usage := "/" + cmd.Name
+		if cmd.Args != "" {
+			usage += " " + cmd.Args
+		}
+		fmt.Fprintf(&sb, "\n  %-22s %s", usage, cmd.Help)
+	}
+	return sb.String()
+}
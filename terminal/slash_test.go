@@ -0,0 +1,61 @@
+package terminal_test
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aki-colt/aiterm/terminal"
+)
+
+func testRegistry(ran *string) *terminal.Registry {
+	r := terminal.NewRegistry()
+	r.Register(terminal.SlashCommand{Name: "help", Help: "Show commands", Run: func(string) error { *ran = "help"; return nil }})
+	r.Register(terminal.SlashCommand{Name: "history", Help: "Show history", Run: func(string) error { *ran = "history"; return nil }})
+	r.Register(terminal.SlashCommand{
+		Name: "model", Args: "[name]", Help: "Switch model",
+		Complete: func(arg string) []string {
+			var res []string
+			for _, m := range []string{"gpt-4o", "gpt-4o-mini", "o3"} {
+				if strings.HasPrefix(m, arg) {
+					res = append(res, m)
+				}
+			}
+			return res
+		},
+		Run: func(args string) error { *ran = "model " + args; return nil },
+	})
+	return r
+}
+
+func TestRegistryDispatch(t *testing.T) {
+	var ran string
+	r := testRegistry(&ran)
+	if err := r.Dispatch("/model  gpt-4o "); err != nil || ran != "model gpt-4o" {
+		t.Errorf("Dispatch = %v, ran %q", err, ran)
+	}
+	if err := r.Dispatch("/nope"); err == nil {
+		t.Error("Dispatch of unknown command succeeded")
+	}
+}
+
+func TestRegistryComplete(t *testing.T) {
+	var ran string
+	r := testRegistry(&ran)
+	tests := []struct {
+		text string
+		want []string
+	}{
+		{"hello", nil},
+		{"/h", []string{"/help", "/history"}},
+		{"/", []string{"/help", "/history", "/model"}},
+		{"/model gpt", []string{"/model gpt-4o", "/model gpt-4o-mini"}},
+		{"/help x", nil},
+		{"/nope x", nil},
+	}
+	for _, tt := range tests {
+		if got := r.Complete(tt.text); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Complete(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package terminal
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/aki-colt/aiterm/ai"
+	"github.com/rivo/tview"
+)
+
+// StatusBar is the line under the dialog showing the provider and model, the
+// size of the context, the tokens and cost of the session, the working
+// directory and what the agent is doing
+type StatusBar struct {
+	*tview.TextView
+	client   *ai.AiClient
+	provider string
+	models   map[string]ai.ModelInfo
+
+	cost     float64
+	unpriced bool // some responses came from a model without a price
+	cwd      string
+	state    string // empty when idle
+}
+
+func NewStatusBar(client *ai.AiClient, provider string, models map[string]ai.ModelInfo) *StatusBar {
+	s := &StatusBar{
+		TextView: tview.NewTextView().
+			SetDynamicColors(true).
+			SetWrap(false),
+		client:   client,
+		provider: provider,
+		models:   models,
+	}
+	s.SetBackgroundColor(tview.Styles.ContrastBackgroundColor)
+	return s
+}
+
+// SetCwd sets the working directory shown
+func (s *StatusBar) SetCwd(cwd string) {
+	s.cwd = cwd
+	s.Refresh()
+}
+
+// Start shows that a request was sent to the model
+func (s *StatusBar) Start() {
+	s.state = "thinking"
+	s.Refresh()
+}
+
+// Handle updates the status with an agent event
+func (s *StatusBar) Handle(e ai.Event) {
+	switch e.Type {
+	case ai.EventToolCallStarted:
+		s.state = "running " + e.ToolCall.Name
+		var args ai.ToolRequest
+		if e.ToolCall.Name == "executeCommand" && json.Unmarshal([]byte(e.ToolCall.Arguments), &args) == nil {
+			s.state = "running " + args.Cmd
+		}
+	case ai.EventCommandOutput:
+		if e.Cwd != "" && e.Pane == "" {
+			s.cwd = e.Cwd
+		}
+	case ai.EventToolCallFinished:
+		s.state = "thinking"
+	case ai.EventUsage:
+		info := s.models[e.Usage.Model]
+		if info.InputPrice == 0 && info.OutputPrice == 0 {
+			s.unpriced = true
+		}
+		s.cost += info.Cost(*e.Usage)
+	case ai.EventTurnDone:
+		s.state = ""
+	}
+}
+
+// Refresh redraws the status; it must be called on the UI goroutine
+func (s *StatusBar) Refresh() {
+	model := s.client.Model()
+	parts := []string{tview.Escape(model)}
+	if s.provider != "" {
+		parts[0] = tview.Escape(s.provider) + "/" + parts[0]
+	}
+
+	ctx := "ctx " + formatTokens(s.client.ContextTokens())
+	if limit := s.models[model].Context; limit > 0 {
+		ctx += "/" + formatTokens(limit)
+	}
+	usage := s.client.Usage()
+	parts = append(parts, ctx, fmt.Sprintf("↑%s ↓%s", formatTokens(usage.PromptTokens), formatTokens(usage.CompletionTokens)))
+
+	switch {
+	case s.cost > 0 && s.unpriced:
+		parts = append(parts, fmt.Sprintf("≥$%.4f", s.cost))
+	case s.cost > 0:
+		parts = append(parts, fmt.Sprintf("$%.4f", s.cost))
+	case s.unpriced:
+		parts = append(parts, "$?")
+	}
+
+	if s.cwd != "" {
+		parts = append(parts, tview.Escape(s.cwd))
+	}
+	if s.state != "" {
+		parts = append(parts, "[yellow]● "+tview.Escape(s.state)+"[-]")
+	} else {
+		parts = append(parts, "[green]● ready[-]")
+	}
+	s.SetText(" " + strings.Join(parts, " │ "))
+}
+
+// formatTokens shortens a token count, e.g. 12345 to 12.3k
+func formatTokens(n int64) string {
+	switch {
+	case n >= 1_000_000:
+		return fmt.Sprintf("%.1fM", float64(n)/1e6)
+	case n >= 1000:
+		return fmt.Sprintf("%.1fk", float64(n)/1e3)
+	}
+	return fmt.Sprint(n)
+}
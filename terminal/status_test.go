@@ -0,0 +1,44 @@
+package terminal_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/aki-colt/aiterm/ai"
+	"github.com/aki-colt/aiterm/internal/llmtest"
+	"github.com/aki-colt/aiterm/terminal"
+)
+
+func TestStatusBar(t *testing.T) {
+	reply := llmtest.Text("Hi.")
+	reply.PromptTokens, reply.CompletionTokens = 1500, 500
+	srv := llmtest.NewServer(reply)
+	defer srv.Close()
+
+	var status *terminal.StatusBar
+	client := ai.Init(llmtest.NewExecutor(), ai.HandlerFunc(func(e ai.Event) { status.Handle(e) }),
+		ai.AiConfig{URL: srv.URL, Token: "test", Model: "test-model"})
+	status = terminal.NewStatusBar(client, "example.com", map[string]ai.ModelInfo{
+		"test-model": {Context: 128000, InputPrice: 2, OutputPrice: 8},
+	})
+	status.SetCwd("/work")
+
+	status.Start()
+	status.Handle(ai.Event{Type: ai.EventToolCallStarted, ToolCall: &ai.ToolCall{Name: "executeCommand", Arguments: `{"cmd":"make test"}`}})
+	status.Refresh()
+	if text := status.GetText(true); !strings.Contains(text, "running make test") {
+		t.Errorf("status while running = %q", text)
+	}
+
+	if err := client.Run(context.Background(), "hi"); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	status.Refresh()
+	text := status.GetText(true)
+	for _, want := range []string{"example.com/test-model", "ctx 2.0k/128.0k", "↑1.5k ↓500", "$0.0070", "/work", "ready"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("status lacks %q: %q", want, text)
+		}
+	}
+}
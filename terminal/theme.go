@@ -0,0 +1,64 @@
+package terminal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/gdamore/tcell/v2"
+)
+
+// Theme maps transcript roles to tview color names. An empty color leaves the
+// text in the terminal's default color.
+type Theme map[Role]string
+
+var defaultTheme = Theme{
+	RoleUser:      "green",
+	RoleAssistant: "",
+	RoleTool:      "gray",
+	RoleError:     "red",
+}
+
+// DefaultTheme returns the colors used when the configuration sets none
+func DefaultTheme() Theme {
+	theme := Theme{}
+	for role, color := range defaultTheme {
+		theme[role] = color
+	}
+	return theme
+}
+
+// ParseTheme builds a theme from the [theme] section. Colors are names such
+// as "green" or hex values such as "#ff8700".
+func ParseTheme(colors map[string]string) (Theme, error) {
+	theme := DefaultTheme()
+	roles := make([]string, 0, len(colors))
+	for role := range colors {
+		roles = append(roles, role)
+	}
+	sort.Strings(roles)
+	for _, name := range roles {
+		role := Role(name)
+		if _, ok := defaultTheme[role]; !ok {
+			return nil, fmt.Errorf("unknown role %q, expected one of assistant, error, tool, user", name)
+		}
+		color := strings.ToLower(strings.TrimSpace(colors[name]))
+		if color != "" && color != "default" && tcell.GetColor(color) == tcell.ColorDefault {
+			return nil, fmt.Errorf("%s: unknown color %q", name, colors[name])
+		}
+		if color == "default" {
+			color = ""
+		}
+		theme[role] = color
+	}
+	return theme, nil
+}
+
+// colorize wraps tagged text in the color of the role
+func (t Theme) colorize(role Role, text string) string {
+	color := t[role]
+	if color == "" {
+		return text
+	}
+	return "[" + color + "]" + text + "[-]"
+}
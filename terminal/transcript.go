@@ -0,0 +1,339 @@
+package terminal
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/aki-colt/aiterm/ai"
+	"github.com/rivo/tview"
+)
+
+// Role is who a transcript block comes from
+type Role string
+
+const (
+	RoleUser      Role = "user"
+	RoleAssistant Role = "assistant"
+	RoleTool      Role = "tool"
+	RoleError     Role = "error"
+	RoleInfo      Role = "info" // messages from aiterm itself, already tagged
+)
+
+// Block is one message of the transcript
+type Block struct {
+	Role    Role
+	Content string
+	// Tool blocks only
+	ToolCall  *ai.ToolCall
+	Command   string // the command run by executeCommand
+	Pane      string // the pane it ran in, empty for the main pane
+	Output    string // the command output, or the tool result
+	Done      bool
+	Collapsed bool
+
+	rendered   string // cache, valid while !dirty
+	dirty      bool
+	codeBlocks []string
+}
+
+// Transcript is the conversation shown in the dialog, as a list of blocks
+type Transcript struct {
+	blocks []*Block
+	// streaming is true while the last block is an assistant reply being written
+	streaming bool
+	theme     Theme
+	// plan shows the last plan, updated as its steps progress
+	plan   *Block
+	planID int
+}
+
+func NewTranscript() *Transcript {
+	return &Transcript{theme: DefaultTheme()}
+}
+
+// SetTheme sets the colors of the roles
+func (t *Transcript) SetTheme(theme Theme) {
+	t.theme = theme
+	for _, b := range t.blocks {
+		b.dirty = true
+	}
+}
+
+// Blocks returns the blocks of the transcript
+func (t *Transcript) Blocks() []*Block {
+	return t.blocks
+}
+
+func (t *Transcript) add(b *Block) *Block {
+	b.dirty = true
+	t.blocks = append(t.blocks, b)
+	t.streaming = false
+	return b
+}
+
+// AddUser adds a request typed by the user
+func (t *Transcript) AddUser(text string) {
+	t.add(&Block{Role: RoleUser, Content: text})
+}
+
+// AddAssistant adds a complete assistant message
+func (t *Transcript) AddAssistant(text string) {
+	t.add(&Block{Role: RoleAssistant, Content: text})
+}
+
+// AddInfo adds a message from aiterm; text may contain tview tags
+func (t *Transcript) AddInfo(text string) {
+	t.add(&Block{Role: RoleInfo, Content: text})
+}
+
+// AddError adds an error message
+func (t *Transcript) AddError(text string) {
+	t.add(&Block{Role: RoleError, Content: text})
+}
+
+// Clear removes all blocks
+func (t *Transcript) Clear() {
+	t.blocks = nil
+	t.streaming = false
+	t.plan = nil
+}
+
+// Toggle collapses or expands a tool block and reports whether it is one
+func (t *Transcript) Toggle(i int) bool {
+	if i < 0 || i >= len(t.blocks) || t.blocks[i].Role != RoleTool {
+		return false
+	}
+	t.blocks[i].Collapsed = !t.blocks[i].Collapsed
+	t.blocks[i].dirty = true
+	return true
+}
+
+// lastTool returns the most recent tool block for the call
+func (t *Transcript) lastTool(call *ai.ToolCall) *Block {
+	for i := len(t.blocks) - 1; i >= 0; i-- {
+		b := t.blocks[i]
+		if b.Role == RoleTool && call != nil && b.ToolCall != nil && b.ToolCall.ID == call.ID {
+			return b
+		}
+	}
+	return nil
+}
+
+// Handle updates the transcript with an agent event
+func (t *Transcript) Handle(e ai.Event) {
+	switch e.Type {
+	case ai.EventTextDelta:
+		if !t.streaming {
+			t.add(&Block{Role: RoleAssistant})
+			t.streaming = true
+		}
+		b := t.blocks[len(t.blocks)-1]
+		b.Content += e.Text
+		b.dirty = true
+	case ai.EventToolCallStarted:
+		t.add(&Block{Role: RoleTool, ToolCall: e.ToolCall, Collapsed: true})
+	case ai.EventCommandOutput:
+		for i := len(t.blocks) - 1; i >= 0; i-- {
+			if b := t.blocks[i]; b.Role == RoleTool && !b.Done {
+				b.Command = e.Command
+				b.Pane = e.Pane
+				b.Output = e.Output
+				b.dirty = true
+				break
+			}
+		}
+	case ai.EventToolCallFinished:
+		if b := t.lastTool(e.ToolCall); b != nil {
+			if b.Command == "" {
+				b.Output = e.Result
+			}
+			b.Done = true
+			b.dirty = true
+		}
+	case ai.EventRedacted:
+		t.AddInfo("[gray]Masked " + tview.Escape(redactedSummary(e.Redacted)) + " before sending to the model[-]")
+	case ai.EventFix:
+		t.AddInfo(fixSummary(e.Fix))
+	case ai.EventPlan:
+		if t.plan == nil || t.planID != e.Plan.ID {
+			t.plan = t.add(&Block{Role: RoleInfo})
+			t.planID = e.Plan.ID
+		}
+		t.plan.Content = planChecklist(e.Plan)
+		t.plan.dirty = true
+	case ai.EventError:
+		t.AddError(e.Err.Error())
+	case ai.EventTurnDone:
+		t.streaming = false
+	}
+}
+
+// fixSummary describes a verification run of a fix loop
+func fixSummary(f *ai.FixStatus) string {
+	command := tview.Escape(f.Command)
+	switch {
+	case f.Green && f.Attempt == 0:
+		return "[green]" + command + " already succeeds, nothing to fix[-]"
+	case f.Green:
+		return fmt.Sprintf("[green]%s succeeds after %d fixes and %d commands[-]", command, f.Attempt, f.Commands)
+	case f.Done:
+		return fmt.Sprintf("[red]%s still fails with exit code %d, giving up after %d fixes and %d commands[-]", command, f.ExitCode, f.Attempt, f.Commands)
+	}
+	return fmt.Sprintf("[yellow]%s failed with exit code %d, fix %d of %d[-]", command, f.ExitCode, f.Attempt+1, f.Max)
+}
+
+// redactedSummary describes secret counts, e.g. "3 secrets: 2 jwt, 1 secret"
+func redactedSummary(counts map[string]int) string {
+	kinds := make([]string, 0, len(counts))
+	total := 0
+	for kind, n := range counts {
+		kinds = append(kinds, kind)
+		total += n
+	}
+	sort.Strings(kinds)
+	for i, kind := range kinds {
+		kinds[i] = fmt.Sprintf("%d %s", counts[kind], kind)
+	}
+	noun := "secrets"
+	if total == 1 {
+		noun = "secret"
+	}
+	return fmt.Sprintf("%d %s: %s", total, noun, strings.Join(kinds, ", "))
+}
+
+// RegionID is the tview region of the i-th block
+func RegionID(i int) string {
+	return fmt.Sprintf("b%d", i)
+}
+
+// Render returns the transcript as tview-tagged text. Each block is a region
+// so that it can be highlighted.
+func (t *Transcript) Render() string {
+	var sb strings.Builder
+	codeBlocks := 0
+	for i, b := range t.blocks {
+		if b.dirty {
+			b.render(codeBlocks+1, t.theme)
+		}
+		codeBlocks += len(b.codeBlocks)
+		if i > 0 {
+			sb.WriteString("\n\n")
+		}
+		fmt.Fprintf(&sb, `["%s"]%s[""]`, RegionID(i), b.rendered)
+	}
+	return sb.String()
+}
+
+func (b *Block) render(firstCodeBlock int, theme Theme) {
+	b.dirty = false
+	switch b.Role {
+	case RoleUser:
+		b.rendered = theme.colorize(RoleUser, "You: "+tview.Escape(b.Content))
+	case RoleAssistant:
+		md := NewMarkdownRenderer().NumberFrom(firstCodeBlock)
+		b.rendered = theme.colorize(RoleAssistant, "AI:") + " " + strings.TrimSuffix(md.Write(b.Content)+md.Flush(), "\n")
+		b.codeBlocks = md.CodeBlocks()
+	case RoleError:
+		b.rendered = theme.colorize(RoleError, tview.Escape(b.Content))
+	case RoleInfo:
+		b.rendered = b.Content
+	case RoleTool:
+		b.rendered = theme.colorize(RoleTool, b.renderTool())
+	}
+}
+
+// title is the first line of a tool block: the command it ran, prefixed by
+// the pane when not the main one, or the tool call
+func (b *Block) title() string {
+	switch {
+	case b.Command == "":
+		return b.ToolCall.Name + " " + b.ToolCall.Arguments
+	case b.Pane != "":
+		return b.Pane + " $ " + b.Command
+	}
+	return "$ " + b.Command
+}
+
+// renderTool renders a tool call, without its color
+func (b *Block) renderTool() string {
+	marker := "▾"
+	if b.Collapsed {
+		marker = "▸"
+	}
+	if !b.Done {
+		marker = "…"
+	}
+	head := marker + " " + tview.Escape(b.title())
+	if b.Output == "" {
+		return head
+	}
+	lines := strings.Split(b.Output, "\n")
+	if b.Collapsed {
+		if b.Command == "" && len(lines) == 1 {
+			return head + " → " + tview.Escape(b.Output)
+		}
+		return fmt.Sprintf("%s (%d lines)", head, len(lines))
+	}
+	for i, line := range lines {
+		lines[i] = "  " + tview.Escape(line)
+	}
+	return head + "\n" + strings.Join(lines, "\n")
+}
+
+// CodeBlocks returns the code blocks of all assistant replies, numbered as
+// they are shown
+func (t *Transcript) CodeBlocks() []string {
+	t.Render()
+	var blocks []string
+	for _, b := range t.blocks {
+		blocks = append(blocks, b.codeBlocks...)
+	}
+	return blocks
+}
+
+// Yank returns the text of a block to copy: the command of a tool block when
+// it ran one, its content otherwise
+func (t *Transcript) Yank(i int) string {
+	if i < 0 || i >= len(t.blocks) {
+		return ""
+	}
+	b := t.blocks[i]
+	switch b.Role {
+	case RoleTool:
+		if b.Command != "" {
+			return b.Command
+		}
+		return b.Output
+	case RoleInfo:
+		return stripTags(b.Content)
+	}
+	return b.Content
+}
+
+// PlainText returns the whole transcript without tags, for saving
+func (t *Transcript) PlainText() string {
+	var parts []string
+	for _, b := range t.blocks {
+		switch b.Role {
+		case RoleUser:
+			parts = append(parts, "You: "+b.Content)
+		case RoleAssistant:
+			parts = append(parts, "AI: "+b.Content)
+		case RoleTool:
+			parts = append(parts, strings.TrimRight(b.title()+"\n"+b.Output, "\n"))
+		case RoleInfo:
+			parts = append(parts, stripTags(b.Content))
+		default:
+			parts = append(parts, b.Content)
+		}
+	}
+	return strings.Join(parts, "\n\n") + "\n"
+}
+
+// stripTags removes tview tags from text
+func stripTags(text string) string {
+	tv := tview.NewTextView().SetDynamicColors(true).SetRegions(true)
+	tv.SetText(text)
+	return tv.GetText(true)
+}
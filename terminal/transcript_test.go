@@ -0,0 +1,88 @@
+package terminal_test
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/aki-colt/aiterm/ai"
+	"github.com/aki-colt/aiterm/terminal"
+)
+
+func conversation() *terminal.Transcript {
+	tr := terminal.NewTranscript()
+	call := &ai.ToolCall{ID: "1", Name: "executeCommand", Arguments: `{"cmd":"ls"}`}
+	tr.AddUser("list [files]")
+	for _, e := range []ai.Event{
+		{Type: ai.EventTextDelta, Text: "Sure:\n```sh\nls\n"},
+		{Type: ai.EventTextDelta, Text: "```\n"},
+		{Type: ai.EventToolCallStarted, ToolCall: call},
+		{Type: ai.EventCommandOutput, Command: "ls", Output: "a.txt\nb.txt"},
+		{Type: ai.EventToolCallFinished, ToolCall: call, Result: "a.txt\nb.txt"},
+		{Type: ai.EventTextDelta, Text: "Then:\n```\n"},
+		{Type: ai.EventTextDelta, Text: "cat a.txt\n```"},
+		{Type: ai.EventError, Err: errors.New("boom")},
+		{Type: ai.EventTurnDone},
+	} {
+		tr.Handle(e)
+	}
+	return tr
+}
+
+func TestTranscriptBlocks(t *testing.T) {
+	tr := conversation()
+	var roles []terminal.Role
+	for _, b := range tr.Blocks() {
+		roles = append(roles, b.Role)
+	}
+	want := []terminal.Role{terminal.RoleUser, terminal.RoleAssistant, terminal.RoleTool, terminal.RoleAssistant, terminal.RoleError}
+	if !reflect.DeepEqual(roles, want) {
+		t.Fatalf("roles = %v, want %v", roles, want)
+	}
+	tool := tr.Blocks()[2]
+	if tool.Command != "ls" || tool.Output != "a.txt\nb.txt" || !tool.Done || !tool.Collapsed {
+		t.Errorf("tool block = %+v", tool)
+	}
+}
+
+func TestTranscriptRender(t *testing.T) {
+	tr := conversation()
+	text := plain(t, tr.Render())
+	for _, want := range []string{"You: list [files]", "┌─ sh #1", "▸ $ ls (2 lines)", "┌─ code #2", "boom"} {
+		if !strings.Contains(text, want) {
+			t.Errorf("render lacks %q:\n%s", want, text)
+		}
+	}
+	if strings.Contains(text, "  a.txt") {
+		t.Errorf("collapsed tool output is shown:\n%s", text)
+	}
+
+	if !tr.Toggle(2) || tr.Toggle(1) {
+		t.Fatal("Toggle should only accept tool blocks")
+	}
+	if text := plain(t, tr.Render()); !strings.Contains(text, "▾ $ ls\n  a.txt\n  b.txt") {
+		t.Errorf("expanded render:\n%s", text)
+	}
+
+	if got := tr.CodeBlocks(); !reflect.DeepEqual(got, []string{"ls", "cat a.txt"}) {
+		t.Errorf("CodeBlocks = %q", got)
+	}
+}
+
+func TestTranscriptYankAndPlainText(t *testing.T) {
+	tr := conversation()
+	if got := tr.Yank(2); got != "ls" {
+		t.Errorf("Yank(tool) = %q", got)
+	}
+	if got := tr.Yank(0); got != "list [files]" {
+		t.Errorf("Yank(user) = %q", got)
+	}
+	if got := tr.Yank(9); got != "" {
+		t.Errorf("Yank(out of range) = %q", got)
+	}
+	text := tr.PlainText()
+	if !strings.HasPrefix(text, "You: list [files]\n\nAI: Sure:") || !strings.Contains(text, "$ ls\na.txt\nb.txt") {
+		t.Errorf("PlainText =\n%s", text)
+	}
+}